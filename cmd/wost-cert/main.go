@@ -0,0 +1,182 @@
+// wost-cert is the command line tool for managing the Hub CA and certificates.
+// It is a thin wrapper around the certsetup package.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/hubserve-go/pkg/certsetup"
+)
+
+const usage = `Usage: wost-cert [options] <command> [arguments]
+
+Manage the WoST Hub certificate authority and certificates.
+
+Commands:
+  init [-force]                           create the CA if it doesn't exist, or replace it with -force
+  server <name>...                        issue the hub server certificate for the domain names and IP addresses
+  plugin                                  issue the plugin client certificate
+  user [-ou client] [-days 365] <loginID> issue a user client certificate
+  inspect [-days 30] [-json]              list the certificates with their expiry and revocation status
+  revoke [-force] <certFile>              add a certificate to the revocation list. -force revokes it even
+                                          if its serial number is shared with other certificates
+  renew [-days 365] <certFile>            renew a certificate with the same key
+  rotate [-transition 720h] <name>...     replace the CA and reissue the server and plugin certificates,
+                                          while trusting the previous CA during the transition period
+
+The CA key is encrypted when the WOST_KEY_PASSPHRASE environment variable is set during init.
+The same variable must be set for commands that use the CA.
+
+Options:
+`
+
+func main() {
+	binFolder := path.Dir(os.Args[0])
+	if abs, err := filepath.Abs(binFolder); err == nil {
+		binFolder = abs
+	}
+	certFolder := flag.String("certs", path.Join(binFolder, "../certs"), "certificate folder")
+	verbose := flag.Bool("v", false, "verbose logging")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	logrus.SetLevel(logrus.WarnLevel)
+	if *verbose {
+		logrus.SetLevel(logrus.InfoLevel)
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	err := run(*certFolder, flag.Arg(0), flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "wost-cert %s: %s\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+// run the command with its arguments
+func run(certFolder string, command string, args []string) error {
+	cmdFlags := flag.NewFlagSet(command, flag.ExitOnError)
+	switch command {
+	case "init":
+		force := cmdFlags.Bool("force", false, "replace the existing CA")
+		_ = cmdFlags.Parse(args)
+		caCert, _, err := certsetup.InitCA(certFolder, *force)
+		if err == nil {
+			fmt.Printf("CA '%s' is valid until %s\n", caCert.Subject.CommonName, caCert.NotAfter.Format(time.RFC3339))
+		}
+		return err
+	case "server":
+		_ = cmdFlags.Parse(args)
+		if cmdFlags.NArg() == 0 {
+			return fmt.Errorf("missing server names")
+		}
+		certPath, _, err := certsetup.IssueServerCert(cmdFlags.Args(), certFolder)
+		if err == nil {
+			fmt.Printf("Issued server certificate %s\n", certPath)
+		}
+		return err
+	case "plugin":
+		_ = cmdFlags.Parse(args)
+		certPath, _, err := certsetup.IssuePluginCert(certFolder)
+		if err == nil {
+			fmt.Printf("Issued plugin certificate %s\n", certPath)
+		}
+		return err
+	case "user":
+		ou := cmdFlags.String("ou", certsetup.OUClient, "role of the user, eg client or admin")
+		days := cmdFlags.Int("days", certsetup.DefaultCertDurationDays, "validity in days")
+		_ = cmdFlags.Parse(args)
+		if cmdFlags.NArg() != 1 {
+			return fmt.Errorf("expected one loginID")
+		}
+		certPath, _, err := certsetup.IssueUserCert(cmdFlags.Arg(0), *ou, *days, certFolder)
+		if err == nil {
+			fmt.Printf("Issued user certificate %s\n", certPath)
+		}
+		return err
+	case "inspect":
+		days := cmdFlags.Int("days", 30, "warn about certificates that expire within this nr of days")
+		asJSON := cmdFlags.Bool("json", false, "output as JSON")
+		_ = cmdFlags.Parse(args)
+		return inspect(certFolder, *days, *asJSON)
+	case "revoke":
+		force := cmdFlags.Bool("force", false, "revoke even if the serial number is shared with other certificates")
+		_ = cmdFlags.Parse(args)
+		if cmdFlags.NArg() != 1 {
+			return fmt.Errorf("expected one certificate file")
+		}
+		err := certsetup.RevokeCert(cmdFlags.Arg(0), certFolder, *force)
+		if err == nil {
+			fmt.Printf("Revoked certificate %s\n", cmdFlags.Arg(0))
+		}
+		return err
+	case "renew":
+		days := cmdFlags.Int("days", certsetup.DefaultCertDurationDays, "validity in days")
+		_ = cmdFlags.Parse(args)
+		if cmdFlags.NArg() != 1 {
+			return fmt.Errorf("expected one certificate file")
+		}
+		cert, err := certsetup.RenewCert(cmdFlags.Arg(0), *days, certFolder)
+		if err == nil {
+			fmt.Printf("Renewed certificate %s until %s\n", cmdFlags.Arg(0), cert.NotAfter.Format(time.RFC3339))
+		}
+		return err
+	case "rotate":
+		transition := cmdFlags.Duration("transition", certsetup.DefaultCATransition, "period the previous CA remains trusted")
+		_ = cmdFlags.Parse(args)
+		if cmdFlags.NArg() == 0 {
+			return fmt.Errorf("missing server names")
+		}
+		rotation, err := certsetup.RotateCA(certFolder, cmdFlags.Args(), *transition)
+		if err == nil {
+			fmt.Printf("Replaced CA '%s' with '%s'. The previous CA is trusted until %s\n",
+				rotation.PrevCaCert.Subject.CommonName, rotation.CaCert.Subject.CommonName,
+				rotation.TransitionEnd.Format(time.RFC3339))
+		}
+		return err
+	}
+	return fmt.Errorf("unknown command. Use -h for help")
+}
+
+// inspect prints the certificates in the certificate folder with their expiry and revocation status
+func inspect(certFolder string, days int, asJSON bool) error {
+	report, err := certsetup.InspectBundle(certFolder)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+		return nil
+	}
+	threshold := time.Duration(days) * 24 * time.Hour
+	fmt.Printf("%-20s %-20s %-10s %-25s %s\n", "File", "Common Name", "OU", "Expires", "Status")
+	for _, info := range report {
+		status := "ok"
+		if info.Revoked {
+			status = "REVOKED"
+		} else if info.IsExpired() {
+			status = "EXPIRED"
+		} else if info.IsExpiringSoon(threshold) {
+			status = fmt.Sprintf("expires in %d days", info.DaysRemaining)
+		}
+		ou := ""
+		if len(info.OU) > 0 {
+			ou = info.OU[0]
+		}
+		fmt.Printf("%-20s %-20s %-10s %-25s %s\n",
+			info.File, info.CommonName, ou, info.NotAfter.Format(time.RFC3339), status)
+	}
+	return nil
+}
@@ -10,6 +10,8 @@ require (
 	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/testify v1.7.0
 	github.com/wostzone/hubclient-go v0.0.0-00010101000000-000000000000
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -0,0 +1,182 @@
+// Package audit with recording of security relevant operations
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Audit event types
+const (
+	EventLogin              = "login"
+	EventTokenRefresh       = "tokenRefresh"
+	EventSessionTerminated  = "sessionTerminated"
+	EventRefreshTokenReuse  = "refreshTokenReuse"
+	EventCertificateIssued  = "certificateIssued"
+	EventCertificateRevoked = "certificateRevoked"
+	EventACLChanged         = "aclChanged"
+	EventThingConfigChanged = "thingConfigChanged"
+)
+
+// DefaultAuditLogFile is the default filename of the audit log
+const DefaultAuditLogFile = "audit.log"
+
+// DefaultMaxFileSize is the default size in bytes at which the audit log is rotated
+const DefaultMaxFileSize = 10 * 1024 * 1024
+
+// DefaultMaxFiles is the default number of rotated audit log files to keep
+const DefaultMaxFiles = 5
+
+// Event is a single audit log entry
+type Event struct {
+	Time time.Time `json:"time"`
+	// Type of event, see EventXyz
+	Type string `json:"type"`
+	// UserID or clientID that performed the operation, if known
+	UserID string `json:"userID,omitempty"`
+	// RemoteAddr of the client
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	// Success of the operation
+	Success bool `json:"success"`
+	// Details of the operation, eg the issued certificate or changed Thing
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// AuditLog writes audit events as JSON lines to an append-only file.
+// The file is rotated when it exceeds its maximum size. Rotated files are named {file}.1, {file}.2 etc,
+// where .1 is the most recent. Events can also be passed to a publisher, for example to publish them
+// on an audit topic. The audit log is safe for concurrent use.
+type AuditLog struct {
+	mux         sync.Mutex
+	filePath    string
+	maxFileSize int64
+	maxFiles    int
+	file        *os.File
+	fileSize    int64
+	publisher   func(event Event)
+}
+
+// Close the audit log file
+func (auditLog *AuditLog) Close() error {
+	auditLog.mux.Lock()
+	defer auditLog.mux.Unlock()
+	if auditLog.file == nil {
+		return nil
+	}
+	err := auditLog.file.Close()
+	auditLog.file = nil
+	return err
+}
+
+// Record writes an event to the audit log and passes it to the publisher, if set.
+// The event time is set to now if not provided.
+func (auditLog *AuditLog) Record(event Event) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	auditLog.mux.Lock()
+	publisher := auditLog.publisher
+	if auditLog.file == nil {
+		auditLog.mux.Unlock()
+		return fmt.Errorf("AuditLog.Record: audit log %s is closed", auditLog.filePath)
+	}
+	if auditLog.maxFileSize > 0 && auditLog.fileSize+int64(len(line)) > auditLog.maxFileSize {
+		err = auditLog.rotate()
+	}
+	if err == nil {
+		var n int
+		n, err = auditLog.file.Write(line)
+		auditLog.fileSize += int64(n)
+	}
+	auditLog.mux.Unlock()
+
+	if err != nil {
+		logrus.Errorf("AuditLog.Record: failed writing to %s: %s", auditLog.filePath, err)
+	}
+	if publisher != nil {
+		publisher(event)
+	}
+	return err
+}
+
+// SetPublisher sets a handler that receives each recorded event, for example to publish it
+// on an audit topic of the message bus. Use nil to remove the publisher.
+func (auditLog *AuditLog) SetPublisher(publisher func(event Event)) {
+	auditLog.mux.Lock()
+	defer auditLog.mux.Unlock()
+	auditLog.publisher = publisher
+}
+
+// open the audit log file for appending
+func (auditLog *AuditLog) open() error {
+	file, err := os.OpenFile(auditLog.filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	auditLog.file = file
+	auditLog.fileSize = info.Size()
+	return nil
+}
+
+// rotate renames the current file to {file}.1, shifts older files and opens a new file.
+// The oldest file is removed when there are more than maxFiles. Must be called with the lock held.
+func (auditLog *AuditLog) rotate() error {
+	logrus.Infof("AuditLog.rotate: rotating %s", auditLog.filePath)
+	_ = auditLog.file.Close()
+	auditLog.file = nil
+	_ = os.Remove(fmt.Sprintf("%s.%d", auditLog.filePath, auditLog.maxFiles))
+	for i := auditLog.maxFiles - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", auditLog.filePath, i), fmt.Sprintf("%s.%d", auditLog.filePath, i+1))
+	}
+	if auditLog.maxFiles > 0 {
+		_ = os.Rename(auditLog.filePath, auditLog.filePath+".1")
+	} else {
+		_ = os.Remove(auditLog.filePath)
+	}
+	return auditLog.open()
+}
+
+// NewAuditLog opens or creates an audit log file
+//  filePath of the audit log file. Events are appended if the file exists.
+//  maxFileSize in bytes at which the file is rotated, or 0 for DefaultMaxFileSize. Use -1 to never rotate.
+//  maxFiles is the number of rotated files to keep, or 0 for DefaultMaxFiles
+// Returns the audit log or an error if the file cannot be opened. Close it when done.
+func NewAuditLog(filePath string, maxFileSize int64, maxFiles int) (*AuditLog, error) {
+	if maxFileSize == 0 {
+		maxFileSize = DefaultMaxFileSize
+	}
+	if maxFiles == 0 {
+		maxFiles = DefaultMaxFiles
+	}
+	auditLog := &AuditLog{
+		filePath:    filePath,
+		maxFileSize: maxFileSize,
+		maxFiles:    maxFiles,
+	}
+	err := os.MkdirAll(path.Dir(filePath), 0700)
+	if err == nil {
+		err = auditLog.open()
+	}
+	if err != nil {
+		logrus.Errorf("NewAuditLog: unable to open audit log %s: %s", filePath, err)
+		return nil, err
+	}
+	return auditLog, nil
+}
@@ -0,0 +1,116 @@
+package audit_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wostzone/hubserve-go/pkg/audit"
+	"github.com/wostzone/hubserve-go/pkg/certsetup"
+)
+
+// readEvents reads the events from an audit log file
+func readEvents(t *testing.T, filePath string) []audit.Event {
+	file, err := os.Open(filePath)
+	require.NoError(t, err)
+	defer file.Close()
+	events := make([]audit.Event, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		event := audit.Event{}
+		err = json.Unmarshal(scanner.Bytes(), &event)
+		require.NoError(t, err)
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestRecord(t *testing.T) {
+	logFolder, _ := ioutil.TempDir("", "audit")
+	defer os.RemoveAll(logFolder)
+	logFile := path.Join(logFolder, audit.DefaultAuditLogFile)
+
+	auditLog, err := audit.NewAuditLog(logFile, 0, 0)
+	require.NoError(t, err)
+	published := make([]audit.Event, 0)
+	auditLog.SetPublisher(func(event audit.Event) {
+		published = append(published, event)
+	})
+	err = auditLog.Record(audit.Event{Type: audit.EventLogin, UserID: "user1", Success: true})
+	assert.NoError(t, err)
+	err = auditLog.Record(audit.Event{Type: audit.EventLogin, UserID: "user1", Success: false})
+	assert.NoError(t, err)
+	err = auditLog.Close()
+	assert.NoError(t, err)
+	err = auditLog.Record(audit.Event{Type: audit.EventLogin})
+	assert.Error(t, err)
+
+	events := readEvents(t, logFile)
+	require.Equal(t, 2, len(events))
+	assert.Equal(t, "user1", events[0].UserID)
+	assert.True(t, events[0].Success)
+	assert.False(t, events[0].Time.IsZero())
+	assert.False(t, events[1].Success)
+	assert.Equal(t, 2, len(published))
+
+	// reopening appends
+	auditLog, err = audit.NewAuditLog(logFile, 0, 0)
+	require.NoError(t, err)
+	_ = auditLog.Record(audit.Event{Type: audit.EventACLChanged})
+	_ = auditLog.Close()
+	assert.Equal(t, 3, len(readEvents(t, logFile)))
+
+	// the log file is not a folder
+	_, err = audit.NewAuditLog(path.Join(logFile, "audit.log"), 0, 0)
+	assert.Error(t, err)
+}
+
+func TestRotate(t *testing.T) {
+	logFolder, _ := ioutil.TempDir("", "audit")
+	defer os.RemoveAll(logFolder)
+	logFile := path.Join(logFolder, audit.DefaultAuditLogFile)
+
+	// each event is about 100 bytes
+	auditLog, err := audit.NewAuditLog(logFile, 250, 2)
+	require.NoError(t, err)
+	defer auditLog.Close()
+	for i := 0; i < 10; i++ {
+		err = auditLog.Record(audit.Event{Type: audit.EventThingConfigChanged, UserID: "user1"})
+		require.NoError(t, err)
+	}
+	assert.FileExists(t, logFile+".1")
+	assert.FileExists(t, logFile+".2")
+	assert.NoFileExists(t, logFile+".3")
+	assert.Equal(t, 2, len(readEvents(t, logFile+".1")))
+}
+
+func TestDefaultLog(t *testing.T) {
+	logFolder, _ := ioutil.TempDir("", "audit")
+	defer os.RemoveAll(logFolder)
+	logFile := path.Join(logFolder, audit.DefaultAuditLogFile)
+
+	// without default log nothing is recorded
+	audit.Record(audit.Event{Type: audit.EventLogin})
+
+	auditLog, err := audit.NewAuditLog(logFile, 0, 0)
+	require.NoError(t, err)
+	audit.SetDefault(auditLog)
+	defer audit.SetDefault(nil)
+
+	// certificate issuance is recorded by certsetup
+	caCert, caKey := certsetup.CreateHubCA()
+	_, _, err = certsetup.CreateUserCert("user1", certsetup.OUClient, 1, caCert, caKey)
+	require.NoError(t, err)
+	_ = auditLog.Close()
+
+	events := readEvents(t, logFile)
+	require.Equal(t, 1, len(events))
+	assert.Equal(t, audit.EventCertificateIssued, events[0].Type)
+	assert.Equal(t, "user1", events[0].UserID)
+	assert.Equal(t, certsetup.OUClient, events[0].Details["ou"])
+}
@@ -0,0 +1,29 @@
+package audit
+
+import (
+	"sync"
+)
+
+// the audit log used by the library packages, if any
+var defaultLog *AuditLog
+var defaultLogMux sync.RWMutex
+
+// Record an event in the default audit log
+// This does nothing if no default audit log is set. Library packages like tlsserver and certsetup
+// use this to record their security relevant operations.
+func Record(event Event) {
+	defaultLogMux.RLock()
+	auditLog := defaultLog
+	defaultLogMux.RUnlock()
+	if auditLog != nil {
+		_ = auditLog.Record(event)
+	}
+}
+
+// SetDefault sets the audit log that receives the events recorded by the library packages
+// Use nil to stop recording.
+func SetDefault(auditLog *AuditLog) {
+	defaultLogMux.Lock()
+	defer defaultLogMux.Unlock()
+	defaultLog = auditLog
+}
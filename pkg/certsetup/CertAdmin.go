@@ -0,0 +1,413 @@
+package certsetup
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/hubclient-go/pkg/certs"
+	"github.com/wostzone/hubclient-go/pkg/config"
+	"github.com/wostzone/hubserve-go/pkg/audit"
+)
+
+// DefaultCrlFile is the filename of the certificate revocation list in the certificate folder
+const DefaultCrlFile = "caCrl.pem"
+
+// oidCertificateIssuer is the revocation list entry extension that holds the certificate issuer
+var oidCertificateIssuer = asn1.ObjectIdentifier{2, 5, 29, 29}
+
+// generalNameDirectoryName is the tag of the directoryName choice of a GeneralName
+const generalNameDirectoryName = 4
+
+// crlValidityDays is the number of days the revocation list is valid until its next update
+const crlValidityDays = 30
+
+// InitCA loads the Hub CA certificate and key from the certificate folder, or creates and saves
+// them if they don't exist.
+// If the PassphraseEnv environment variable is set then a new CA key is saved encrypted.
+//  certFolder containing the CA certificate and key
+//  force replaces an existing CA. All certificates signed by the previous CA become invalid.
+//  Use RotateCA to replace the CA with a transition period.
+// Returns the CA certificate and key, or an error if an existing CA cannot be loaded or a new CA
+// cannot be saved
+func InitCA(certFolder string, force bool) (caCert *x509.Certificate, caKey crypto.Signer, err error) {
+	caKeyPath := path.Join(certFolder, config.DefaultCaKeyFile)
+	if !force {
+		// never replace a CA that exists but can't be loaded, eg due to a missing passphrase
+		if _, err = os.Stat(caKeyPath); err == nil {
+			return LoadCA(certFolder)
+		}
+	}
+	logrus.Warningf("InitCA: Generating a new CA certificate in %s", certFolder)
+	caCert, newKey := CreateHubCA()
+	err = saveCA(caCert, newKey, certFolder)
+	if err != nil {
+		logrus.Errorf("InitCA: failed saving the CA: %s", err)
+		return nil, nil, err
+	}
+	// a new CA starts without revoked certificates or a previous CA
+	_ = os.Remove(path.Join(certFolder, DefaultCrlFile))
+	_ = os.Remove(path.Join(certFolder, DefaultPrevCaCertFile))
+	_ = os.Remove(path.Join(certFolder, DefaultCrossCaCertFile))
+	return caCert, newKey, nil
+}
+
+// IsRevoked returns whether a certificate issued by the CA of the certificate folder with the given
+// serial number is in the revocation list of the certificate folder.
+// Use it with TLSServer.EnableOCSPStapling or OCSPStapler.SetRevocationCheck, for example.
+// Use IsRevokedCert for certificates that can be issued by the previous CA.
+//  certFolder with the revocation list
+//  serialNumber of the certificate
+// Returns true and the revocation time if the certificate is revoked
+func IsRevoked(certFolder string, serialNumber *big.Int) (revoked bool, revokedAt time.Time) {
+	caCert, revokedCerts, err := loadRevoked(certFolder)
+	if err != nil || len(revokedCerts) == 0 {
+		return false, revokedAt
+	}
+	return findRevoked(revokedCerts, caCert.RawSubject, caCert.RawSubject, serialNumber)
+}
+
+// IsRevokedCert returns whether the certificate is in the revocation list of the certificate folder.
+// The certificate is identified by its issuer and serial number.
+//  certFolder with the revocation list
+//  cert is the certificate to check
+// Returns true and the revocation time if the certificate is revoked
+func IsRevokedCert(certFolder string, cert *x509.Certificate) (revoked bool, revokedAt time.Time) {
+	caCert, revokedCerts, err := loadRevoked(certFolder)
+	if err != nil || len(revokedCerts) == 0 {
+		return false, revokedAt
+	}
+	return isCertRevoked(revokedCerts, caCert, cert)
+}
+
+// IssuePluginCert creates the plugin client certificate signed by the CA in the certificate
+// folder and saves it as the default plugin certificate and key files. Existing files are replaced.
+//  certFolder containing the CA certificate and key, and where the certificate is stored
+// Returns the path of the saved certificate and key files, or error
+func IssuePluginCert(certFolder string) (certPath string, keyPath string, err error) {
+	caCert, caKey, err := LoadCA(certFolder)
+	if err != nil {
+		return "", "", err
+	}
+	privKey := certs.CreateECDSAKeys()
+	pluginCert, err := CreateHubClientCert(DefaultPluginClientID, OUPlugin,
+		&privKey.PublicKey, caCert, caKey, certClock.Now(), DefaultCertDurationDays)
+	if err != nil {
+		return "", "", err
+	}
+	certPath = path.Join(certFolder, config.DefaultPluginCertFile)
+	keyPath = path.Join(certFolder, config.DefaultPluginKeyFile)
+	err = saveKeyAndCert(privKey, pluginCert, keyPath, certPath)
+	if err != nil {
+		logrus.Errorf("IssuePluginCert: failed saving the certificate: %s", err)
+		return "", "", err
+	}
+	return certPath, keyPath, nil
+}
+
+// IssueServerCert creates the Hub server certificate signed by the CA in the certificate folder
+// and saves it as the default server certificate and key files. Existing files are replaced.
+//  names contains the domain names and IP addresses the Hub can be reached on
+//  certFolder containing the CA certificate and key, and where the certificate is stored
+// Returns the path of the saved certificate and key files, or error
+func IssueServerCert(names []string, certFolder string) (certPath string, keyPath string, err error) {
+	caCert, caKey, err := LoadCA(certFolder)
+	if err != nil {
+		return "", "", err
+	}
+	serverCert, err := CreateHubServerCert(names, caCert, caKey)
+	if err != nil {
+		return "", "", err
+	}
+	certPath = path.Join(certFolder, config.DefaultServerCertFile)
+	keyPath = path.Join(certFolder, config.DefaultServerKeyFile)
+	err = saveTLSCert(serverCert, certPath, keyPath)
+	if err != nil {
+		logrus.Errorf("IssueServerCert: failed saving the certificate: %s", err)
+		return "", "", err
+	}
+	return certPath, keyPath, nil
+}
+
+// ListRevoked returns the revoked certificates in the revocation list of the certificate folder
+// The revocation list must be signed by the CA in the same folder.
+// Returns an empty list if there is no revocation list, or an error if it is invalid
+func ListRevoked(certFolder string) ([]pkix.RevokedCertificate, error) {
+	_, revokedCerts, err := loadRevoked(certFolder)
+	return revokedCerts, err
+}
+
+// LoadCA loads the Hub CA certificate and private key from the certificate folder
+// An encrypted CA key is decrypted with the passphrase from the PassphraseEnv environment variable.
+// The key is returned as a signer, like keys from an IKeyStore, and can be of any type supported
+// by LoadKeyFromPEM.
+// Returns the CA certificate and key, or an error if they cannot be loaded
+func LoadCA(certFolder string) (caCert *x509.Certificate, caKey crypto.Signer, err error) {
+	caCert, err = certs.LoadX509CertFromPEM(path.Join(certFolder, config.DefaultCaCertFile))
+	if err != nil {
+		logrus.Errorf("LoadCA: unable to load the CA certificate: %s", err)
+		return nil, nil, err
+	}
+	caKey, err = LoadKeyFromPEM(path.Join(certFolder, config.DefaultCaKeyFile), PassphraseFromEnv)
+	if err != nil {
+		logrus.Errorf("LoadCA: unable to load the CA key: %s", err)
+		return nil, nil, err
+	}
+	return caCert, caKey, nil
+}
+
+// RenewCert replaces a certificate with a new certificate for the same subject, names and key,
+// signed by the CA in the certificate folder. The private key of the certificate is not needed
+// and remains valid.
+//  certPath of the certificate to renew. The renewed certificate is saved in the same file.
+//  validityDays nr of days the renewed certificate will be valid
+//  certFolder containing the CA certificate and key
+// Returns the renewed certificate, or an error if the certificate is a CA
+func RenewCert(certPath string, validityDays int, certFolder string) (*x509.Certificate, error) {
+	caCert, caKey, err := LoadCA(certFolder)
+	if err != nil {
+		return nil, err
+	}
+	oldCert, err := certs.LoadX509CertFromPEM(certPath)
+	if err != nil {
+		logrus.Errorf("RenewCert: unable to load certificate %s: %s", certPath, err)
+		return nil, err
+	}
+	if oldCert.IsCA {
+		err = fmt.Errorf("RenewCert: certificate %s is a CA", certPath)
+		logrus.Error(err)
+		return nil, err
+	}
+	start := certClock.Now()
+	template := &x509.Certificate{
+		SerialNumber:          newSerialNumber(),
+		Subject:               oldCert.Subject,
+		NotBefore:             start,
+		NotAfter:              start.AddDate(0, 0, validityDays),
+		KeyUsage:              oldCert.KeyUsage,
+		ExtKeyUsage:           oldCert.ExtKeyUsage,
+		BasicConstraintsValid: oldCert.BasicConstraintsValid,
+		DNSNames:              oldCert.DNSNames,
+		IPAddresses:           oldCert.IPAddresses,
+		EmailAddresses:        oldCert.EmailAddresses,
+	}
+	newCert, err := signClientCert(template, oldCert.PublicKey, caCert, caKey)
+	if err != nil {
+		logrus.Errorf("RenewCert: unable to renew certificate %s: %s", certPath, err)
+		return nil, err
+	}
+	err = saveCert(newCert, certPath)
+	if err != nil {
+		logrus.Errorf("RenewCert: failed saving certificate: %s", err)
+		return nil, err
+	}
+	logrus.Infof("RenewCert: renewed certificate of '%s' in %s until %s",
+		newCert.Subject.CommonName, certPath, newCert.NotAfter.Format(time.RFC3339))
+	return newCert, nil
+}
+
+// RevokeCert adds a certificate to the revocation list in the certificate folder.
+// The revocation list is signed by the CA and saved as DefaultCrlFile. Services that verify
+// client certificates can use IsRevokedCert to reject revoked certificates.
+// Certificates created before serial numbers were random all have the same serial number. To
+// avoid revoking other certificates, a certificate whose serial number is shared with other
+// certificates in the folder is only revoked when forced.
+//  certPath of the certificate to revoke
+//  certFolder containing the CA certificate and key, and the revocation list
+//  force revokes the certificate even if its serial number is shared with other certificates
+func RevokeCert(certPath string, certFolder string, force bool) error {
+	cert, err := certs.LoadX509CertFromPEM(certPath)
+	if err != nil {
+		logrus.Errorf("RevokeCert: unable to load certificate %s: %s", certPath, err)
+		return err
+	} else if cert.IsCA {
+		err = fmt.Errorf("RevokeCert: certificate %s is a CA", certPath)
+		logrus.Error(err)
+		return err
+	}
+	caCert, caKey, err := LoadCA(certFolder)
+	if err != nil {
+		return err
+	}
+	if err = cert.CheckSignatureFrom(caCert); err != nil {
+		// certificates of the previous CA are still valid during the transition of a CA rotation
+		prevCaCert := LoadPreviousCA(certFolder)
+		if prevCaCert != nil && cert.CheckSignatureFrom(prevCaCert) == nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("RevokeCert: certificate %s is not signed by the CA: %s", certPath, err)
+		logrus.Error(err)
+		return err
+	}
+	_, revokedCerts, err := loadRevoked(certFolder)
+	if err != nil {
+		logrus.Errorf("RevokeCert: %s", err)
+		return err
+	}
+	if revoked, _ := isCertRevoked(revokedCerts, caCert, cert); revoked {
+		logrus.Infof("RevokeCert: certificate %s is already revoked", certPath)
+		return nil
+	}
+	if !force {
+		sharedWith := make([]string, 0)
+		err = forEachCert(certFolder, func(fileName string, other *x509.Certificate) {
+			if other.SerialNumber.Cmp(cert.SerialNumber) == 0 && !bytes.Equal(other.Raw, cert.Raw) {
+				sharedWith = append(sharedWith, fileName)
+			}
+		})
+		if err == nil && len(sharedWith) > 0 {
+			err = fmt.Errorf("RevokeCert: serial number %s of certificate %s is shared with %s",
+				cert.SerialNumber, certPath, strings.Join(sharedWith, ", "))
+		}
+		if err != nil {
+			logrus.Error(err)
+			return err
+		}
+	}
+	now := certClock.Now()
+	revokedCerts = append(revokedCerts, pkix.RevokedCertificate{
+		SerialNumber:   cert.SerialNumber,
+		RevocationTime: now,
+		Extensions:     []pkix.Extension{certificateIssuerExtension(cert.RawIssuer)},
+	})
+	err = saveCRL(revokedCerts, caCert, caKey, certFolder)
+	if err != nil {
+		logrus.Errorf("RevokeCert: failed saving the revocation list: %s", err)
+		return err
+	}
+	audit.Record(audit.Event{
+		Type:    audit.EventCertificateRevoked,
+		UserID:  cert.Subject.CommonName,
+		Success: true,
+		Details: map[string]string{"serialNumber": cert.SerialNumber.String()},
+	})
+	logrus.Infof("RevokeCert: revoked certificate of '%s' with serial number %s",
+		cert.Subject.CommonName, cert.SerialNumber)
+	return nil
+}
+
+// certificateIssuerExtension returns the revocation list entry extension that identifies the issuer
+// of the revoked certificate. This allows the revocation list to hold certificates of the previous CA.
+//  rawIssuer is the DER encoded issuer name of the revoked certificate
+func certificateIssuerExtension(rawIssuer []byte) pkix.Extension {
+	value, _ := asn1.Marshal([]asn1.RawValue{{
+		Class: asn1.ClassContextSpecific, Tag: generalNameDirectoryName, IsCompound: true, Bytes: rawIssuer}})
+	return pkix.Extension{Id: oidCertificateIssuer, Critical: true, Value: value}
+}
+
+// findRevoked returns whether the certificate with the given issuer and serial number is in the
+// list of revoked certificates.
+//  crlIssuer is the issuer of the revocation list, which is the issuer of entries without certificate issuer
+//  issuer of the certificate, DER encoded
+//  serialNumber of the certificate
+func findRevoked(revokedCerts []pkix.RevokedCertificate, crlIssuer []byte, issuer []byte,
+	serialNumber *big.Int) (revoked bool, revokedAt time.Time) {
+
+	for _, revokedCert := range revokedCerts {
+		if revokedCert.SerialNumber.Cmp(serialNumber) == 0 &&
+			bytes.Equal(revokedCertIssuer(revokedCert, crlIssuer), issuer) {
+			return true, revokedCert.RevocationTime
+		}
+	}
+	return false, revokedAt
+}
+
+// isCertRevoked returns whether the certificate is in the list of revoked certificates of the CA
+// A self-signed CA certificate is never revoked by its own revocation list.
+func isCertRevoked(revokedCerts []pkix.RevokedCertificate, caCert *x509.Certificate,
+	cert *x509.Certificate) (revoked bool, revokedAt time.Time) {
+
+	if cert.IsCA && bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		return false, revokedAt
+	}
+	return findRevoked(revokedCerts, caCert.RawSubject, cert.RawIssuer, cert.SerialNumber)
+}
+
+// loadRevoked loads the revocation list of the certificate folder and the CA that signed it
+// Returns the CA and revoked certificates, an empty list and nil CA if there is no revocation list,
+// or an error if it is invalid
+func loadRevoked(certFolder string) (*x509.Certificate, []pkix.RevokedCertificate, error) {
+	crlData, err := ioutil.ReadFile(path.Join(certFolder, DefaultCrlFile))
+	if os.IsNotExist(err) {
+		return nil, []pkix.RevokedCertificate{}, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	caCert, err := certs.LoadX509CertFromPEM(path.Join(certFolder, config.DefaultCaCertFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	crl, err := x509.ParseCRL(crlData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ListRevoked: invalid revocation list: %s", err)
+	}
+	err = caCert.CheckCRLSignature(crl)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ListRevoked: revocation list is not signed by the CA: %s", err)
+	}
+	return caCert, crl.TBSCertList.RevokedCertificates, nil
+}
+
+// revokedCertIssuer returns the DER encoded issuer of the revoked certificate
+// This is the certificate issuer extension of the entry, or the issuer of the revocation list if
+// the entry has no such extension.
+func revokedCertIssuer(revokedCert pkix.RevokedCertificate, crlIssuer []byte) []byte {
+	for _, ext := range revokedCert.Extensions {
+		if !ext.Id.Equal(oidCertificateIssuer) {
+			continue
+		}
+		var generalNames []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &generalNames); err == nil {
+			for _, generalName := range generalNames {
+				if generalName.Class == asn1.ClassContextSpecific && generalName.Tag == generalNameDirectoryName {
+					return generalName.Bytes
+				}
+			}
+		}
+	}
+	return crlIssuer
+}
+
+// saveCA saves the CA certificate and key in the certificate folder
+// The key is encrypted if the PassphraseEnv environment variable is set.
+func saveCA(caCert *x509.Certificate, caKey *ecdsa.PrivateKey, certFolder string) (err error) {
+	caCertPath := path.Join(certFolder, config.DefaultCaCertFile)
+	caKeyPath := path.Join(certFolder, config.DefaultCaKeyFile)
+	if passphrase, found := os.LookupEnv(PassphraseEnv); found && passphrase != "" {
+		err = SaveEncryptedKeyToPEM(caKey, caKeyPath, []byte(passphrase))
+		if err == nil {
+			err = saveCert(caCert, caCertPath)
+		}
+	} else {
+		err = saveKeyAndCert(caKey, caCert, caKeyPath, caCertPath)
+	}
+	return err
+}
+
+// saveCRL creates the revocation list signed by the CA and saves it as DefaultCrlFile
+func saveCRL(revokedCerts []pkix.RevokedCertificate,
+	caCert *x509.Certificate, caKey crypto.Signer, certFolder string) error {
+
+	now := certClock.Now()
+	crlDer, err := caCert.CreateCRL(rand.Reader, caKey, revokedCerts, now, now.AddDate(0, 0, crlValidityDays))
+	if err != nil {
+		return fmt.Errorf("unable to create the revocation list: %s", err)
+	}
+	crlPem := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDer})
+	return saveFile(path.Join(certFolder, DefaultCrlFile), crlPem, CertFilePermissions)
+}
@@ -0,0 +1,194 @@
+package certsetup
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/hubclient-go/pkg/certs"
+)
+
+// KeyFilePermissions are the permissions of saved private key files, readable by the owner only
+const KeyFilePermissions os.FileMode = 0600
+
+// CertFilePermissions are the permissions of saved certificate files
+const CertFilePermissions os.FileMode = 0640
+
+// PermissionError is returned when a private key file can be accessed by others than its owner,
+// or is owned by another user than the one running the service.
+type PermissionError struct {
+	// Path of the key file
+	Path string
+	// Mode of the key file
+	Mode os.FileMode
+	// Reason the permissions are too open
+	Reason string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("key file %s has insecure permissions %04o: %s", e.Path, e.Mode.Perm(), e.Reason)
+}
+
+// CheckKeyFilePermissions verifies that a private key file is only accessible by its owner, and that
+// the owner is the current user or root.
+// Returns a *PermissionError if the permissions are too open, or an error if the file cannot be read
+func CheckKeyFilePermissions(keyPath string) error {
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return &PermissionError{Path: keyPath, Mode: info.Mode(), Reason: "accessible by group or others"}
+	}
+	if !isOwnedByCurrentUser(info) {
+		return &PermissionError{Path: keyPath, Mode: info.Mode(), Reason: "owned by another user"}
+	}
+	return nil
+}
+
+// saveAtomic saves a file using the given save function on a temporary file in the same folder, which
+// is synced to disk and renamed to the destination. A crash while saving leaves the existing file intact.
+//  filePath is the destination file
+//  perm are the permissions of the saved file
+//  save writes the content to the temporary file
+func saveAtomic(filePath string, perm os.FileMode, save func(tmpPath string) error) error {
+	tmpPath, err := stageFile(filePath, perm, save)
+	if err != nil {
+		return err
+	}
+	// remove the temporary file if saving fails
+	defer os.Remove(tmpPath)
+	err = os.Rename(tmpPath, filePath)
+	if err != nil {
+		return err
+	}
+	// persist the rename. Not all platforms support syncing folders.
+	_ = syncFile(path.Dir(filePath))
+	return nil
+}
+
+// stageFile saves a file using the given save function on a temporary file in the same folder as
+// the destination, and syncs it to disk. The caller renames it to the destination.
+//  filePath is the destination file
+//  perm are the permissions of the saved file
+//  save writes the content to the temporary file
+// Returns the path of the temporary file, or an error if saving failed. The temporary file is
+// removed on error.
+func stageFile(filePath string, perm os.FileMode, save func(tmpPath string) error) (tmpPath string, err error) {
+	// temp files are created with 0600 permissions so keys are never exposed
+	tmpFile, err := ioutil.TempFile(path.Dir(filePath), "."+path.Base(filePath)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	tmpPath = tmpFile.Name()
+	_ = tmpFile.Close()
+
+	err = save(tmpPath)
+	if err == nil {
+		err = os.Chmod(tmpPath, perm)
+	}
+	if err == nil {
+		err = syncFile(tmpPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+// saveCert atomically saves a certificate in PEM format
+func saveCert(cert *x509.Certificate, certPath string) error {
+	return saveAtomic(certPath, CertFilePermissions, func(tmpPath string) error {
+		return certs.SaveX509CertToPEM(cert, tmpPath)
+	})
+}
+
+// saveFile atomically saves data to file
+func saveFile(filePath string, data []byte, perm os.FileMode) error {
+	return saveAtomic(filePath, perm, func(tmpPath string) error {
+		return ioutil.WriteFile(tmpPath, data, perm)
+	})
+}
+
+// saveKeyAndCert atomically saves a private key and its certificate in PEM format.
+// The key and certificate are verified to match before the existing files are replaced. If the
+// certificate cannot be replaced then the previous key is restored, so the key and certificate
+// files always match.
+func saveKeyAndCert(key *ecdsa.PrivateKey, cert *x509.Certificate, keyPath string, certPath string) error {
+	tmpKeyPath, err := stageFile(keyPath, KeyFilePermissions, func(tmpPath string) error {
+		return certs.SaveKeysToPEM(key, tmpPath)
+	})
+	if err != nil {
+		logrus.Errorf("saveKeyAndCert: unable to save key %s: %s", keyPath, err)
+		return err
+	}
+	defer os.Remove(tmpKeyPath)
+	tmpCertPath, err := stageFile(certPath, CertFilePermissions, func(tmpPath string) error {
+		err := certs.SaveX509CertToPEM(cert, tmpPath)
+		if err != nil {
+			return err
+		}
+		_, err = tls.LoadX509KeyPair(tmpPath, tmpKeyPath)
+		if err != nil {
+			return fmt.Errorf("certificate %s doesn't match its key: %s", certPath, err)
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("saveKeyAndCert: unable to save certificate %s: %s", certPath, err)
+		return err
+	}
+	defer os.Remove(tmpCertPath)
+
+	// keep the previous key to restore it if the certificate cannot be replaced
+	prevKeyPEM, prevKeyErr := ioutil.ReadFile(keyPath)
+	err = os.Rename(tmpKeyPath, keyPath)
+	if err == nil {
+		err = os.Rename(tmpCertPath, certPath)
+		if err != nil {
+			if prevKeyErr == nil {
+				_ = saveFile(keyPath, prevKeyPEM, KeyFilePermissions)
+			} else {
+				_ = os.Remove(keyPath)
+			}
+		}
+	}
+	if err != nil {
+		logrus.Errorf("saveKeyAndCert: unable to replace %s and %s: %s", keyPath, certPath, err)
+		return err
+	}
+	// persist the renames. Not all platforms support syncing folders.
+	_ = syncFile(path.Dir(keyPath))
+	_ = syncFile(path.Dir(certPath))
+	return nil
+}
+
+// saveTLSCert atomically saves a TLS certificate with ECDSA key in PEM format
+// Certificates whose key is held in an IKeyStore cannot be saved, as the key cannot be exported.
+func saveTLSCert(tlsCert *tls.Certificate, certPath string, keyPath string) error {
+	key, isECDSA := tlsCert.PrivateKey.(*ecdsa.PrivateKey)
+	if !isECDSA || len(tlsCert.Certificate) == 0 {
+		return fmt.Errorf("saveTLSCert: only certificates with an ECDSA key can be saved to file")
+	}
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	return saveKeyAndCert(key, cert, keyPath, certPath)
+}
+
+// syncFile flushes a file or folder to disk
+func syncFile(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -3,6 +3,7 @@
 package certsetup
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/tls"
@@ -12,11 +13,14 @@ import (
 	"math/big"
 	"net"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/wostzone/hubclient-go/pkg/certs"
 	"github.com/wostzone/hubclient-go/pkg/config"
+	"github.com/wostzone/hubserve-go/pkg/audit"
+	"github.com/wostzone/hubserve-go/pkg/clock"
 )
 
 // // Standard WoST client and server key/certificate filenames. All stored in PEM format.
@@ -73,6 +77,19 @@ const caDefaultValidityDuration = time.Hour * 24 * 364 * 20 // 20 years
 const DefaultCertDurationDays = 365
 const TempCertDurationDays = 1
 
+// source of time for certificate validity
+var certClock clock.Clock = clock.RealClock{}
+
+// SetClock replaces the source of time used for the validity period of new certificates and
+// for the expiry checks of CertInfo. Intended for tests that use a clock.FakeClock.
+// Use nil to restore the system time.
+func SetClock(c clock.Clock) {
+	if c == nil {
+		c = clock.RealClock{}
+	}
+	certClock = c
+}
+
 // CreateCertificateBundle is a convenience function to create the Hub CA, server and (plugin) client
 // certificates into the given folder.
 //  * The CA certificate will only be created if missing
@@ -86,25 +103,14 @@ func CreateCertificateBundle(names []string, certFolder string) error {
 	forcePluginCert := true // best to always created these certs
 	forceHubCert := true
 	var caCert *x509.Certificate
-	var caKeys *ecdsa.PrivateKey
+	var caKeys crypto.Signer
 
 	// create the CA only if needed
 	// TODO: How to handle CA expiry?
-	// TODO: Handle CA revocation
-	caCert, _ = certs.LoadX509CertFromPEM(path.Join(certFolder, config.DefaultCaCertFile))
-	caKeys, _ = certs.LoadKeysFromPEM(path.Join(certFolder, config.DefaultCaKeyFile))
-	if caCert == nil || caKeys == nil {
-		logrus.Warningf("CreateCertificateBundle Generating a CA certificate in %s as none was found. Names: %s", certFolder, names)
-		caCert, caKeys = CreateHubCA()
-		err = certs.SaveKeysToPEM(caKeys, path.Join(certFolder, config.DefaultCaKeyFile))
-		if err != nil {
-			logrus.Errorf("CreateCertificateBundle CA failed writing. Unable to continue: %s", err)
-			return err
-		}
-		err = certs.SaveX509CertToPEM(caCert, path.Join(certFolder, config.DefaultCaCertFile))
-		if err != nil {
-			return err
-		}
+	caCert, caKeys, err = InitCA(certFolder, false)
+	if err != nil {
+		logrus.Errorf("CreateCertificateBundle CA failed. Unable to continue: %s", err)
+		return err
 	}
 
 	// create the Hub server cert
@@ -118,7 +124,11 @@ func CreateCertificateBundle(names []string, certFolder string) error {
 			logrus.Errorf("CreateCertificateBundle server failed: %s", err)
 			return err
 		}
-		certs.SaveTLSCertToPEM(serverCert, serverCertPath, serverKeyPath)
+		err = saveTLSCert(serverCert, serverCertPath, serverKeyPath)
+		if err != nil {
+			logrus.Errorf("CreateCertificateBundle server failed writing: %s", err)
+			return err
+		}
 	}
 
 	// create the Plugin (client) certificate
@@ -131,12 +141,15 @@ func CreateCertificateBundle(names []string, certFolder string) error {
 		// The plugin client cert uses the fixed common name 'plugin'
 		privKey := certs.CreateECDSAKeys()
 		pluginCert, err := CreateHubClientCert(DefaultPluginClientID, OUPlugin,
-			&privKey.PublicKey, caCert, caKeys, time.Now(), DefaultCertDurationDays)
+			&privKey.PublicKey, caCert, caKeys, certClock.Now(), DefaultCertDurationDays)
 		if err != nil {
 			logrus.Fatalf("CreateCertificateBundle client failed: %s", err)
 		}
-		certs.SaveX509CertToPEM(pluginCert, pluginCertPath)
-		certs.SaveKeysToPEM(privKey, pluginKeyPath)
+		err = saveKeyAndCert(privKey, pluginCert, pluginKeyPath, pluginCertPath)
+		if err != nil {
+			logrus.Errorf("CreateCertificateBundle client failed writing: %s", err)
+			return err
+		}
 	}
 	return nil
 }
@@ -148,30 +161,35 @@ func CreateCertificateBundle(names []string, certFolder string) error {
 //
 //  temporary set to generate a temporary CA for one-off signing
 func CreateHubCA() (cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	return createCA("WoST CA")
+}
+
+// createCA creates a self-signed CA certificate and private key with the given common name
+func createCA(commonName string) (cert *x509.Certificate, key *ecdsa.PrivateKey) {
 	validity := caDefaultValidityDuration
 
 	// set up our CA certificate
 	// see also: https://superuser.com/questions/738612/openssl-ca-keyusage-extension
 	rootTemplate := &x509.Certificate{
-		SerialNumber: big.NewInt(2021),
+		SerialNumber: newSerialNumber(),
 		Subject: pkix.Name{
 			Country:      []string{"CA"},
 			Organization: []string{CertOrgName},
 			Province:     []string{"BC"},
 			Locality:     []string{CertOrgLocality},
-			CommonName:   "WoST CA",
+			CommonName:   commonName,
 		},
-		NotBefore: time.Now().Add(-10 * time.Second),
-		NotAfter:  time.Now().Add(validity),
+		NotBefore: certClock.Now().Add(-10 * time.Second),
+		NotAfter:  certClock.Now().Add(validity),
 		// CA cert can be used to sign certificate and revocation lists
 		KeyUsage:    x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 
-		// This hub cert is the only CA. Not using intermediate CAs
+		// This hub cert is the only CA. Not using intermediate CAs except for the
+		// cross-signed certificate of the next CA during a CA rotation.
 		BasicConstraintsValid: true,
 		IsCA:                  true,
-		MaxPathLen:            0,
-		MaxPathLenZero:        true,
+		MaxPathLen:            1,
 	}
 
 	// Create the CA private key
@@ -197,12 +215,12 @@ func CreateHubCA() (cert *x509.Certificate, key *ecdsa.PrivateKey) {
 //  ou of the client role, eg OUNone, OUClient, OUPlugin
 //  ownerPubKey the public key of the certificate holder
 //  caCert CA's certificate for signing
-//  caPrivKey CA's ECDSA key for signing
+//  caPrivKey CA's key for signing. The key can be held in an IKeyStore.
 //  start time the certificate is first valid. Intended for testing. Use time.now()
 //  durationDays nr of days the certificate will be valid
 // Returns the signed TLS certificate or error
 func CreateHubClientCert(clientID string, ou string,
-	ownerPubKey *ecdsa.PublicKey, caCert *x509.Certificate, caPrivKey *ecdsa.PrivateKey,
+	ownerPubKey *ecdsa.PublicKey, caCert *x509.Certificate, caPrivKey crypto.Signer,
 	start time.Time, durationDays int) (clientCert *x509.Certificate, err error) {
 
 	if caCert == nil || caPrivKey == nil {
@@ -210,8 +228,23 @@ func CreateHubClientCert(clientID string, ou string,
 		logrus.Error(err)
 		return nil, err
 	}
+	template := newClientCertTemplate(clientID, ou, start, durationDays)
+	newCert, err := signClientCert(template, ownerPubKey, caCert, caPrivKey)
+	if err != nil {
+		logrus.Errorf("CertSetup.CreateHubClientCert: Unable to create WoST Hub client cert: %s", err)
+		return nil, err
+	}
+	return newCert, err
+}
+
+// newClientCertTemplate returns the certificate template for client certificates
+//  clientID used as the CommonName
+//  ou of the client role
+//  start time the certificate is first valid
+//  durationDays nr of days the certificate will be valid
+func newClientCertTemplate(clientID string, ou string, start time.Time, durationDays int) *x509.Certificate {
 	template := &x509.Certificate{
-		SerialNumber: big.NewInt(2021),
+		SerialNumber: newSerialNumber(),
 		Subject: pkix.Name{
 			Organization:       []string{CertOrgName},
 			Locality:           []string{CertOrgLocality},
@@ -228,30 +261,41 @@ func CreateHubClientCert(clientID string, ou string,
 		IsCA:                  false,
 		BasicConstraintsValid: true,
 	}
-	// clientKey := certs.CreateECDSAKeys()
+	return template
+}
+
+// signClientCert signs the client certificate template with the CA
+// The CA key can be held in hardware, see IKeyStore.
+// Returns the signed certificate or error
+func signClientCert(template *x509.Certificate, ownerPubKey crypto.PublicKey,
+	caCert *x509.Certificate, caPrivKey crypto.Signer) (*x509.Certificate, error) {
+
 	certDer, err := x509.CreateCertificate(rand.Reader, template, caCert, ownerPubKey, caPrivKey)
 	if err != nil {
-		logrus.Errorf("CertSetup.CreateHubClientCert: Unable to create WoST Hub client cert: %s", err)
 		return nil, err
 	}
-	newCert, err := x509.ParseCertificate(certDer)
-
-	// // combined them into a TLS certificate
-	// tlscert := &tls.Certificate{}
-	// tlscert.Certificate = append(tlscert.Certificate, certDer)
-	// tlscert.PrivateKey = clientKey
-
-	return newCert, err
+	audit.Record(audit.Event{
+		Type:    audit.EventCertificateIssued,
+		UserID:  template.Subject.CommonName,
+		Success: true,
+		Details: map[string]string{
+			"ou":       strings.Join(template.Subject.OrganizationalUnit, ","),
+			"notAfter": template.NotAfter.Format(time.RFC3339),
+		},
+	})
+	return x509.ParseCertificate(certDer)
 }
 
 // CreateHubServerCert creates a new Hub service certificate and private key
 // The certificate is valid for the given names either local domain name and IP addresses.
-// The server must have a fixed IP.
-//  names contains one or more domain names and/or IP addresses the Hub can be reached on, to add to the certificate
+// The server must have a fixed IP. If a loopback name is included then both the IPv4 and IPv6
+// loopback addresses are added, as localhost can resolve to either.
+//  names contains one or more domain names and/or IPv4 or IPv6 addresses the Hub can be reached on,
+//  to add to the certificate. IPv6 addresses can be bracketed, eg [::1].
 //  caCert is the CA to sign the server certificate
-//  caPrivKey is the CA private key to sign the server certificate
+//  caPrivKey is the CA private key to sign the server certificate. It can be held in an IKeyStore.
 // returns the signed Server TLS certificate
-func CreateHubServerCert(names []string, caCert *x509.Certificate, caPrivKey *ecdsa.PrivateKey) (cert *tls.Certificate, err error) {
+func CreateHubServerCert(names []string, caCert *x509.Certificate, caPrivKey crypto.Signer) (cert *tls.Certificate, err error) {
 	if caCert == nil || caPrivKey == nil || names == nil {
 		err := fmt.Errorf("CreateServiceCert: missing argument")
 		logrus.Error(err)
@@ -265,7 +309,7 @@ func CreateHubServerCert(names []string, caCert *x509.Certificate, caPrivKey *ec
 	logrus.Infof("CertSetup.CreateServiceCert: Refresh server certificate for IP/name: %s", names)
 
 	template := &x509.Certificate{
-		SerialNumber: big.NewInt(2021),
+		SerialNumber: newSerialNumber(),
 		Subject: pkix.Name{
 			Organization:       []string{CertOrgName},
 			Country:            []string{"CA"},
@@ -274,8 +318,8 @@ func CreateHubServerCert(names []string, caCert *x509.Certificate, caPrivKey *ec
 			CommonName:         "WoST Service",
 			OrganizationalUnit: []string{OUAdmin},
 		},
-		NotBefore: time.Now(),
-		NotAfter:  time.Now().AddDate(0, 0, DefaultCertDurationDays),
+		NotBefore: certClock.Now(),
+		NotAfter:  certClock.Now().AddDate(0, 0, DefaultCertDurationDays),
 
 		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageCRLSign,
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
@@ -287,14 +331,8 @@ func CreateHubServerCert(names []string, caCert *x509.Certificate, caPrivKey *ec
 		IPAddresses: []net.IP{},
 	}
 	// determine the hosts for this hub
+	template.IPAddresses, template.DNSNames = serverCertSANs(names)
 
-	for _, h := range names {
-		if ip := net.ParseIP(h); ip != nil {
-			template.IPAddresses = append(template.IPAddresses, ip)
-		} else {
-			template.DNSNames = append(template.DNSNames, h)
-		}
-	}
 	// Create the server private key
 	certKey := certs.CreateECDSAKeys()
 	// and the certificate itself
@@ -303,6 +341,15 @@ func CreateHubServerCert(names []string, caCert *x509.Certificate, caPrivKey *ec
 	if err != nil {
 		return nil, err
 	}
+	audit.Record(audit.Event{
+		Type:    audit.EventCertificateIssued,
+		UserID:  template.Subject.CommonName,
+		Success: true,
+		Details: map[string]string{
+			"names":    strings.Join(names, ","),
+			"notAfter": template.NotAfter.Format(time.RFC3339),
+		},
+	})
 	// combined them into a TLS certificate
 	tlscert := &tls.Certificate{}
 	tlscert.Certificate = append(tlscert.Certificate, certDer)
@@ -310,3 +357,43 @@ func CreateHubServerCert(names []string, caCert *x509.Certificate, caPrivKey *ec
 
 	return tlscert, nil
 }
+
+// newSerialNumber returns a random 128 bit certificate serial number
+// Serial numbers must be unique for the CA in order to revoke individual certificates.
+func newSerialNumber() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
+
+// serverCertSANs splits the server names into IP addresses and DNS names for use as
+// certificate subject alternative names. Duplicates are removed.
+func serverCertSANs(names []string) (ipAddresses []net.IP, dnsNames []string) {
+	ipAddresses = make([]net.IP, 0)
+	dnsNames = make([]string, 0)
+	dnsNameFound := make(map[string]bool)
+	hasLoopback := false
+	addIP := func(ip net.IP) {
+		for _, existing := range ipAddresses {
+			if existing.Equal(ip) {
+				return
+			}
+		}
+		ipAddresses = append(ipAddresses, ip)
+	}
+	for _, h := range names {
+		h = strings.TrimSuffix(strings.TrimPrefix(h, "["), "]")
+		if ip := net.ParseIP(h); ip != nil {
+			hasLoopback = hasLoopback || ip.IsLoopback()
+			addIP(ip)
+		} else if h != "" && !dnsNameFound[h] {
+			hasLoopback = hasLoopback || h == "localhost"
+			dnsNameFound[h] = true
+			dnsNames = append(dnsNames, h)
+		}
+	}
+	if hasLoopback {
+		addIP(net.IPv4(127, 0, 0, 1))
+		addIP(net.IPv6loopback)
+	}
+	return ipAddresses, dnsNames
+}
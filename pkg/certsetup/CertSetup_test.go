@@ -1,10 +1,18 @@
 package certsetup_test
 
 import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -13,6 +21,7 @@ import (
 	"github.com/wostzone/hubclient-go/pkg/certs"
 	"github.com/wostzone/hubclient-go/pkg/config"
 	"github.com/wostzone/hubserve-go/pkg/certsetup"
+	"github.com/wostzone/hubserve-go/pkg/clock"
 )
 
 var homeFolder string
@@ -79,7 +88,20 @@ func TestCreateServerCert(t *testing.T) {
 	require.NotNil(t, cert)
 	require.NotNil(t, cert.PrivateKey)
 
-	// todo, verify names in certificate
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"localhost"}, x509Cert.DNSNames)
+	// a loopback name includes the IPv6 loopback address
+	require.Equal(t, 2, len(x509Cert.IPAddresses))
+	assert.True(t, x509Cert.IPAddresses[1].Equal(net.IPv6loopback))
+
+	// bracketed IPv6 literals are accepted
+	cert, err = certsetup.CreateHubServerCert([]string{"[fd00::1]", "hub.local"}, caCert, caKey)
+	require.NoError(t, err)
+	x509Cert, _ = x509.ParseCertificate(cert.Certificate[0])
+	require.Equal(t, 1, len(x509Cert.IPAddresses))
+	assert.Equal(t, "fd00::1", x509Cert.IPAddresses[0].String())
+	assert.Equal(t, []string{"hub.local"}, x509Cert.DNSNames)
 }
 
 func TestServerCertBadCA(t *testing.T) {
@@ -145,3 +167,445 @@ func TestCreateBundleBadNames(t *testing.T) {
 	err := certsetup.CreateCertificateBundle(nil, certFolder)
 	require.Error(t, err)
 }
+
+func TestCreateUserCert(t *testing.T) {
+	loginID := "user1@example.com"
+	caCert, caKey := certsetup.CreateHubCA()
+
+	userCert, userKey, err := certsetup.CreateUserCert(loginID, certsetup.OUClient, 1, caCert, caKey)
+	require.NoError(t, err)
+	require.NotNil(t, userKey)
+	assert.Equal(t, loginID, userCert.Subject.CommonName)
+	assert.Equal(t, []string{certsetup.OUClient}, userCert.Subject.OrganizationalUnit)
+	assert.Equal(t, []string{loginID}, userCert.EmailAddresses)
+
+	// a plain loginID is not an email address
+	userCert, _, err = certsetup.CreateUserCert("user2", certsetup.OUClient, 1, caCert, caKey)
+	require.NoError(t, err)
+	assert.Empty(t, userCert.EmailAddresses)
+
+	// missing arguments
+	_, _, err = certsetup.CreateUserCert("", certsetup.OUClient, 1, caCert, caKey)
+	assert.Error(t, err)
+	// the plugin CommonName is reserved
+	_, _, err = certsetup.CreateUserCert("Plugin", certsetup.OUClient, 1, caCert, caKey)
+	assert.Error(t, err)
+	_, _, err = certsetup.CreateUserCert(loginID, certsetup.OUClient, 1, nil, caKey)
+	assert.Error(t, err)
+}
+
+func TestIssueUserCert(t *testing.T) {
+	loginID := "user1"
+	err := certsetup.CreateCertificateBundle([]string{"127.0.0.1"}, certFolder)
+	require.NoError(t, err)
+
+	certPath, keyPath, err := certsetup.IssueUserCert(loginID, certsetup.OUClient, 1, certFolder)
+	require.NoError(t, err)
+	assert.Equal(t, path.Join(certFolder, "user1Cert.pem"), certPath)
+	userCert, err := certs.LoadTLSCertFromPEM(certPath, keyPath)
+	require.NoError(t, err)
+	assert.NotNil(t, userCert)
+
+	// loginID must be usable as a filename
+	_, _, err = certsetup.IssueUserCert("../user1", certsetup.OUClient, 1, certFolder)
+	assert.Error(t, err)
+
+	// user certificates never replace the CA, server or plugin certificates
+	caCertPath := path.Join(certFolder, config.DefaultCaCertFile)
+	caCertBefore, err := ioutil.ReadFile(caCertPath)
+	require.NoError(t, err)
+	for _, reserved := range []string{"ca", "CA", "hub", "plugin", "caPrev", "caCross"} {
+		_, _, err = certsetup.IssueUserCert(reserved, certsetup.OUClient, 1, certFolder)
+		assert.Error(t, err, reserved)
+	}
+	caCertAfter, err := ioutil.ReadFile(caCertPath)
+	require.NoError(t, err)
+	assert.Equal(t, caCertBefore, caCertAfter)
+	caCert, err := certs.LoadX509CertFromPEM(caCertPath)
+	require.NoError(t, err)
+	assert.True(t, caCert.IsCA)
+
+	// no CA
+	_, _, err = certsetup.IssueUserCert(loginID, certsetup.OUClient, 1, "/not/a/valid/folder")
+	assert.Error(t, err)
+}
+
+func TestInspectBundle(t *testing.T) {
+	removeServerCerts()
+	err := certsetup.CreateCertificateBundle([]string{"127.0.0.1", "localhost"}, certFolder)
+	require.NoError(t, err)
+
+	report, err := certsetup.InspectBundle(certFolder)
+	require.NoError(t, err)
+	// CA, hub and plugin certificates. Key files are ignored.
+	require.Equal(t, 3, len(report))
+	for _, info := range report {
+		assert.NotEmpty(t, info.File)
+		assert.Equal(t, "ECDSA P-256", info.KeyType)
+		assert.Greater(t, info.DaysRemaining, 300)
+		assert.False(t, info.IsExpired())
+		assert.False(t, info.IsExpiringSoon(time.Hour*24*30))
+		assert.True(t, info.IsExpiringSoon(time.Hour*24*365*30))
+		if info.File == config.DefaultServerCertFile {
+			assert.Equal(t, []string{"127.0.0.1", "::1"}, info.IPAddresses)
+			assert.Equal(t, []string{"localhost"}, info.DNSNames)
+		}
+	}
+
+	_, err = certsetup.InspectBundle("/not/a/valid/folder")
+	assert.Error(t, err)
+}
+
+func TestCertExpiryWithClock(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	certsetup.SetClock(fakeClock)
+	defer certsetup.SetClock(nil)
+
+	caCert, caKey := certsetup.CreateHubCA()
+	clientKey := certs.CreateECDSAKeys()
+	clientCert, err := certsetup.CreateHubClientCert("client1", certsetup.OUClient,
+		&clientKey.PublicKey, caCert, caKey, fakeClock.Now(), 1)
+	require.NoError(t, err)
+	info := certsetup.InspectCert(clientCert)
+	assert.False(t, info.IsExpired())
+	assert.Equal(t, 0, info.DaysRemaining)
+
+	// the certificate expires after a day without waiting for it
+	fakeClock.Advance(49 * time.Hour)
+	assert.True(t, info.IsExpired())
+	info = certsetup.InspectCert(clientCert)
+	assert.Equal(t, -1, info.DaysRemaining)
+	caInfo := certsetup.InspectCert(caCert)
+	assert.False(t, caInfo.IsExpired())
+}
+
+func TestCertAdmin(t *testing.T) {
+	removeServerCerts()
+	_, _, err := certsetup.IssuePluginCert(certFolder)
+	assert.Error(t, err, "no CA")
+
+	caCert, _, err := certsetup.InitCA(certFolder, false)
+	require.NoError(t, err)
+	caCert2, _, err := certsetup.InitCA(certFolder, false)
+	require.NoError(t, err)
+	assert.Equal(t, caCert.SerialNumber, caCert2.SerialNumber, "existing CA is kept")
+
+	serverCertPath, _, err := certsetup.IssueServerCert([]string{"localhost"}, certFolder)
+	require.NoError(t, err)
+	pluginCertPath, pluginKeyPath, err := certsetup.IssuePluginCert(certFolder)
+	require.NoError(t, err)
+	userCertPath, _, err := certsetup.IssueUserCert("user1", certsetup.OUClient, 1, certFolder)
+	require.NoError(t, err)
+
+	// renewal keeps the subject, names and key
+	serverCert, err := certs.LoadX509CertFromPEM(serverCertPath)
+	require.NoError(t, err)
+	renewedCert, err := certsetup.RenewCert(serverCertPath, 30, certFolder)
+	require.NoError(t, err)
+	assert.NotEqual(t, serverCert.SerialNumber, renewedCert.SerialNumber)
+	assert.Equal(t, serverCert.DNSNames, renewedCert.DNSNames)
+	assert.Equal(t, serverCert.PublicKey, renewedCert.PublicKey)
+	userCert, err := certsetup.RenewCert(userCertPath, 30, certFolder)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", userCert.Subject.CommonName)
+	_, err = certs.LoadTLSCertFromPEM(userCertPath, path.Join(certFolder, "user1"+certsetup.UserKeyFileSuffix))
+	assert.NoError(t, err)
+	_, err = certsetup.RenewCert(path.Join(certFolder, config.DefaultCaCertFile), 30, certFolder)
+	assert.Error(t, err, "CA can't be renewed")
+
+	// revoke the plugin and user certificates
+	revoked, err := certsetup.ListRevoked(certFolder)
+	require.NoError(t, err)
+	assert.Empty(t, revoked)
+	err = certsetup.RevokeCert(pluginCertPath, certFolder, false)
+	require.NoError(t, err)
+	err = certsetup.RevokeCert(userCertPath, certFolder, false)
+	require.NoError(t, err)
+	err = certsetup.RevokeCert(userCertPath, certFolder, false)
+	require.NoError(t, err)
+	revoked, err = certsetup.ListRevoked(certFolder)
+	require.NoError(t, err)
+	assert.Len(t, revoked, 2)
+
+	pluginCert, err := certs.LoadX509CertFromPEM(pluginCertPath)
+	require.NoError(t, err)
+	isRevoked, _ := certsetup.IsRevoked(certFolder, pluginCert.SerialNumber)
+	assert.True(t, isRevoked)
+	isRevoked, _ = certsetup.IsRevoked(certFolder, renewedCert.SerialNumber)
+	assert.False(t, isRevoked)
+	report, err := certsetup.InspectBundle(certFolder)
+	require.NoError(t, err)
+	for _, info := range report {
+		assert.Equal(t, info.File == config.DefaultPluginCertFile || info.File == "user1Cert.pem", info.Revoked)
+	}
+	err = certsetup.RevokeCert(pluginKeyPath, certFolder, false)
+	assert.Error(t, err, "not a certificate")
+	err = certsetup.RevokeCert(path.Join(certFolder, config.DefaultCaCertFile), certFolder, true)
+	assert.Error(t, err, "CA can't be revoked")
+
+	// legacy certificates share the serial number of the CA
+	caCert, caKey, err := certsetup.LoadCA(certFolder)
+	require.NoError(t, err)
+	legacyKey := certs.CreateECDSAKeys()
+	legacyTemplate := &x509.Certificate{
+		SerialNumber: caCert.SerialNumber,
+		Subject:      pkix.Name{CommonName: "legacy"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	legacyDer, err := x509.CreateCertificate(rand.Reader, legacyTemplate, caCert, &legacyKey.PublicKey, caKey)
+	require.NoError(t, err)
+	legacyCert, _ := x509.ParseCertificate(legacyDer)
+	legacyCertPath := path.Join(certFolder, "legacyCert.pem")
+	err = certs.SaveX509CertToPEM(legacyCert, legacyCertPath)
+	require.NoError(t, err)
+	err = certsetup.RevokeCert(legacyCertPath, certFolder, false)
+	assert.Error(t, err, "serial number is shared with the CA")
+	err = certsetup.RevokeCert(legacyCertPath, certFolder, true)
+	require.NoError(t, err)
+	isRevoked, _ = certsetup.IsRevokedCert(certFolder, legacyCert)
+	assert.True(t, isRevoked)
+	isRevoked, _ = certsetup.IsRevokedCert(certFolder, caCert)
+	assert.False(t, isRevoked, "the CA is not revoked with the legacy certificate")
+	report, err = certsetup.InspectBundle(certFolder)
+	require.NoError(t, err)
+	for _, info := range report {
+		assert.Equal(t, info.File == config.DefaultPluginCertFile || info.File == "user1Cert.pem" ||
+			info.File == "legacyCert.pem", info.Revoked, info.File)
+	}
+
+	// a new CA invalidates the revocation list and certificates of the old CA
+	_, _, err = certsetup.InitCA(certFolder, true)
+	require.NoError(t, err)
+	revoked, err = certsetup.ListRevoked(certFolder)
+	require.NoError(t, err)
+	assert.Empty(t, revoked)
+	err = certsetup.RevokeCert(serverCertPath, certFolder, false)
+	assert.Error(t, err, "not signed by the new CA")
+	_, _, err = certsetup.InitCA("/not/a/valid/folder", false)
+	assert.Error(t, err)
+}
+
+func TestSaveCertFilePermissions(t *testing.T) {
+	removeServerCerts()
+	_, _, err := certsetup.InitCA(certFolder, false)
+	require.NoError(t, err)
+	certPath, keyPath, err := certsetup.IssueUserCert("user1", certsetup.OUClient, 1, certFolder)
+	require.NoError(t, err)
+	keyInfo, err := os.Stat(keyPath)
+	require.NoError(t, err)
+	assert.Equal(t, certsetup.KeyFilePermissions, keyInfo.Mode().Perm())
+	certInfo, err := os.Stat(certPath)
+	require.NoError(t, err)
+	assert.Equal(t, certsetup.CertFilePermissions, certInfo.Mode().Perm())
+	assert.NoError(t, certsetup.CheckKeyFilePermissions(keyPath))
+
+	// no temporary files are left behind
+	tmpFiles, _ := filepath.Glob(path.Join(certFolder, ".*.tmp*"))
+	assert.Empty(t, tmpFiles)
+
+	// the previous key is kept if the certificate cannot be replaced
+	pluginCertPath, pluginKeyPath, err := certsetup.IssuePluginCert(certFolder)
+	require.NoError(t, err)
+	prevKeyPEM, _ := ioutil.ReadFile(pluginKeyPath)
+	_ = os.Remove(pluginCertPath)
+	_ = os.Mkdir(pluginCertPath, 0700)
+	defer os.RemoveAll(pluginCertPath)
+	_, _, err = certsetup.IssuePluginCert(certFolder)
+	assert.Error(t, err)
+	keyPEM, _ := ioutil.ReadFile(pluginKeyPath)
+	assert.Equal(t, prevKeyPEM, keyPEM)
+	_ = os.RemoveAll(pluginCertPath)
+
+	// keys readable by others are rejected
+	caKeyPath := path.Join(certFolder, config.DefaultCaKeyFile)
+	err = os.Chmod(caKeyPath, 0644)
+	require.NoError(t, err)
+	err = certsetup.CheckKeyFilePermissions(caKeyPath)
+	var permErr *certsetup.PermissionError
+	require.True(t, errors.As(err, &permErr))
+	assert.Equal(t, caKeyPath, permErr.Path)
+	_, _, err = certsetup.LoadCA(certFolder)
+	assert.Error(t, err)
+	_, _, err = certsetup.IssueUserCert("user1", certsetup.OUClient, 1, certFolder)
+	assert.Error(t, err)
+
+	err = certsetup.CheckKeyFilePermissions(path.Join(certFolder, "notakey.pem"))
+	assert.Error(t, err)
+	assert.False(t, errors.As(err, &permErr))
+}
+
+func TestKeyStore(t *testing.T) {
+	keyFolder, err := ioutil.TempDir("", "certsetup")
+	require.NoError(t, err)
+	defer os.RemoveAll(keyFolder)
+	var keyStore certsetup.IKeyStore = certsetup.NewFileKeyStore(keyFolder)
+
+	_, err = keyStore.GetKey("ca")
+	assert.Error(t, err)
+	_, err = keyStore.CreateKey("../ca")
+	assert.Error(t, err)
+	caSigner, err := keyStore.CreateKey("ca")
+	require.NoError(t, err)
+	caSigner2, err := keyStore.GetKey("ca")
+	require.NoError(t, err)
+	assert.Equal(t, caSigner.Public(), caSigner2.Public())
+
+	// a device key of another type, eg held in the device TPM, is signed by the CA signer
+	caCert, caKey := certsetup.CreateHubCA()
+	deviceKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	deviceCert, err := certsetup.CreateClientCertForKey("device1", certsetup.OUIoTDevice,
+		deviceKey.Public(), caCert, caKey, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "RSA 2048", certsetup.InspectCert(deviceCert).KeyType)
+	assert.NoError(t, deviceCert.CheckSignatureFrom(caCert))
+	_, err = certsetup.CreateClientCertForKey("device1", certsetup.OUIoTDevice, nil, caCert, caKey, 1)
+	assert.Error(t, err)
+
+	tlsCert := certsetup.NewTLSCertWithSigner(deviceCert, deviceKey)
+	assert.Equal(t, deviceCert, tlsCert.Leaf)
+	assert.Equal(t, deviceKey, tlsCert.PrivateKey)
+
+	// a CA key that cannot be exported, eg held in a TPM, signs server and client certificates
+	hwCaKey := hardwareSigner{caKey}
+	serverCert, err := certsetup.CreateHubServerCert([]string{"localhost"}, caCert, hwCaKey)
+	require.NoError(t, err)
+	serverLeaf, _ := x509.ParseCertificate(serverCert.Certificate[0])
+	assert.NoError(t, serverLeaf.CheckSignatureFrom(caCert))
+	clientKey := certs.CreateECDSAKeys()
+	clientCert, err := certsetup.CreateHubClientCert("client1", certsetup.OUClient,
+		&clientKey.PublicKey, caCert, hwCaKey, time.Now(), 1)
+	require.NoError(t, err)
+	assert.NoError(t, clientCert.CheckSignatureFrom(caCert))
+	userCert, _, err := certsetup.CreateUserCert("user1", certsetup.OUClient, 1, caCert, hwCaKey)
+	require.NoError(t, err)
+	assert.NoError(t, userCert.CheckSignatureFrom(caCert))
+}
+
+// hardwareSigner hides the key type of a signer, like keys held in a TPM or PKCS#11 token
+type hardwareSigner struct {
+	crypto.Signer
+}
+
+func TestEncryptedKey(t *testing.T) {
+	keyFolder, err := ioutil.TempDir("", "certsetup")
+	require.NoError(t, err)
+	defer os.RemoveAll(keyFolder)
+	passphrase := []byte("secret passphrase")
+	getPassphrase := func(keyPath string) ([]byte, error) { return passphrase, nil }
+
+	key := certs.CreateECDSAKeys()
+	keyPath := path.Join(keyFolder, "testKey.pem")
+	err = certsetup.SaveEncryptedKeyToPEM(key, keyPath, passphrase)
+	require.NoError(t, err)
+	pemData, _ := ioutil.ReadFile(keyPath)
+	assert.Contains(t, string(pemData), certsetup.EncryptedKeyPEMType)
+
+	key2, err := certsetup.LoadKeyFromPEM(keyPath, getPassphrase)
+	require.NoError(t, err)
+	assert.Equal(t, key.Public(), key2.Public())
+	_, err = certsetup.LoadKeyFromPEM(keyPath, nil)
+	assert.Error(t, err)
+	_, err = certsetup.LoadKeyFromPEM(keyPath, func(string) ([]byte, error) { return []byte("wrong"), nil })
+	assert.Error(t, err)
+	_, err = certsetup.EncryptKeyPEM(key, nil)
+	assert.Error(t, err)
+
+	// the key store encrypts new keys and reads unencrypted keys
+	keyStore := certsetup.NewFileKeyStore(keyFolder)
+	plainKey, err := keyStore.CreateKey("plain")
+	require.NoError(t, err)
+	keyStore.SetPassphrase(getPassphrase)
+	_, err = keyStore.CreateKey("encrypted")
+	require.NoError(t, err)
+	pemData, _ = ioutil.ReadFile(path.Join(keyFolder, "encryptedKey.pem"))
+	assert.Contains(t, string(pemData), certsetup.EncryptedKeyPEMType)
+	_, err = keyStore.GetKey("encrypted")
+	assert.NoError(t, err)
+	plainKey2, err := keyStore.GetKey("plain")
+	require.NoError(t, err)
+	assert.Equal(t, plainKey.Public(), plainKey2.Public())
+
+	// the CA key is encrypted with the passphrase from the environment
+	os.Setenv(certsetup.PassphraseEnv, string(passphrase))
+	caCert, _, err := certsetup.InitCA(keyFolder, true)
+	require.NoError(t, err)
+	caCert2, _, err := certsetup.InitCA(keyFolder, false)
+	require.NoError(t, err)
+	assert.Equal(t, caCert.SerialNumber, caCert2.SerialNumber)
+	os.Unsetenv(certsetup.PassphraseEnv)
+	// without passphrase the existing CA cannot be loaded and is not replaced
+	_, _, err = certsetup.InitCA(keyFolder, false)
+	assert.Error(t, err)
+	err = certsetup.CreateCertificateBundle([]string{"localhost"}, keyFolder)
+	assert.Error(t, err)
+}
+
+func TestRotateCA(t *testing.T) {
+	removeServerCerts()
+	_, err := certsetup.RotateCA(certFolder, []string{"localhost"}, time.Hour)
+	assert.Error(t, err, "no CA")
+
+	prevCaCert, _, err := certsetup.InitCA(certFolder, false)
+	require.NoError(t, err)
+	pluginCertPath, _, err := certsetup.IssuePluginCert(certFolder)
+	require.NoError(t, err)
+	userCertPath, _, err := certsetup.IssueUserCert("user1", certsetup.OUClient, 1, certFolder)
+	require.NoError(t, err)
+	err = certsetup.RevokeCert(pluginCertPath, certFolder, false)
+	require.NoError(t, err)
+	prevPluginCert, _ := certs.LoadX509CertFromPEM(pluginCertPath)
+	prevPool := x509.NewCertPool()
+	prevPool.AddCert(prevCaCert)
+
+	rotation, err := certsetup.RotateCA(certFolder, []string{"localhost"}, time.Hour)
+	require.NoError(t, err)
+	assert.NotEqual(t, prevCaCert.Subject.CommonName, rotation.CaCert.Subject.CommonName)
+	assert.Equal(t, prevCaCert.SerialNumber, certsetup.LoadPreviousCA(certFolder).SerialNumber)
+
+	// client certificates of both CAs are accepted during the transition
+	caPool, err := certsetup.LoadCAPool(certFolder)
+	require.NoError(t, err)
+	userCert, _ := certs.LoadX509CertFromPEM(userCertPath)
+	pluginCert, _ := certs.LoadX509CertFromPEM(pluginCertPath)
+	clientOpts := x509.VerifyOptions{Roots: caPool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	_, err = userCert.Verify(clientOpts)
+	assert.NoError(t, err, "certificate of the previous CA")
+	_, err = pluginCert.Verify(clientOpts)
+	assert.NoError(t, err, "certificate of the new CA")
+
+	// clients that only trust the previous CA accept the new server certificate
+	serverCert, err := certsetup.LoadServerCert(certFolder)
+	require.NoError(t, err)
+	require.Len(t, serverCert.Certificate, 2)
+	leaf, _ := x509.ParseCertificate(serverCert.Certificate[0])
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(rotation.CrossCaCert)
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: prevPool, Intermediates: intermediates, DNSName: "localhost"})
+	assert.NoError(t, err)
+
+	// revocations carry over and certificates of the previous CA can still be revoked
+	isRevoked, _ := certsetup.IsRevokedCert(certFolder, prevPluginCert)
+	assert.True(t, isRevoked)
+	isRevoked, _ = certsetup.IsRevoked(certFolder, prevPluginCert.SerialNumber)
+	assert.False(t, isRevoked, "not issued by the new CA")
+	err = certsetup.RevokeCert(userCertPath, certFolder, false)
+	assert.NoError(t, err)
+	isRevoked, _ = certsetup.IsRevokedCert(certFolder, userCert)
+	assert.True(t, isRevoked)
+
+	// the previous CA is no longer trusted after the transition
+	certsetup.SetClock(clock.NewFakeClock(time.Now().Add(2 * time.Hour)))
+	assert.Nil(t, certsetup.LoadPreviousCA(certFolder))
+	serverCert, err = certsetup.LoadServerCert(certFolder)
+	require.NoError(t, err)
+	assert.Len(t, serverCert.Certificate, 1)
+	certsetup.SetClock(nil)
+
+	// a new CA without rotation has no transition
+	_, _, err = certsetup.InitCA(certFolder, true)
+	require.NoError(t, err)
+	assert.Nil(t, certsetup.LoadPreviousCA(certFolder))
+}
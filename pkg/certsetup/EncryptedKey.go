@@ -0,0 +1,231 @@
+package certsetup
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// PassphraseEnv is the environment variable that holds the passphrase of encrypted private keys
+const PassphraseEnv = "WOST_KEY_PASSPHRASE"
+
+// EncryptedKeyPEMType is the PEM block type of PKCS#8 encrypted private keys
+const EncryptedKeyPEMType = "ENCRYPTED PRIVATE KEY"
+
+// number of PBKDF2 iterations when encrypting keys
+const pbkdf2Iterations = 100000
+
+// PassphraseFunc returns the passphrase for the private key file, for example by reading it
+// from configuration or prompting the user.
+type PassphraseFunc func(keyPath string) ([]byte, error)
+
+// PassphraseFromEnv returns the passphrase from the PassphraseEnv environment variable
+// Returns an error if the variable isn't set
+func PassphraseFromEnv(keyPath string) ([]byte, error) {
+	passphrase, found := os.LookupEnv(PassphraseEnv)
+	if !found || passphrase == "" {
+		return nil, fmt.Errorf("key %s is encrypted but %s is not set", keyPath, PassphraseEnv)
+	}
+	return []byte(passphrase), nil
+}
+
+// object identifiers of the PKCS#5 v2.0 encryption
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// encryptedPrivateKeyInfo is the PKCS#8 EncryptedPrivateKeyInfo structure
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// pbes2Params are the PBES2 algorithm parameters
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params are the PBKDF2 key derivation parameters
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// DecryptKeyPEM returns the private key from PEM data that is either a PKCS#8 encrypted key or an
+// unencrypted key. The passphrase function is only invoked for encrypted keys.
+//  pemData with the PEM encoded key
+//  keyPath is passed to the passphrase function and used in error messages
+//  getPassphrase provides the passphrase of an encrypted key
+// Returns the private key, or an error if the key cannot be decoded or the passphrase is wrong
+func DecryptKeyPEM(pemData []byte, keyPath string, getPassphrase PassphraseFunc) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, fmt.Errorf("DecryptKeyPEM: %s is not a PEM file", keyPath)
+	}
+	der := block.Bytes
+	if block.Type == EncryptedKeyPEMType {
+		if getPassphrase == nil {
+			return nil, fmt.Errorf("DecryptKeyPEM: key %s is encrypted and no passphrase is provided", keyPath)
+		}
+		passphrase, err := getPassphrase(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		der, err = decryptPKCS8(block.Bytes, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("DecryptKeyPEM: unable to decrypt key %s: %s", keyPath, err)
+		}
+	}
+	return parsePrivateKey(der)
+}
+
+// EncryptKeyPEM encrypts a private key with a passphrase using PKCS#8 with PBES2, PBKDF2-SHA256
+// and AES-256-CBC. The result can be read by openssl and other tools that support PKCS#8.
+//  key is the private key to encrypt, eg an *ecdsa.PrivateKey
+//  passphrase to encrypt the key with
+// Returns the PEM encoded encrypted key
+func EncryptKeyPEM(key crypto.PrivateKey, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("EncryptKeyPEM: empty passphrase")
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	_, _ = rand.Read(salt)
+	_, _ = rand.Read(iv)
+	aesKey := pbkdf2.Key(passphrase, salt, pbkdf2Iterations, 32, sha256.New)
+	block, _ := aes.NewCipher(aesKey)
+	// PKCS#7 padding
+	padLen := aes.BlockSize - len(der)%aes.BlockSize
+	plaintext := append(der, bytes.Repeat([]byte{byte(padLen)}, padLen)...)
+	encrypted := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, plaintext)
+
+	kdfParams, _ := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pbkdf2Iterations,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	ivParam, _ := asn1.Marshal(iv)
+	params, _ := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	encryptedDer, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: EncryptedKeyPEMType, Bytes: encryptedDer}), nil
+}
+
+// LoadKeyFromPEM loads a private key file that is either encrypted or unencrypted
+// The file permissions are checked with CheckKeyFilePermissions.
+//  keyPath of the key file
+//  getPassphrase provides the passphrase if the key is encrypted, eg PassphraseFromEnv
+// Returns the private key, or an error if the key cannot be loaded
+func LoadKeyFromPEM(keyPath string, getPassphrase PassphraseFunc) (crypto.Signer, error) {
+	err := CheckKeyFilePermissions(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	pemData, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return DecryptKeyPEM(pemData, keyPath, getPassphrase)
+}
+
+// SaveEncryptedKeyToPEM encrypts a private key with a passphrase and saves it atomically with
+// owner-only permissions.
+//  key is the private key to save, eg an *ecdsa.PrivateKey
+//  keyPath of the file to save the key to
+//  passphrase to encrypt the key with
+func SaveEncryptedKeyToPEM(key crypto.PrivateKey, keyPath string, passphrase []byte) error {
+	pemData, err := EncryptKeyPEM(key, passphrase)
+	if err != nil {
+		return err
+	}
+	return saveFile(keyPath, pemData, KeyFilePermissions)
+}
+
+// decryptPKCS8 decrypts a PBES2 encrypted PKCS#8 key using AES-CBC
+// Returns the DER encoded PKCS#8 private key
+func decryptPKCS8(der []byte, passphrase []byte) ([]byte, error) {
+	var keyInfo encryptedPrivateKeyInfo
+	var params pbes2Params
+	var kdfParams pbkdf2Params
+	var iv []byte
+	if _, err := asn1.Unmarshal(der, &keyInfo); err != nil {
+		return nil, err
+	} else if !keyInfo.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported encryption algorithm %s", keyInfo.Algorithm.Algorithm)
+	} else if _, err = asn1.Unmarshal(keyInfo.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	} else if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %s", params.KeyDerivationFunc.Algorithm)
+	} else if _, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, err
+	} else if !kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA256) {
+		return nil, fmt.Errorf("unsupported key derivation function %s", kdfParams.PRF.Algorithm)
+	} else if !params.EncryptionScheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, fmt.Errorf("unsupported cipher %s", params.EncryptionScheme.Algorithm)
+	} else if _, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	encrypted := keyInfo.EncryptedData
+	if len(iv) != aes.BlockSize || len(encrypted) == 0 || len(encrypted)%aes.BlockSize != 0 ||
+		kdfParams.IterationCount < 1 {
+		return nil, fmt.Errorf("invalid encryption parameters")
+	}
+	aesKey := pbkdf2.Key(passphrase, kdfParams.Salt, kdfParams.IterationCount, 32, sha256.New)
+	block, _ := aes.NewCipher(aesKey)
+	plaintext := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, encrypted)
+	padLen := int(plaintext[len(plaintext)-1])
+	if padLen < 1 || padLen > aes.BlockSize ||
+		!bytes.Equal(plaintext[len(plaintext)-padLen:], bytes.Repeat([]byte{byte(padLen)}, padLen)) {
+		return nil, fmt.Errorf("incorrect passphrase")
+	}
+	return plaintext[:len(plaintext)-padLen], nil
+}
+
+// parsePrivateKey parses a DER encoded PKCS#8, EC or PKCS#1 private key
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("invalid private key or incorrect passphrase")
+}
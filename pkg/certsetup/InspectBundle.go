@@ -0,0 +1,153 @@
+package certsetup
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CertInfo contains the inspection result of a single certificate
+type CertInfo struct {
+	// File the certificate was loaded from, if any
+	File string `json:"file,omitempty"`
+	// Subject distinguished name
+	Subject    string    `json:"subject"`
+	CommonName string    `json:"commonName"`
+	OU         []string  `json:"ou"`
+	Issuer     string    `json:"issuer"`
+	IsCA       bool      `json:"isCA"`
+	NotBefore  time.Time `json:"notBefore"`
+	NotAfter   time.Time `json:"notAfter"`
+	// DaysRemaining until the certificate expires. Negative if expired.
+	DaysRemaining  int      `json:"daysRemaining"`
+	DNSNames       []string `json:"dnsNames,omitempty"`
+	IPAddresses    []string `json:"ipAddresses,omitempty"`
+	EmailAddresses []string `json:"emailAddresses,omitempty"`
+	// KeyType of the certificate public key, eg "ECDSA P-256" or "RSA 2048"
+	KeyType string `json:"keyType"`
+	// SerialNumber of the certificate in decimal
+	SerialNumber string `json:"serialNumber"`
+	// Revoked is set by InspectBundle if the certificate is in the revocation list of the folder.
+	// Certificates are identified by their issuer and serial number.
+	Revoked bool `json:"revoked,omitempty"`
+}
+
+// IsExpired returns true if the certificate is no longer valid
+func (info *CertInfo) IsExpired() bool {
+	return certClock.Now().After(info.NotAfter)
+}
+
+// IsExpiringSoon returns true if the certificate expires within the given threshold.
+// Already expired certificates are also expiring soon.
+//  threshold is the duration before expiry to consider the certificate as expiring
+func (info *CertInfo) IsExpiringSoon(threshold time.Duration) bool {
+	return certClock.Now().Add(threshold).After(info.NotAfter)
+}
+
+// InspectCert returns the inspection info of the given certificate
+func InspectCert(cert *x509.Certificate) CertInfo {
+	info := CertInfo{
+		Subject:        cert.Subject.String(),
+		CommonName:     cert.Subject.CommonName,
+		OU:             cert.Subject.OrganizationalUnit,
+		Issuer:         cert.Issuer.String(),
+		IsCA:           cert.IsCA,
+		NotBefore:      cert.NotBefore,
+		NotAfter:       cert.NotAfter,
+		DaysRemaining:  int(cert.NotAfter.Sub(certClock.Now()).Hours() / 24),
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		KeyType:        getKeyType(cert),
+		SerialNumber:   cert.SerialNumber.String(),
+	}
+	for _, ip := range cert.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	return info
+}
+
+// InspectBundle returns the inspection info of each certificate in the PEM files of the given folder.
+// PEM files without certificates, like key files, are ignored. Files that cannot be parsed are
+// logged and skipped.
+// Intended for use by health endpoints and monitoring plugins.
+//
+//  certFolder containing the certificates, eg the hub certs folder
+// Returns a list of certificate info sorted by filename, or error if the folder cannot be read
+func InspectBundle(certFolder string) ([]CertInfo, error) {
+	result := make([]CertInfo, 0)
+	caCert, revokedCerts, err := loadRevoked(certFolder)
+	if err != nil {
+		logrus.Warningf("InspectBundle: %s", err)
+	}
+	err = forEachCert(certFolder, func(fileName string, cert *x509.Certificate) {
+		info := InspectCert(cert)
+		info.File = fileName
+		if len(revokedCerts) > 0 {
+			info.Revoked, _ = isCertRevoked(revokedCerts, caCert, cert)
+		}
+		result = append(result, info)
+	})
+	if err != nil {
+		logrus.Errorf("InspectBundle: unable to read folder %s: %s", certFolder, err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// forEachCert invokes the handler with each certificate in the PEM files of the given folder,
+// ordered by filename. PEM files without certificates, like key files, are ignored. Files that
+// cannot be parsed are logged and skipped.
+// Returns an error if the folder cannot be read
+func forEachCert(certFolder string, handler func(fileName string, cert *x509.Certificate)) error {
+	files, err := ioutil.ReadDir(certFolder)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".pem") {
+			continue
+		}
+		filePath := path.Join(certFolder, f.Name())
+		pemData, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			logrus.Warningf("forEachCert: unable to read %s: %s", filePath, err)
+			continue
+		}
+		for block, rest := pem.Decode(pemData); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				logrus.Warningf("forEachCert: invalid certificate in %s: %s", filePath, err)
+				continue
+			}
+			handler(f.Name(), cert)
+		}
+	}
+	return nil
+}
+
+// getKeyType returns a description of the certificate public key type and size
+func getKeyType(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECDSA %s", key.Curve.Params().Name)
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", key.N.BitLen())
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return cert.PublicKeyAlgorithm.String()
+}
@@ -0,0 +1,132 @@
+package certsetup
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/hubclient-go/pkg/certs"
+)
+
+// IKeyStore holds private keys for signing. Keys are used through the crypto.Signer interface so
+// they can live in a TPM2 chip or PKCS#11 token, where they can be used but not exported.
+// FileKeyStore is the file based implementation for devices without such hardware.
+type IKeyStore interface {
+	// CreateKey creates a new key with the given name, replacing an existing key with that name
+	CreateKey(keyName string) (crypto.Signer, error)
+	// GetKey returns the signer of an existing key
+	GetKey(keyName string) (crypto.Signer, error)
+}
+
+// FileKeyStore keeps ECDSA P-256 private keys in PEM files named {keyName}Key.pem.
+// This uses the same naming as the certificate folder, eg the key named "ca" is stored as caKey.pem.
+// Keys are encrypted if a passphrase function is set.
+type FileKeyStore struct {
+	folder        string
+	getPassphrase PassphraseFunc
+}
+
+// CreateKey creates a new ECDSA key and saves it in the store folder
+func (store *FileKeyStore) CreateKey(keyName string) (crypto.Signer, error) {
+	keyPath, err := store.keyPath(keyName)
+	if err != nil {
+		return nil, err
+	}
+	key := certs.CreateECDSAKeys()
+	if store.getPassphrase != nil {
+		var passphrase []byte
+		passphrase, err = store.getPassphrase(keyPath)
+		if err == nil {
+			err = SaveEncryptedKeyToPEM(key, keyPath, passphrase)
+		}
+	} else {
+		err = saveAtomic(keyPath, KeyFilePermissions, func(tmpPath string) error {
+			return certs.SaveKeysToPEM(key, tmpPath)
+		})
+	}
+	if err != nil {
+		logrus.Errorf("FileKeyStore.CreateKey: failed saving key '%s': %s", keyName, err)
+		return nil, err
+	}
+	return key, nil
+}
+
+// GetKey loads a key from the store folder
+// Returns an error if the key doesn't exist, cannot be decrypted or its file permissions are too
+// open, see PermissionError
+func (store *FileKeyStore) GetKey(keyName string) (crypto.Signer, error) {
+	keyPath, err := store.keyPath(keyName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := LoadKeyFromPEM(keyPath, store.getPassphrase)
+	if err != nil {
+		logrus.Errorf("FileKeyStore.GetKey: %s", err)
+		return nil, err
+	}
+	return key, nil
+}
+
+// SetPassphrase sets the function that provides the passphrase for encrypting new keys and
+// decrypting encrypted keys. Unencrypted keys can still be read.
+//  getPassphrase provides the passphrase, eg PassphraseFromEnv, or nil to not encrypt new keys
+func (store *FileKeyStore) SetPassphrase(getPassphrase PassphraseFunc) {
+	store.getPassphrase = getPassphrase
+}
+
+// keyPath returns the file path of the key with the given name
+func (store *FileKeyStore) keyPath(keyName string) (string, error) {
+	if keyName == "" || strings.ContainsAny(keyName, "/\\") || strings.HasPrefix(keyName, ".") {
+		return "", fmt.Errorf("FileKeyStore: key name '%s' is not usable as a filename", keyName)
+	}
+	return path.Join(store.folder, keyName+UserKeyFileSuffix), nil
+}
+
+// NewFileKeyStore creates a key store that keeps keys in PEM files
+//  folder to store the keys, eg the certificate folder
+func NewFileKeyStore(folder string) *FileKeyStore {
+	return &FileKeyStore{folder: folder}
+}
+
+// CreateClientCertForKey creates a client certificate for a public key of any type, signed by a CA
+// whose key can be held in an IKeyStore. Use this to issue certificates for device keys that are
+// generated in the device hardware and cannot leave it.
+//  clientID used as the CommonName, eg the deviceID
+//  ou of the client role, eg OUIoTDevice
+//  ownerPubKey is the public key of the certificate holder
+//  caCert is the CA certificate
+//  caSigner is the CA private key
+//  validityDays nr of days the certificate will be valid
+// Returns the signed certificate or error
+func CreateClientCertForKey(clientID string, ou string, ownerPubKey crypto.PublicKey,
+	caCert *x509.Certificate, caSigner crypto.Signer, validityDays int) (*x509.Certificate, error) {
+
+	if caCert == nil || caSigner == nil || ownerPubKey == nil {
+		err := fmt.Errorf("CreateClientCertForKey: missing CA cert, CA key or public key")
+		logrus.Error(err)
+		return nil, err
+	}
+	template := newClientCertTemplate(clientID, ou, certClock.Now(), validityDays)
+	cert, err := signClientCert(template, ownerPubKey, caCert, caSigner)
+	if err != nil {
+		logrus.Errorf("CreateClientCertForKey: Unable to create certificate for '%s': %s", clientID, err)
+		return nil, err
+	}
+	return cert, nil
+}
+
+// NewTLSCertWithSigner returns a TLS certificate whose private key is a signer, for use by the
+// TLS server or client when the key is held in an IKeyStore.
+//  cert is the certificate of the key
+//  signer is the private key of the certificate
+func NewTLSCertWithSigner(cert *x509.Certificate, signer crypto.Signer) *tls.Certificate {
+	return &tls.Certificate{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  signer,
+		Leaf:        cert,
+	}
+}
@@ -0,0 +1,216 @@
+package certsetup
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/hubclient-go/pkg/certs"
+	"github.com/wostzone/hubclient-go/pkg/config"
+)
+
+// DefaultPrevCaCertFile is the filename of the previous CA certificate after a CA rotation
+const DefaultPrevCaCertFile = "caPrevCert.pem"
+
+// DefaultCrossCaCertFile is the filename of the new CA certificate signed by the previous CA.
+// Its expiry marks the end of the transition period of a CA rotation.
+const DefaultCrossCaCertFile = "caCrossCert.pem"
+
+// DefaultCATransition is the default period after a CA rotation in which the previous CA is still trusted
+const DefaultCATransition = 30 * 24 * time.Hour
+
+// CARotation describes the result of a CA rotation
+type CARotation struct {
+	// PrevCaCert is the CA certificate that was replaced
+	PrevCaCert *x509.Certificate
+	// CaCert is the new CA certificate
+	CaCert *x509.Certificate
+	// CrossCaCert is the new CA certificate signed by the previous CA
+	CrossCaCert *x509.Certificate
+	// TransitionEnd is the time until which the previous CA is trusted
+	TransitionEnd time.Time
+}
+
+// LoadCAPool returns the pool of CA certificates to trust when verifying server and client
+// certificates. This is the CA in the certificate folder and, during the transition period of a
+// CA rotation, the previous CA.
+//  certFolder containing the CA certificates
+// Returns the pool, or an error if the CA certificate cannot be loaded
+func LoadCAPool(certFolder string) (*x509.CertPool, error) {
+	caCert, err := certs.LoadX509CertFromPEM(path.Join(certFolder, config.DefaultCaCertFile))
+	if err != nil {
+		logrus.Errorf("LoadCAPool: unable to load the CA certificate: %s", err)
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	if prevCaCert := LoadPreviousCA(certFolder); prevCaCert != nil {
+		pool.AddCert(prevCaCert)
+	}
+	return pool, nil
+}
+
+// LoadPreviousCA returns the previous CA certificate if the certificate folder is in the
+// transition period of a CA rotation.
+//  certFolder containing the CA certificates
+// Returns nil if there is no previous CA or its transition period has ended
+func LoadPreviousCA(certFolder string) *x509.Certificate {
+	crossCert := loadCrossCA(certFolder)
+	if crossCert == nil {
+		return nil
+	}
+	prevCaCert, err := certs.LoadX509CertFromPEM(path.Join(certFolder, DefaultPrevCaCertFile))
+	if err != nil {
+		return nil
+	}
+	return prevCaCert
+}
+
+// LoadServerCert loads the Hub server certificate and key from the certificate folder.
+// During the transition period of a CA rotation the cross-signed CA certificate is included in
+// the certificate chain, so clients that only trust the previous CA can still verify the server.
+//  certFolder containing the server certificate and key
+// Returns the TLS certificate, or an error if it cannot be loaded
+func LoadServerCert(certFolder string) (*tls.Certificate, error) {
+	serverCert, err := tls.LoadX509KeyPair(
+		path.Join(certFolder, config.DefaultServerCertFile),
+		path.Join(certFolder, config.DefaultServerKeyFile))
+	if err != nil {
+		logrus.Errorf("LoadServerCert: unable to load the server certificate: %s", err)
+		return nil, err
+	}
+	if crossCert := loadCrossCA(certFolder); crossCert != nil {
+		serverCert.Certificate = append(serverCert.Certificate, crossCert.Raw)
+	}
+	return &serverCert, nil
+}
+
+// RotateCA replaces the CA in the certificate folder with a new CA and issues new server and
+// plugin certificates. The new CA is cross-signed by the previous CA so that during the transition
+// period both CAs are trusted:
+//  - LoadCAPool includes the previous CA, so client certificates of the previous CA are accepted
+//  - LoadServerCert includes the cross-signed CA, so clients that only trust the previous CA accept the server
+// Clients should obtain the new CA certificate and renew their certificates before the transition ends.
+// Certificates that were revoked by the previous CA remain revoked.
+// CA certificates created before cross-signing was supported have a path length of 0. Clients that
+// only trust such a CA reject the cross-signed chain and must install the new CA certificate.
+//  certFolder containing the CA certificate and key, and where the new certificates are stored
+//  names contains the domain names and IP addresses of the Hub server certificate
+//  transition is the period in which the previous CA remains trusted, eg DefaultCATransition
+// Returns the rotation result, or an error if the CA cannot be loaded or the new CA cannot be saved
+func RotateCA(certFolder string, names []string, transition time.Duration) (*CARotation, error) {
+	prevCaCert, prevCaKey, err := LoadCA(certFolder)
+	if err != nil {
+		return nil, err
+	}
+	// the previous revocation list is signed by the previous CA
+	revokedCerts, err := ListRevoked(certFolder)
+	if err != nil {
+		logrus.Errorf("RotateCA: %s", err)
+		return nil, err
+	}
+	if prevCaCert.MaxPathLen < 1 {
+		logrus.Warningf("RotateCA: CA '%s' doesn't allow cross-signing. Clients must install the new CA before they accept the server",
+			prevCaCert.Subject.CommonName)
+	}
+	now := certClock.Now()
+	caCert, caKey := createCA(fmt.Sprintf("WoST CA %s", now.Format("2006-01-02")))
+	if caCert == nil {
+		return nil, fmt.Errorf("RotateCA: unable to create the new CA")
+	}
+	transitionEnd := now.Add(transition)
+	crossCert, err := crossSignCA(caCert, prevCaCert, prevCaKey, transitionEnd)
+	if err != nil {
+		logrus.Errorf("RotateCA: unable to cross-sign the new CA: %s", err)
+		return nil, err
+	}
+	// keep the previous CA and cross-signed CA before replacing the CA
+	err = saveCert(prevCaCert, path.Join(certFolder, DefaultPrevCaCertFile))
+	if err == nil {
+		err = saveCert(crossCert, path.Join(certFolder, DefaultCrossCaCertFile))
+	}
+	if err == nil {
+		err = saveCA(caCert, caKey, certFolder)
+	}
+	if err != nil {
+		logrus.Errorf("RotateCA: failed saving the CA: %s", err)
+		return nil, err
+	}
+	if len(revokedCerts) > 0 {
+		// entries without certificate issuer are of certificates issued by the previous CA
+		for i, revokedCert := range revokedCerts {
+			if revokedCertIssuer(revokedCert, nil) == nil {
+				revokedCerts[i].Extensions = append(revokedCert.Extensions,
+					certificateIssuerExtension(prevCaCert.RawSubject))
+			}
+		}
+		err = saveCRL(revokedCerts, caCert, caKey, certFolder)
+	} else {
+		err = os.Remove(path.Join(certFolder, DefaultCrlFile))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		logrus.Errorf("RotateCA: failed saving the revocation list: %s", err)
+		return nil, err
+	}
+	if _, _, err = IssueServerCert(names, certFolder); err != nil {
+		return nil, err
+	}
+	if _, _, err = IssuePluginCert(certFolder); err != nil {
+		return nil, err
+	}
+	logrus.Warningf("RotateCA: replaced CA '%s' with '%s'. The previous CA is trusted until %s",
+		prevCaCert.Subject.CommonName, caCert.Subject.CommonName, transitionEnd.Format(time.RFC3339))
+	return &CARotation{
+		PrevCaCert:    prevCaCert,
+		CaCert:        caCert,
+		CrossCaCert:   crossCert,
+		TransitionEnd: transitionEnd,
+	}, nil
+}
+
+// crossSignCA creates a certificate for the subject and public key of a CA, signed by another CA.
+// Certificates issued by the CA can then be verified using either CA as the root.
+//  caCert is the CA certificate to cross-sign
+//  signerCert is the certificate of the signing CA
+//  signerKey is the private key of the signing CA
+//  notAfter is the end of the validity of the cross-signed certificate
+func crossSignCA(caCert *x509.Certificate, signerCert *x509.Certificate, signerKey crypto.Signer,
+	notAfter time.Time) (*x509.Certificate, error) {
+
+	template := &x509.Certificate{
+		SerialNumber:          newSerialNumber(),
+		Subject:               caCert.Subject,
+		SubjectKeyId:          caCert.SubjectKeyId,
+		NotBefore:             caCert.NotBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              caCert.KeyUsage,
+		ExtKeyUsage:           caCert.ExtKeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            0,
+		MaxPathLenZero:        true,
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, signerCert, caCert.PublicKey, signerKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(certDer)
+}
+
+// loadCrossCA returns the cross-signed CA certificate if it exists and hasn't expired
+func loadCrossCA(certFolder string) *x509.Certificate {
+	crossCert, err := certs.LoadX509CertFromPEM(path.Join(certFolder, DefaultCrossCaCertFile))
+	if err != nil || certClock.Now().After(crossCert.NotAfter) {
+		return nil
+	}
+	return crossCert
+}
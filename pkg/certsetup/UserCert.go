@@ -0,0 +1,122 @@
+package certsetup
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"fmt"
+	"net/mail"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/hubclient-go/pkg/certs"
+	"github.com/wostzone/hubclient-go/pkg/config"
+)
+
+// UserCertFileSuffix and UserKeyFileSuffix are appended to the loginID to construct the
+// user certificate and key filenames, eg {loginID}Cert.pem and {loginID}Key.pem
+const UserCertFileSuffix = "Cert.pem"
+const UserKeyFileSuffix = "Key.pem"
+
+// reservedCertFiles are the files in the certificate folder that user certificates must not replace
+var reservedCertFiles = []string{
+	config.DefaultCaCertFile, config.DefaultCaKeyFile,
+	config.DefaultServerCertFile, config.DefaultServerKeyFile,
+	config.DefaultPluginCertFile, config.DefaultPluginKeyFile,
+	DefaultPrevCaCertFile, DefaultCrossCaCertFile,
+}
+
+// CreateUserCert creates a client certificate and private key for an end user, like a consumer
+// using a browser or mobile app.
+// The loginID is stored in the certificate CommonName. If the loginID is an email address then
+// it is also included in the certificate email addresses.
+// The loginID 'plugin' is rejected as that CommonName identifies plugins, which have full permission.
+//
+//  loginID of the user, used as the CommonName
+//  ou of the user role, eg OUClient or OUAdmin
+//  validityDays nr of days the certificate will be valid
+//  caCert CA's certificate for signing
+//  caPrivKey CA's key for signing. The key can be held in an IKeyStore.
+// Returns the signed certificate and its private key, or error
+func CreateUserCert(loginID string, ou string, validityDays int,
+	caCert *x509.Certificate, caPrivKey crypto.Signer) (
+	cert *x509.Certificate, privKey *ecdsa.PrivateKey, err error) {
+
+	if loginID == "" {
+		err = fmt.Errorf("CreateUserCert: missing loginID")
+		logrus.Error(err)
+		return nil, nil, err
+	}
+	if strings.EqualFold(loginID, DefaultPluginClientID) {
+		err = fmt.Errorf("CreateUserCert: loginID '%s' is reserved for plugins", loginID)
+		logrus.Error(err)
+		return nil, nil, err
+	}
+	if caCert == nil || caPrivKey == nil {
+		err = fmt.Errorf("CreateUserCert: missing CA cert or key")
+		logrus.Error(err)
+		return nil, nil, err
+	}
+	var emailAddresses []string
+	if addr, err2 := mail.ParseAddress(loginID); err2 == nil && addr.Address == loginID {
+		emailAddresses = []string{loginID}
+	}
+	template := newClientCertTemplate(loginID, ou, certClock.Now(), validityDays)
+	template.EmailAddresses = emailAddresses
+
+	privKey = certs.CreateECDSAKeys()
+	cert, err = signClientCert(template, &privKey.PublicKey, caCert, caPrivKey)
+	if err != nil {
+		logrus.Errorf("CertSetup.CreateUserCert: Unable to create user cert for '%s': %s", loginID, err)
+		return nil, nil, err
+	}
+	return cert, privKey, nil
+}
+
+// IssueUserCert is a convenience function for admin tooling that creates a user certificate signed
+// by the Hub CA in certFolder and stores it in the same folder.
+// The certificate is saved as {loginID}Cert.pem and the private key as {loginID}Key.pem.
+// Existing files for the same user are replaced. LoginIDs whose files would replace the CA, server
+// or plugin certificates, like 'ca' and 'hub', are rejected.
+//
+//  loginID of the user, used as the CommonName and filename prefix
+//  ou of the user role, eg OUClient or OUAdmin
+//  validityDays nr of days the certificate will be valid
+//  certFolder containing the CA certificate and key, and where the user certificate is stored
+// Returns the path of the saved certificate and key files, or error
+func IssueUserCert(loginID string, ou string, validityDays int, certFolder string) (
+	certPath string, keyPath string, err error) {
+
+	if loginID == "" || strings.ContainsAny(loginID, "/\\") || strings.HasPrefix(loginID, ".") {
+		err = fmt.Errorf("IssueUserCert: loginID '%s' is not usable as a filename", loginID)
+		logrus.Error(err)
+		return "", "", err
+	}
+	// compare case-insensitive as the filesystem can be
+	for _, reservedFile := range reservedCertFiles {
+		if strings.EqualFold(loginID+UserCertFileSuffix, reservedFile) ||
+			strings.EqualFold(loginID+UserKeyFileSuffix, reservedFile) {
+			err = fmt.Errorf("IssueUserCert: loginID '%s' is reserved for %s", loginID, reservedFile)
+			logrus.Error(err)
+			return "", "", err
+		}
+	}
+	caCert, caKey, err := LoadCA(certFolder)
+	if err != nil {
+		return "", "", err
+	}
+	userCert, userKey, err := CreateUserCert(loginID, ou, validityDays, caCert, caKey)
+	if err != nil {
+		return "", "", err
+	}
+	certPath = path.Join(certFolder, loginID+UserCertFileSuffix)
+	keyPath = path.Join(certFolder, loginID+UserKeyFileSuffix)
+	logrus.Infof("IssueUserCert: Saving certificate for user '%s' with OU '%s' in %s", loginID, ou, certPath)
+	err = saveKeyAndCert(userKey, userCert, keyPath, certPath)
+	if err != nil {
+		logrus.Errorf("IssueUserCert: failed saving certificate: %s", err)
+		return "", "", err
+	}
+	return certPath, keyPath, nil
+}
@@ -0,0 +1,17 @@
+// +build !windows
+
+package certsetup
+
+import (
+	"os"
+	"syscall"
+)
+
+// isOwnedByCurrentUser returns true if the file is owned by the current user or root
+func isOwnedByCurrentUser(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+	return stat.Uid == 0 || int(stat.Uid) == os.Getuid()
+}
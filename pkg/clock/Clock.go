@@ -0,0 +1,190 @@
+// Package clock provides a replaceable source of time.
+// Components that depend on the current time, like token and certificate expiry, use a Clock so
+// tests can control the time with a FakeClock instead of sleeping.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// After returns a channel that receives the time once the duration has passed
+	After(d time.Duration) <-chan time.Time
+	// NewTicker returns a ticker that sends the time on its channel every period
+	NewTicker(period time.Duration) Ticker
+}
+
+// Ticker sends the time on its channel at intervals
+type Ticker interface {
+	// C returns the channel on which the ticks are delivered
+	C() <-chan time.Time
+	// Stop the ticker. No more ticks will be sent.
+	Stop()
+}
+
+// RealClock is the Clock that uses the system time
+type RealClock struct{}
+
+// After waits for the duration to pass and then sends the current time
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// NewTicker returns a ticker using the system time
+func (RealClock) NewTicker(period time.Duration) Ticker {
+	return &realTicker{ticker: time.NewTicker(period)}
+}
+
+// Now returns the system time
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// realTicker wraps the time.Ticker
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (rt *realTicker) C() <-chan time.Time {
+	return rt.ticker.C
+}
+func (rt *realTicker) Stop() {
+	rt.ticker.Stop()
+}
+
+// FakeClock is a Clock whose time only changes when it is set or advanced.
+// Timers and tickers fire when the time is advanced past their deadline.
+type FakeClock struct {
+	mux     sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// fakeWaiter is a pending After timer or ticker of the fake clock
+type fakeWaiter struct {
+	deadline time.Time
+	// period of a ticker, 0 for a timer
+	period time.Duration
+	c      chan time.Time
+}
+
+// Advance moves the time forward and fires the timers and tickers that are due
+// Like the system ticker, a ticker that isn't read in time drops ticks.
+func (fc *FakeClock) Advance(d time.Duration) {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	fc.setTime(fc.now.Add(d))
+}
+
+// After returns a channel that receives the time once the clock is advanced by the duration
+func (fc *FakeClock) After(d time.Duration) <-chan time.Time {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- fc.now
+		return c
+	}
+	fc.waiters = append(fc.waiters, &fakeWaiter{deadline: fc.now.Add(d), c: c})
+	return c
+}
+
+// NewTicker returns a ticker that ticks each time the clock is advanced by the period
+// This panics if period is not positive, like time.NewTicker.
+func (fc *FakeClock) NewTicker(period time.Duration) Ticker {
+	if period <= 0 {
+		panic("clock.FakeClock.NewTicker: non-positive interval")
+	}
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	waiter := &fakeWaiter{deadline: fc.now.Add(period), period: period, c: make(chan time.Time, 1)}
+	fc.waiters = append(fc.waiters, waiter)
+	return &fakeTicker{clock: fc, waiter: waiter}
+}
+
+// Now returns the time of the fake clock
+func (fc *FakeClock) Now() time.Time {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	return fc.now
+}
+
+// Set the time of the fake clock and fire the timers and tickers that are due
+// Setting the time backwards doesn't fire anything.
+func (fc *FakeClock) Set(now time.Time) {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	fc.setTime(now)
+}
+
+// WaiterCount returns the number of pending timers and tickers.
+// Tests use this to wait until the code under test is waiting on the clock before advancing it.
+func (fc *FakeClock) WaiterCount() int {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	return len(fc.waiters)
+}
+
+// removeWaiter removes a stopped ticker
+func (fc *FakeClock) removeWaiter(waiter *fakeWaiter) {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	for i, w := range fc.waiters {
+		if w == waiter {
+			fc.waiters = append(fc.waiters[:i], fc.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// setTime changes the time and fires the waiters that are due, in order of their deadline
+// The caller must hold the lock.
+func (fc *FakeClock) setTime(now time.Time) {
+	fc.now = now
+	sort.SliceStable(fc.waiters, func(i, j int) bool {
+		return fc.waiters[i].deadline.Before(fc.waiters[j].deadline)
+	})
+	pending := fc.waiters[:0]
+	for _, waiter := range fc.waiters {
+		if waiter.deadline.After(now) {
+			pending = append(pending, waiter)
+			continue
+		}
+		select {
+		case waiter.c <- waiter.deadline:
+		default:
+		}
+		if waiter.period > 0 {
+			// skip the ticks that are missed
+			for !waiter.deadline.After(now) {
+				waiter.deadline = waiter.deadline.Add(waiter.period)
+			}
+			pending = append(pending, waiter)
+		}
+	}
+	fc.waiters = pending
+}
+
+// fakeTicker is the ticker of a fake clock
+type fakeTicker struct {
+	clock  *FakeClock
+	waiter *fakeWaiter
+}
+
+func (ft *fakeTicker) C() <-chan time.Time {
+	return ft.waiter.c
+}
+func (ft *fakeTicker) Stop() {
+	ft.clock.removeWaiter(ft.waiter)
+}
+
+// NewFakeClock creates a fake clock set to the given time
+//  now is the initial time of the clock. Use time.Now() to start at the current time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
@@ -0,0 +1,70 @@
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wostzone/hubserve-go/pkg/clock"
+)
+
+func TestRealClock(t *testing.T) {
+	var c clock.Clock = clock.RealClock{}
+	assert.WithinDuration(t, time.Now(), c.Now(), time.Second)
+	select {
+	case <-c.After(time.Millisecond):
+	case <-time.After(time.Second):
+		assert.Fail(t, "After didn't fire")
+	}
+	ticker := c.NewTicker(time.Millisecond)
+	<-ticker.C()
+	ticker.Stop()
+}
+
+func TestFakeClockAfter(t *testing.T) {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	fc := clock.NewFakeClock(start)
+	assert.Equal(t, start, fc.Now())
+
+	c1 := fc.After(time.Minute)
+	c2 := fc.After(time.Hour)
+	assert.Equal(t, 2, fc.WaiterCount())
+
+	fc.Advance(59 * time.Second)
+	assert.Len(t, c1, 0)
+	fc.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Minute), <-c1)
+	assert.Len(t, c2, 0)
+	assert.Equal(t, 1, fc.WaiterCount())
+
+	// setting the time past the deadline fires the timer
+	fc.Set(start.Add(2 * time.Hour))
+	assert.Equal(t, start.Add(time.Hour), <-c2)
+	assert.Equal(t, 0, fc.WaiterCount())
+
+	// a non-positive duration fires immediately
+	c3 := fc.After(0)
+	assert.Equal(t, fc.Now(), <-c3)
+}
+
+func TestFakeClockTicker(t *testing.T) {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	fc := clock.NewFakeClock(start)
+	ticker := fc.NewTicker(10 * time.Second)
+	fc.Advance(10 * time.Second)
+	assert.Equal(t, start.Add(10*time.Second), <-ticker.C())
+
+	// ticks that are not read are dropped
+	fc.Advance(35 * time.Second)
+	assert.Equal(t, start.Add(20*time.Second), <-ticker.C())
+	assert.Len(t, ticker.C(), 0)
+	fc.Advance(5 * time.Second)
+	assert.Equal(t, start.Add(50*time.Second), <-ticker.C())
+
+	ticker.Stop()
+	assert.Equal(t, 0, fc.WaiterCount())
+	fc.Advance(time.Minute)
+	assert.Len(t, ticker.C(), 0)
+
+	assert.Panics(t, func() { fc.NewTicker(0) })
+}
@@ -6,16 +6,22 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// DefaultIPv4Destination is the destination used to determine the default IPv4 route
+const DefaultIPv4Destination = "1.1.1.1"
+
+// DefaultIPv6Destination is the destination used to determine the default IPv6 route
+const DefaultIPv6Destination = "2606:4700:4700::1111"
+
 // Get the default outbound IP address to reach the given hostname.
 // Use a local hostname if a subnet other than the default one should be used.
 // Use "" for the default route address
 //  destination to reach or "" to use 1.1.1.1 (no connection will be established)
 func GetOutboundIP(destination string) net.IP {
 	if destination == "" {
-		destination = "1.1.1.1"
+		destination = DefaultIPv4Destination
 	}
 	// This dial command doesn't actually create a connection
-	conn, err := net.Dial("udp", destination+":80")
+	conn, err := net.Dial("udp", net.JoinHostPort(destination, "80"))
 	if err != nil {
 		logrus.Errorf("GetIPAddr: %s", err)
 		return nil
@@ -25,3 +31,20 @@ func GetOutboundIP(destination string) net.IP {
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
 	return localAddr.IP
 }
+
+// GetOutboundIPv6 returns the default outbound IPv6 address, or nil if there is no IPv6 route.
+//  destination to reach or "" to use the DefaultIPv6Destination (no connection will be established)
+func GetOutboundIPv6(destination string) net.IP {
+	if destination == "" {
+		destination = DefaultIPv6Destination
+	}
+	conn, err := net.Dial("udp6", net.JoinHostPort(destination, "80"))
+	if err != nil {
+		logrus.Infof("GetOutboundIPv6: no IPv6 route: %s", err)
+		return nil
+	}
+	defer conn.Close()
+
+	localAddr := conn.LocalAddr().(*net.UDPAddr)
+	return localAddr.IP
+}
@@ -0,0 +1,36 @@
+package hubnet
+
+import (
+	"net"
+	"os"
+)
+
+// GetServerNames returns the hostnames and IP addresses the hub can be reached at, for use as the
+// names of the hub server certificate. See certsetup.CreateCertificateBundle.
+//
+// This includes localhost, the IPv4 and IPv6 loopback addresses, the hostname of this machine,
+// the outbound IPv4 and IPv6 addresses and the given extra names. Duplicates are removed.
+//  extraNames with additional hostnames or addresses, like the hub DNS name
+func GetServerNames(extraNames ...string) []string {
+	names := []string{"localhost", "127.0.0.1", net.IPv6loopback.String()}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		names = append(names, hostname)
+	}
+	if ip := GetOutboundIP(""); ip != nil {
+		names = append(names, ip.String())
+	}
+	if ip := GetOutboundIPv6(""); ip != nil {
+		names = append(names, ip.String())
+	}
+	names = append(names, extraNames...)
+
+	result := make([]string, 0, len(names))
+	found := make(map[string]bool)
+	for _, name := range names {
+		if name != "" && !found[name] {
+			found[name] = true
+			result = append(result, name)
+		}
+	}
+	return result
+}
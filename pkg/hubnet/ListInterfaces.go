@@ -0,0 +1,116 @@
+package hubnet
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+// InterfaceInfo describes a network interface and its addresses
+type InterfaceInfo struct {
+	Name       string
+	MacAddress string
+	// IPs are the IPv4 and IPv6 addresses of the interface
+	IPs      []net.IP
+	Up       bool
+	Loopback bool
+}
+
+// IPv4 returns the first IPv4 address of the interface, or nil if it has none
+func (info *InterfaceInfo) IPv4() net.IP {
+	for _, ip := range info.IPs {
+		if ip.To4() != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// IPv6 returns the first global unicast IPv6 address of the interface, or the first
+// link-local address if it has none. Returns nil if the interface has no IPv6 address.
+func (info *InterfaceInfo) IPv6() (ipAddr net.IP) {
+	for _, ip := range info.IPs {
+		if ip.To4() != nil {
+			continue
+		}
+		if ip.IsGlobalUnicast() {
+			return ip
+		} else if ipAddr == nil {
+			ipAddr = ip
+		}
+	}
+	return ipAddr
+}
+
+// ListInterfaces returns the network interfaces of this machine with their addresses
+func ListInterfaces() ([]InterfaceInfo, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		logrus.Errorf("ListInterfaces: %s", err)
+		return nil, err
+	}
+	result := make([]InterfaceInfo, 0, len(interfaces))
+	for _, interf := range interfaces {
+		info := InterfaceInfo{
+			Name:       interf.Name,
+			MacAddress: fmt.Sprint(interf.HardwareAddr),
+			IPs:        make([]net.IP, 0),
+			Up:         interf.Flags&net.FlagUp != 0,
+			Loopback:   interf.Flags&net.FlagLoopback != 0,
+		}
+		addrs, err := interf.Addrs()
+		if err != nil {
+			logrus.Warningf("ListInterfaces: unable to get addresses of interface '%s': %s", interf.Name, err)
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				info.IPs = append(info.IPs, ipNet.IP)
+			}
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+// GetInterfaceByIP returns the interface that has the given IP address
+// Returns an error if no interface has the address
+func GetInterfaceByIP(ipAddr net.IP) (*InterfaceInfo, error) {
+	interfaces, err := ListInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range interfaces {
+		for _, ip := range info.IPs {
+			if ip.Equal(ipAddr) {
+				return &info, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("GetInterfaceByIP: no interface with address %s", ipAddr)
+}
+
+// GetIPByInterfaceName returns the IP address of the network interface with the given name
+//  name of the interface, eg eth0 or wlan0
+//  ipv6 to return the IPv6 address instead of the IPv4 address
+// Returns an error if the interface doesn't exist or has no address of the requested type
+func GetIPByInterfaceName(name string, ipv6 bool) (net.IP, error) {
+	interfaces, err := ListInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range interfaces {
+		if info.Name != name {
+			continue
+		}
+		ipAddr := info.IPv4()
+		if ipv6 {
+			ipAddr = info.IPv6()
+		}
+		if ipAddr == nil {
+			return nil, fmt.Errorf("GetIPByInterfaceName: interface '%s' has no address of the requested type", name)
+		}
+		return ipAddr, nil
+	}
+	return nil, fmt.Errorf("GetIPByInterfaceName: interface '%s' not found", name)
+}
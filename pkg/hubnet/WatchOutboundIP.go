@@ -0,0 +1,56 @@
+package hubnet
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultWatchInterval is the default interval for checking the outbound IP address
+const DefaultWatchInterval = 30 * time.Second
+
+// WatchOutboundIP periodically checks the outbound IP address and invokes the handler when it changes,
+// for example after a DHCP renewal or when moving to another network. Use this to update the server
+// certificate and discovery records of the hub.
+// The handler is not invoked for the initial address. newIP is nil when the network is unavailable.
+//
+//  destination to reach or "" for the default route, see GetOutboundIP
+//  interval between checks, or 0 for DefaultWatchInterval
+//  handler to invoke with the old and new address
+// This returns a function to stop watching.
+func WatchOutboundIP(destination string, interval time.Duration,
+	handler func(oldIP net.IP, newIP net.IP)) (stop func()) {
+
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	currentIP := GetOutboundIP(destination)
+	ticker := time.NewTicker(interval)
+	done := make(chan bool)
+	stopOnce := sync.Once{}
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				newIP := GetOutboundIP(destination)
+				if !newIP.Equal(currentIP) {
+					logrus.Infof("WatchOutboundIP: outbound address changed from %s to %s", currentIP, newIP)
+					oldIP := currentIP
+					currentIP = newIP
+					handler(oldIP, newIP)
+				}
+			}
+		}
+	}()
+	return func() {
+		stopOnce.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package hubnet_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wostzone/hubserve-go/pkg/hubnet"
+)
+
+func TestListInterfaces(t *testing.T) {
+	interfaces, err := hubnet.ListInterfaces()
+	require.NoError(t, err)
+	require.NotEmpty(t, interfaces)
+
+	// the loopback interface always exists
+	var loopback *hubnet.InterfaceInfo
+	for i, info := range interfaces {
+		if info.Loopback {
+			loopback = &interfaces[i]
+		}
+	}
+	require.NotNil(t, loopback)
+	assert.True(t, loopback.IPv4().IsLoopback())
+
+	ip, err := hubnet.GetIPByInterfaceName(loopback.Name, false)
+	assert.NoError(t, err)
+	assert.True(t, ip.Equal(net.IPv4(127, 0, 0, 1)))
+
+	info, err := hubnet.GetInterfaceByIP(net.IPv4(127, 0, 0, 1))
+	assert.NoError(t, err)
+	assert.Equal(t, loopback.Name, info.Name)
+
+	_, err = hubnet.GetIPByInterfaceName("notaninterface", false)
+	assert.Error(t, err)
+	_, err = hubnet.GetInterfaceByIP(net.IPv4(192, 0, 2, 1))
+	assert.Error(t, err)
+}
+
+func TestGetServerNames(t *testing.T) {
+	names := hubnet.GetServerNames("hub.local", "localhost")
+	assert.Contains(t, names, "localhost")
+	assert.Contains(t, names, "127.0.0.1")
+	assert.Contains(t, names, "::1")
+	assert.Contains(t, names, "hub.local")
+	// no duplicates
+	count := 0
+	for _, name := range names {
+		if name == "localhost" {
+			count++
+		}
+	}
+	assert.Equal(t, 1, count)
+}
+
+func TestWatchOutboundIP(t *testing.T) {
+	changed := 0
+	stop := hubnet.WatchOutboundIP("127.0.0.1", 10*time.Millisecond, func(oldIP, newIP net.IP) {
+		changed++
+	})
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	// stopping twice is allowed
+	stop()
+	// the loopback address doesn't change
+	assert.Equal(t, 0, changed)
+}
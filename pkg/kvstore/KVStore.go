@@ -0,0 +1,230 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/hubclient-go/pkg/config"
+	"go.etcd.io/bbolt"
+)
+
+// DefaultStoreFileSuffix is appended to the plugin ID to construct the store filename
+const DefaultStoreFileSuffix = ".kvstore.db"
+
+// timeout to obtain the file lock, in case another process has the store open
+const openTimeout = 3 * time.Second
+
+// KVStore is a simple persistent key-value store for plugin state, like pending provisioning
+// requests or last-seen values. Keys are grouped in buckets. The store is backed by a bbolt
+// database file and is safe for concurrent use.
+type KVStore struct {
+	db       *bbolt.DB
+	filePath string
+}
+
+// Close the store
+func (store *KVStore) Close() error {
+	logrus.Infof("KVStore.Close: closing %s", store.filePath)
+	return store.db.Close()
+}
+
+// Buckets returns the names of the buckets in the store, ordered by name
+func (store *KVStore) Buckets() (names []string, err error) {
+	names = make([]string, 0)
+	err = store.db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+			names = append(names, string(name))
+			return nil
+		})
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// Delete a key from a bucket. Deleting a key that doesn't exist is not an error.
+func (store *KVStore) Delete(bucket string, key string) error {
+	return store.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// DeleteBucket removes a bucket and all its keys
+// Returns an error if the bucket doesn't exist
+func (store *KVStore) DeleteBucket(bucket string) error {
+	return store.db.Update(func(tx *bbolt.Tx) error {
+		err := tx.DeleteBucket([]byte(bucket))
+		if err != nil {
+			return fmt.Errorf("KVStore.DeleteBucket: bucket '%s': %s", bucket, err)
+		}
+		return nil
+	})
+}
+
+// Export writes the content of all buckets as JSON to the writer.
+// The JSON document maps bucket names to a map of key to base64 encoded values.
+func (store *KVStore) Export(w io.Writer) error {
+	content := make(map[string]map[string][]byte)
+	err := store.db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			bucketContent := make(map[string][]byte)
+			content[string(name)] = bucketContent
+			return b.ForEach(func(k, v []byte) error {
+				bucketContent[string(k)] = append([]byte(nil), v...)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(content)
+}
+
+// Get the value of a key in a bucket
+// Returns an error if the bucket or key doesn't exist
+func (store *KVStore) Get(bucket string, key string) (value []byte, err error) {
+	err = store.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("KVStore.Get: bucket '%s' not found", bucket)
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return fmt.Errorf("KVStore.Get: key '%s' not found in bucket '%s'", key, bucket)
+		}
+		// the value is only valid during the transaction
+		value = append([]byte(nil), v...)
+		return nil
+	})
+	return value, err
+}
+
+// GetJSON reads the value of a key in a bucket and unmarshals it from JSON
+func (store *KVStore) GetJSON(bucket string, key string, v interface{}) error {
+	value, err := store.Get(bucket, key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(value, v)
+}
+
+// Import reads buckets from a JSON document created with Export and adds them to the store.
+// Existing keys are overwritten. This happens in a single transaction.
+func (store *KVStore) Import(r io.Reader) error {
+	content := make(map[string]map[string][]byte)
+	err := json.NewDecoder(r).Decode(&content)
+	if err != nil {
+		logrus.Errorf("KVStore.Import: invalid import document: %s", err)
+		return err
+	}
+	return store.db.Update(func(tx *bbolt.Tx) error {
+		for bucket, bucketContent := range content {
+			b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+			if err != nil {
+				return err
+			}
+			for key, value := range bucketContent {
+				err = b.Put([]byte(key), value)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Iterate invokes the handler for each key in a bucket, in key order.
+// The value is only valid during the handler call and must be copied if it is retained.
+// Iteration stops when the handler returns false. A bucket that doesn't exist has no keys.
+func (store *KVStore) Iterate(bucket string, handler func(key string, value []byte) bool) error {
+	return store.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		cursor := b.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			if !handler(string(k), v) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// Path returns the location of the store file
+func (store *KVStore) Path() string {
+	return store.filePath
+}
+
+// Put writes the value of a key in a bucket. The bucket is created if it doesn't exist.
+func (store *KVStore) Put(bucket string, key string, value []byte) error {
+	if bucket == "" || key == "" {
+		return fmt.Errorf("KVStore.Put: missing bucket or key")
+	}
+	return store.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+// PutJSON marshals the value to JSON and writes it to a key in a bucket
+func (store *KVStore) PutJSON(bucket string, key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return store.Put(bucket, key, value)
+}
+
+// OpenStore opens or creates a store at the given file path.
+// Only a single process can have the store open at a time.
+// Returns the store or an error if it cannot be opened. Close the store when done.
+func OpenStore(filePath string) (*KVStore, error) {
+	db, err := bbolt.Open(filePath, 0600, &bbolt.Options{Timeout: openTimeout})
+	if err != nil {
+		logrus.Errorf("OpenStore: unable to open store %s: %s", filePath, err)
+		return nil, err
+	}
+	logrus.Infof("OpenStore: opened %s", filePath)
+	store := &KVStore{db: db, filePath: filePath}
+	return store, nil
+}
+
+// OpenPluginStore opens or creates the store of a plugin in the hub configuration folder.
+// The store filename is the pluginID with the DefaultStoreFileSuffix. Use OpenStore for a store in
+// another location.
+//  hubConfig with the ConfigFolder to keep the store in. The folder is created if it doesn't exist.
+//  pluginID of the plugin that owns the store. It must be usable as a filename.
+func OpenPluginStore(hubConfig *config.HubConfig, pluginID string) (*KVStore, error) {
+	if hubConfig == nil || hubConfig.ConfigFolder == "" {
+		return nil, fmt.Errorf("OpenPluginStore: missing hub config folder")
+	}
+	if pluginID == "" || strings.ContainsAny(pluginID, "/\\") || strings.HasPrefix(pluginID, ".") {
+		return nil, fmt.Errorf("OpenPluginStore: pluginID '%s' is not usable as a filename", pluginID)
+	}
+	storeFolder := hubConfig.ConfigFolder
+	err := os.MkdirAll(storeFolder, 0700)
+	if err != nil {
+		logrus.Errorf("OpenPluginStore: unable to create folder %s: %s", storeFolder, err)
+		return nil, err
+	}
+	return OpenStore(path.Join(storeFolder, pluginID+DefaultStoreFileSuffix))
+}
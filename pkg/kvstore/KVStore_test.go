@@ -0,0 +1,149 @@
+package kvstore_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wostzone/hubclient-go/pkg/config"
+	"github.com/wostzone/hubserve-go/pkg/kvstore"
+)
+
+const pluginID = "plugin1"
+const bucket1 = "bucket1"
+
+func TestOpenPutGet(t *testing.T) {
+	storeFolder, _ := ioutil.TempDir("", "kvstore")
+	defer os.RemoveAll(storeFolder)
+
+	store, err := kvstore.OpenPluginStore(&config.HubConfig{ConfigFolder: storeFolder}, pluginID)
+	require.NoError(t, err)
+	assert.Equal(t, path.Join(storeFolder, pluginID+kvstore.DefaultStoreFileSuffix), store.Path())
+
+	err = store.Put(bucket1, "key1", []byte("value1"))
+	assert.NoError(t, err)
+	err = store.PutJSON(bucket1, "key2", map[string]int{"count": 2})
+	assert.NoError(t, err)
+	err = store.Put("", "key1", []byte("value1"))
+	assert.Error(t, err)
+
+	// values must survive a reopen
+	err = store.Close()
+	require.NoError(t, err)
+	store, err = kvstore.OpenPluginStore(&config.HubConfig{ConfigFolder: storeFolder}, pluginID)
+	require.NoError(t, err)
+	defer store.Close()
+
+	value, err := store.Get(bucket1, "key1")
+	assert.NoError(t, err)
+	assert.Equal(t, "value1", string(value))
+	count := map[string]int{}
+	err = store.GetJSON(bucket1, "key2", &count)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count["count"])
+
+	_, err = store.Get(bucket1, "notakey")
+	assert.Error(t, err)
+	_, err = store.Get("notabucket", "key1")
+	assert.Error(t, err)
+
+	err = store.Delete(bucket1, "key1")
+	assert.NoError(t, err)
+	_, err = store.Get(bucket1, "key1")
+	assert.Error(t, err)
+
+	buckets, err := store.Buckets()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{bucket1}, buckets)
+	err = store.DeleteBucket(bucket1)
+	assert.NoError(t, err)
+	err = store.DeleteBucket(bucket1)
+	assert.Error(t, err)
+
+	// the pluginID must not escape the config folder
+	for _, badID := range []string{"", "../plugin1", "sub/plugin1", "sub\\plugin1", ".plugin1"} {
+		_, err = kvstore.OpenPluginStore(&config.HubConfig{ConfigFolder: storeFolder}, badID)
+		assert.Error(t, err, badID)
+	}
+	_, err = kvstore.OpenPluginStore(&config.HubConfig{}, pluginID)
+	assert.Error(t, err)
+	_, err = kvstore.OpenPluginStore(nil, pluginID)
+	assert.Error(t, err)
+}
+
+func TestIterateConcurrent(t *testing.T) {
+	storeFolder, _ := ioutil.TempDir("", "kvstore")
+	defer os.RemoveAll(storeFolder)
+	store, err := kvstore.OpenPluginStore(&config.HubConfig{ConfigFolder: storeFolder}, pluginID)
+	require.NoError(t, err)
+	defer store.Close()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := store.Put(bucket1, string(rune('a'+i)), []byte{byte(i)})
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	keys := make([]string, 0)
+	err = store.Iterate(bucket1, func(key string, value []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(keys))
+	assert.Equal(t, "a", keys[0])
+
+	// stop early
+	count := 0
+	err = store.Iterate(bucket1, func(key string, value []byte) bool {
+		count++
+		return count < 3
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	// a missing bucket has no keys
+	err = store.Iterate("notabucket", func(key string, value []byte) bool {
+		assert.Fail(t, "unexpected key")
+		return true
+	})
+	assert.NoError(t, err)
+}
+
+func TestExportImport(t *testing.T) {
+	storeFolder, _ := ioutil.TempDir("", "kvstore")
+	defer os.RemoveAll(storeFolder)
+	store1, err := kvstore.OpenStore(path.Join(storeFolder, "store1.db"))
+	require.NoError(t, err)
+	defer store1.Close()
+	store2, err := kvstore.OpenStore(path.Join(storeFolder, "store2.db"))
+	require.NoError(t, err)
+	defer store2.Close()
+
+	_ = store1.Put(bucket1, "key1", []byte("value1"))
+	_ = store1.Put("bucket2", "key2", []byte{0, 1, 2})
+	buf := bytes.Buffer{}
+	err = store1.Export(&buf)
+	require.NoError(t, err)
+
+	err = store2.Import(&buf)
+	require.NoError(t, err)
+	value, err := store2.Get("bucket2", "key2")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 1, 2}, value)
+	buckets, _ := store2.Buckets()
+	assert.Equal(t, []string{bucket1, "bucket2"}, buckets)
+
+	err = store2.Import(bytes.NewBufferString("not json"))
+	assert.Error(t, err)
+}
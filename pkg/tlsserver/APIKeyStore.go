@@ -0,0 +1,252 @@
+package tlsserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// APIKeyHeader is the request header that holds the API key
+const APIKeyHeader = "X-Api-Key"
+
+// AuthTypeAPIKey identifies API key authentication
+const AuthTypeAPIKey = "apikey"
+
+// APIKey describes an API key. The key itself is not stored, only its hash.
+type APIKey struct {
+	// KeyID is the public part of the key, used to identify it
+	KeyID string `json:"keyID"`
+	// UserID the key authenticates as, eg the name of the script or plugin
+	UserID string `json:"userID"`
+	// OU is the role of the key holder, see certsetup.OUxxx. Handlers obtain it with VerifyRequest.
+	OU string `json:"ou"`
+	// Hash of the key secret
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+// APIKeyStore holds API keys for machine-to-machine authentication, for example by scripts that
+// cannot hold certificates. Only hashes of the keys are stored.
+//
+// Keys have the format {keyID}.{secret}. Clients pass them in the X-Api-Key header or as bearer token.
+// The store implements IIdentityProvider so it can be added to the TLSServer with AddIdentityProvider.
+type APIKeyStore struct {
+	mux      sync.RWMutex
+	keys     map[string]APIKey
+	filePath string
+}
+
+// CreateKey creates a new API key for a user
+//  userID the key authenticates as
+//  ou is the role of the key holder
+// Returns the key to hand to the client and its description. The key cannot be retrieved later.
+func (store *APIKeyStore) CreateKey(userID string, ou string) (key string, info APIKey, err error) {
+	if userID == "" {
+		return "", info, fmt.Errorf("APIKeyStore.CreateKey: missing userID")
+	}
+	keyID := randomString(8)
+	secret := randomString(32)
+	info = APIKey{
+		KeyID:   keyID,
+		UserID:  userID,
+		OU:      ou,
+		Hash:    hashAPIKeySecret(secret),
+		Created: time.Now(),
+	}
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	store.keys[keyID] = info
+	logrus.Infof("APIKeyStore.CreateKey: created key '%s' for user '%s'", keyID, userID)
+	err = store.save()
+	return keyID + "." + secret, info, err
+}
+
+// ListKeys returns the keys of a user, ordered by creation time
+//  userID whose keys to list, or "" for all keys
+func (store *APIKeyStore) ListKeys(userID string) []APIKey {
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+	result := make([]APIKey, 0)
+	for _, info := range store.keys {
+		if userID == "" || info.UserID == userID {
+			result = append(result, info)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Created.Before(result[j].Created) })
+	return result
+}
+
+// RemoveKey revokes an API key
+// Returns an error if the key doesn't exist
+func (store *APIKeyStore) RemoveKey(keyID string) error {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	_, found := store.keys[keyID]
+	delete(store.keys, keyID)
+	if !found {
+		return fmt.Errorf("APIKeyStore.RemoveKey: key '%s' not found", keyID)
+	}
+	logrus.Infof("APIKeyStore.RemoveKey: removed key '%s'", keyID)
+	return store.save()
+}
+
+// RotateKey replaces the secret of an existing key. The old key is no longer valid.
+// The keyID, user and OU remain the same.
+// Returns the new key or an error if the key doesn't exist
+func (store *APIKeyStore) RotateKey(keyID string) (newKey string, err error) {
+	secret := randomString(32)
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	info, found := store.keys[keyID]
+	if found {
+		info.Hash = hashAPIKeySecret(secret)
+		info.Created = time.Now()
+		store.keys[keyID] = info
+	}
+	if !found {
+		return "", fmt.Errorf("APIKeyStore.RotateKey: key '%s' not found", keyID)
+	}
+	logrus.Infof("APIKeyStore.RotateKey: rotated key '%s' of user '%s'", keyID, info.UserID)
+	return keyID + "." + secret, store.save()
+}
+
+// VerifyKey verifies an API key and returns its description
+// Returns false if the key is unknown or invalid
+func (store *APIKeyStore) VerifyKey(key string) (info APIKey, valid bool) {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 {
+		return info, false
+	}
+	store.mux.RLock()
+	info, found := store.keys[parts[0]]
+	store.mux.RUnlock()
+	if !found {
+		return info, false
+	}
+	hash := hashAPIKeySecret(parts[1])
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(info.Hash)) != 1 {
+		return info, false
+	}
+	return info, true
+}
+
+// VerifyRequest verifies the API key of a request, passed as bearer token or in the X-Api-Key
+// header, and returns its description.
+// Handlers can use this to authorize the request using the OU of the key holder.
+// Returns false if the request has no valid API key
+func (store *APIKeyStore) VerifyRequest(req *http.Request) (info APIKey, valid bool) {
+	key := ""
+	parts := strings.Split(req.Header.Get("Authorization"), " ")
+	if len(parts) == 2 && strings.ToLower(parts[0]) == "bearer" {
+		key = parts[1]
+	}
+	if info, valid = store.VerifyKey(key); valid {
+		return info, valid
+	}
+	return store.VerifyKey(req.Header.Get(APIKeyHeader))
+}
+
+// VerifyPassword is not supported
+func (store *APIKeyStore) VerifyPassword(string, string) (string, bool) {
+	return "", false
+}
+
+// VerifyClientCert is not supported
+func (store *APIKeyStore) VerifyClientCert(*x509.Certificate) (string, bool) {
+	return "", false
+}
+
+// VerifyToken verifies the API key and returns the userID it authenticates as
+func (store *APIKeyStore) VerifyToken(token string) (string, bool) {
+	info, valid := store.VerifyKey(token)
+	return info.UserID, valid
+}
+
+// save the keys to file if a file is used
+// The caller must hold the lock so concurrent changes are saved in order. The keys are written to
+// a unique temporary file that replaces the key file, so a failed save leaves the file intact.
+func (store *APIKeyStore) save() error {
+	if store.filePath == "" {
+		return nil
+	}
+	data, _ := json.MarshalIndent(store.keys, "", "  ")
+	// temp files are created with 0600 permissions
+	tmpFile, err := ioutil.TempFile(filepath.Dir(store.filePath), "."+filepath.Base(store.filePath)+".tmp")
+	if err == nil {
+		tmpPath := tmpFile.Name()
+		_, err = tmpFile.Write(data)
+		if err == nil {
+			err = tmpFile.Sync()
+		}
+		if closeErr := tmpFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmpPath, store.filePath)
+		}
+		if err != nil {
+			_ = os.Remove(tmpPath)
+		}
+	}
+	if err != nil {
+		logrus.Errorf("APIKeyStore.save: failed writing keys to %s: %s", store.filePath, err)
+	}
+	return err
+}
+
+// hashAPIKeySecret returns the hex encoded SHA256 hash of the secret.
+// API key secrets are long random strings so a slow password hash is not needed.
+func hashAPIKeySecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// randomString returns a URL safe random string from the given number of random bytes
+func randomString(nrBytes int) string {
+	data := make([]byte, nrBytes)
+	_, _ = rand.Read(data)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// NewAPIKeyStore creates a store for API keys
+//  filePath of the JSON file to persist the keys, or "" to keep the keys in memory only
+// Returns the store, or an error if the file exists but cannot be read
+func NewAPIKeyStore(filePath string) (*APIKeyStore, error) {
+	store := &APIKeyStore{
+		keys:     make(map[string]APIKey),
+		filePath: filePath,
+	}
+	if filePath == "" {
+		return store, nil
+	}
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err == nil {
+		err = json.Unmarshal(data, &store.keys)
+	}
+	// a file with 'null' leaves no map
+	if store.keys == nil {
+		store.keys = make(map[string]APIKey)
+	}
+	if err != nil {
+		logrus.Errorf("NewAPIKeyStore: unable to load keys from %s: %s", filePath, err)
+		return nil, err
+	}
+	return store, nil
+}
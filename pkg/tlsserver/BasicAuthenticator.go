@@ -8,6 +8,8 @@ import (
 type BasicAuthenticator struct {
 	// the password verification handler
 	verifyUsernamePassword func(username, password string) bool
+	// optional verification that maps the loginID to a userID, used instead of verifyUsernamePassword
+	verifyLogin func(loginID, password string) (userID string, match bool)
 }
 
 // AuthenticateRequest
@@ -18,6 +20,15 @@ func (bauth *BasicAuthenticator) AuthenticateRequest(resp http.ResponseWriter, r
 	if !ok {
 		return username, false
 	}
+	if bauth.verifyLogin != nil {
+		userID, match = bauth.verifyLogin(username, password)
+		if !match {
+			return username, false
+		}
+		return userID, true
+	} else if bauth.verifyUsernamePassword == nil {
+		return username, false
+	}
 	ok = bauth.verifyUsernamePassword(username, password)
 	if !ok {
 		return username, false
@@ -0,0 +1,139 @@
+package tlsserver
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultCORSMethods are the methods allowed for cross origin requests when none are configured
+var DefaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// DefaultCORSHeaders are the request headers allowed for cross origin requests when none are configured
+var DefaultCORSHeaders = []string{"Accept", "Authorization", "Content-Type"}
+
+// CORSOptions with the Cross-Origin Resource Sharing configuration
+type CORSOptions struct {
+	// AllowedOrigins is the list of origins that are allowed to make requests, eg "https://myhub.local:8443".
+	// Use "*" to allow any origin. Origins that only match "*" are not allowed to include credentials.
+	AllowedOrigins []string
+	// AllowedMethods of cross origin requests. Default is DefaultCORSMethods
+	AllowedMethods []string
+	// AllowedHeaders the client can use in requests. Default is DefaultCORSHeaders
+	AllowedHeaders []string
+	// ExposedHeaders the client is allowed to read from the response
+	ExposedHeaders []string
+	// AllowCredentials lets the browser include cookies and client certificates. This only applies
+	// to the origins that are listed explicitly in AllowedOrigins.
+	AllowCredentials bool
+	// MaxAge the result of a preflight request can be cached. 0 to use the browser default.
+	MaxAge time.Duration
+}
+
+// Handler returns a http handler that adds the CORS headers to the response of the given handler.
+// Preflight OPTIONS requests are answered directly, without authentication, as browsers do not
+// include credentials in these requests.
+func (opts *CORSOptions) Handler(next http.Handler) http.Handler {
+	allowedMethods := opts.AllowedMethods
+	if len(allowedMethods) == 0 {
+		allowedMethods = DefaultCORSMethods
+	}
+	allowedHeaders := opts.AllowedHeaders
+	if len(allowedHeaders) == 0 {
+		allowedHeaders = DefaultCORSHeaders
+	}
+	if opts.isWildcard() && opts.AllowCredentials {
+		logrus.Warningf("CORS: credentials are only allowed for listed origins, not for origin '*'")
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		isPreflight := req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" {
+			// not a cross origin request
+			next.ServeHTTP(resp, req)
+			return
+		}
+		resp.Header().Add("Vary", "Origin")
+		if !opts.isOriginAllowed(origin) {
+			logrus.Infof("CORS: origin '%s' is not allowed for %s %s", origin, req.Method, req.URL.Path)
+			if isPreflight {
+				resp.WriteHeader(http.StatusForbidden)
+				return
+			}
+			// without CORS headers the browser will block the response
+			next.ServeHTTP(resp, req)
+			return
+		}
+		// any website matches the wildcard, so it must not make requests with the user's credentials
+		isListed := opts.isOriginListed(origin)
+		if isListed && opts.AllowCredentials {
+			resp.Header().Set("Access-Control-Allow-Origin", origin)
+			resp.Header().Set("Access-Control-Allow-Credentials", "true")
+		} else if opts.isWildcard() {
+			resp.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			resp.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if isPreflight {
+			resp.Header().Set("Access-Control-Allow-Methods", strings.Join(allowedMethods, ", "))
+			resp.Header().Set("Access-Control-Allow-Headers", strings.Join(allowedHeaders, ", "))
+			if opts.MaxAge > 0 {
+				resp.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(opts.MaxAge.Seconds())))
+			}
+			resp.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if len(opts.ExposedHeaders) > 0 {
+			resp.Header().Set("Access-Control-Expose-Headers", strings.Join(opts.ExposedHeaders, ", "))
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
+
+// isOriginAllowed returns true if the origin is in the list of allowed origins or any origin is allowed
+func (opts *CORSOptions) isOriginAllowed(origin string) bool {
+	return opts.isWildcard() || opts.isOriginListed(origin)
+}
+
+// isOriginListed returns true if the origin is explicitly listed in the allowed origins
+func (opts *CORSOptions) isOriginListed(origin string) bool {
+	for _, allowed := range opts.AllowedOrigins {
+		if strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWildcard returns true if any origin is allowed
+func (opts *CORSOptions) isWildcard() bool {
+	for _, allowed := range opts.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// AddCORSHandler adds a new handler for a path that accepts cross origin requests.
+// This is the same as AddHandler with CORS support for this route only.
+// Do not use this in combination with EnableCORS as that already applies to all routes.
+//
+//  path to listen on. This supports wildcards
+//  options with the CORS configuration of this route
+//  handler to invoke with the request. The userID is only provided when an authenticator is used
+func (srv *TLSServer) AddCORSHandler(path string, options *CORSOptions,
+	handler func(userID string, resp http.ResponseWriter, req *http.Request)) {
+
+	srv.router.Handle(path, options.Handler(srv.authenticatedHandler(path, handler)))
+}
+
+// EnableCORS enables cross origin requests for all routes of the server
+//  options with the CORS configuration
+func (srv *TLSServer) EnableCORS(options *CORSOptions) {
+	logrus.Infof("TLSServer.EnableCORS: allowed origins: %s", options.AllowedOrigins)
+	srv.router.Use(options.Handler)
+}
@@ -0,0 +1,86 @@
+package tlsserver_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wostzone/hubserve-go/pkg/tlsserver"
+)
+
+func TestCORS(t *testing.T) {
+	handlerHit := 0
+	origin := "https://myapp.local"
+	opts := &tlsserver.CORSOptions{
+		AllowedOrigins:   []string{origin},
+		AllowCredentials: true,
+		MaxAge:           time.Minute,
+	}
+	handler := opts.Handler(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		handlerHit++
+	}))
+
+	// preflight request is answered without invoking the handler
+	req := httptest.NewRequest("OPTIONS", "/things", nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, origin, resp.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", resp.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Contains(t, resp.Header().Get("Access-Control-Allow-Methods"), "PUT")
+	assert.Equal(t, "60", resp.Header().Get("Access-Control-Max-Age"))
+	assert.Equal(t, 0, handlerHit)
+
+	// actual request
+	req = httptest.NewRequest("GET", "/things", nil)
+	req.Header.Set("Origin", origin)
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, origin, resp.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, 1, handlerHit)
+
+	// origin not allowed
+	req = httptest.NewRequest("OPTIONS", "/things", nil)
+	req.Header.Set("Origin", "https://evil.local")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Empty(t, resp.Header().Get("Access-Control-Allow-Origin"))
+
+	// same origin request
+	req = httptest.NewRequest("GET", "/things", nil)
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Empty(t, resp.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, 2, handlerHit)
+
+	// wildcard without credentials
+	opts = &tlsserver.CORSOptions{AllowedOrigins: []string{"*"}}
+	handler = opts.Handler(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+	req = httptest.NewRequest("GET", "/things", nil)
+	req.Header.Set("Origin", origin)
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, "*", resp.Header().Get("Access-Control-Allow-Origin"))
+
+	// wildcard with credentials only allows credentials for the listed origins
+	opts = &tlsserver.CORSOptions{AllowedOrigins: []string{"*", origin}, AllowCredentials: true}
+	handler = opts.Handler(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+	req = httptest.NewRequest("GET", "/things", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, "*", resp.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, resp.Header().Get("Access-Control-Allow-Credentials"))
+	req = httptest.NewRequest("GET", "/things", nil)
+	req.Header.Set("Origin", origin)
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, origin, resp.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", resp.Header().Get("Access-Control-Allow-Credentials"))
+}
@@ -1,12 +1,18 @@
 package tlsserver
 
 import (
+	"crypto/x509"
 	"net/http"
 )
 
 // CertAuthenticator verifies the client certificate authentication is used
-// This simply checks if a client certificate is active and assumes that having one is sufficient to pass auth
+// This simply checks if a client certificate is active and assumes that having one is sufficient to pass auth,
+// unless a certificate verification handler is set.
 type CertAuthenticator struct {
+	// optional handler to verify the certificate holder
+	verifyClientCert func(cert *x509.Certificate) (userID string, ok bool)
+	// optional registry to count authenticated requests
+	metrics *MetricsRegistry
 }
 
 // AuthenticateRequest
@@ -14,19 +20,43 @@ type CertAuthenticator struct {
 // If the certificate is a plugin, then no userID is returned
 // Returns the userID of the certificate (CN) or an error if no client certificate is used
 func (hauth *CertAuthenticator) AuthenticateRequest(resp http.ResponseWriter, req *http.Request) (userID string, ok bool) {
-	if len(req.TLS.PeerCertificates) == 0 {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
 		return "", false
 	}
 	cert := req.TLS.PeerCertificates[0]
+	if hauth.verifyClientCert != nil {
+		userID, ok = hauth.verifyClientCert(cert)
+		if ok {
+			hauth.countCert(cert)
+		}
+		return userID, ok
+	}
 	userID = cert.Subject.CommonName
 	// a plugin is not a username
 	if cert.Subject.CommonName == "plugin" {
 		userID = ""
 	}
-
+	hauth.countCert(cert)
 	return userID, true
 }
 
+// SetMetrics sets the registry to count the requests authenticated with a client certificate
+//  metrics is the registry in which the metric is registered, or nil to stop counting
+func (hauth *CertAuthenticator) SetMetrics(metrics *MetricsRegistry) {
+	metrics.AddCounter(MetricClientCertAuth,
+		"Requests authenticated with a client certificate by organizational unit", "ou")
+	hauth.metrics = metrics
+}
+
+// countCert counts an authenticated request by the OU of the certificate
+func (hauth *CertAuthenticator) countCert(cert *x509.Certificate) {
+	ou := ""
+	if len(cert.Subject.OrganizationalUnit) > 0 {
+		ou = cert.Subject.OrganizationalUnit[0]
+	}
+	hauth.metrics.IncCounter(MetricClientCertAuth, ou)
+}
+
 // Create a new HTTP authenticator
 // Use .AuthenticateRequest() to authenticate the incoming request
 func NewCertAuthenticator() *CertAuthenticator {
@@ -0,0 +1,176 @@
+package tlsserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// delay after the last change of the certificate files before reloading them
+const certReloadDebounceDelay = 50 // msec
+
+// CertReloader serves an externally provided server certificate, such as the fullchain.pem and
+// privkey.pem files of a Let's Encrypt certificate managed by certbot, and reloads it when the
+// files are renewed.
+type CertReloader struct {
+	certPath string
+	keyPath  string
+	cert     *tls.Certificate
+	mutex    sync.RWMutex
+	watcher  *fsnotify.Watcher
+}
+
+// GetCertificate returns the current certificate, for use in tls.Config
+func (reloader *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+	return reloader.cert, nil
+}
+
+// Reload loads the certificate and key files.
+// The current certificate remains in use if the files are invalid, for example when the key
+// doesn't match the certificate while the files are being replaced.
+func (reloader *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(reloader.certPath, reloader.keyPath)
+	if err != nil {
+		err = fmt.Errorf("CertReloader.Reload: unable to load certificate %s: %s", reloader.certPath, err)
+		logrus.Error(err)
+		return err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	logrus.Infof("CertReloader.Reload: loaded certificate of '%s' valid until %s",
+		cert.Leaf.Subject.CommonName, cert.Leaf.NotAfter.Format(time.RFC3339))
+	reloader.mutex.Lock()
+	reloader.cert = &cert
+	reloader.mutex.Unlock()
+	return nil
+}
+
+// Start watching the certificate and key files for changes
+// The folders of the files are watched instead of the files themselves. Certbot renews a certificate
+// by writing new files in its archive folder and replacing the symlinks in the live folder. A watch
+// on the file would follow the symlink to the old archive file and never see the renewal.
+func (reloader *CertReloader) Start() error {
+	fileWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// the callback timer debounces the changes to both files
+	callbackTimer := time.AfterFunc(time.Hour, func() {
+		_ = reloader.Reload()
+	})
+	callbackTimer.Stop()
+
+	watchedFiles := map[string]bool{
+		filepath.Clean(reloader.certPath): true,
+		filepath.Clean(reloader.keyPath):  true,
+	}
+	for filePath := range watchedFiles {
+		folder := filepath.Dir(filePath)
+		err = fileWatcher.Add(folder)
+		if err != nil {
+			logrus.Errorf("CertReloader.Start: unable to watch folder %s: %s", folder, err)
+			_ = fileWatcher.Close()
+			return err
+		}
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-fileWatcher.Events:
+				if !ok {
+					callbackTimer.Stop()
+					return
+				}
+				if watchedFiles[filepath.Clean(event.Name)] {
+					logrus.Infof("CertReloader: event '%s' on %s", event.Op, event.Name)
+					callbackTimer.Reset(time.Millisecond * certReloadDebounceDelay)
+				}
+			case err, ok := <-fileWatcher.Errors:
+				if !ok {
+					return
+				}
+				logrus.Errorf("CertReloader: watch error: %s", err)
+			}
+		}
+	}()
+	reloader.watcher = fileWatcher
+	return nil
+}
+
+// Stop watching the certificate and key files
+func (reloader *CertReloader) Stop() {
+	if reloader.watcher != nil {
+		_ = reloader.watcher.Close()
+		reloader.watcher = nil
+	}
+}
+
+// NewCertReloader loads an externally provided certificate and key. Use Start to reload them on change.
+//  certPath of the PEM file with the server certificate followed by its intermediate certificates
+//  keyPath of the PEM file with the private key
+// Returns an error if the certificate cannot be loaded
+func NewCertReloader(certPath string, keyPath string) (*CertReloader, error) {
+	reloader := &CertReloader{certPath: certPath, keyPath: keyPath}
+	err := reloader.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// EnableAutocert obtains and renews the server certificate from Let's Encrypt using the TLS-ALPN
+// challenge. This requires that the server is reachable on port 443 of the public domain names.
+// Client certificates are still verified with the Hub CA. This must be called before Start.
+//  domains are the public DNS names of the server
+//  cacheDir is the folder where certificates and the account key are stored between restarts
+//  email is the optional contact address for the certificate authority
+func (srv *TLSServer) EnableAutocert(domains []string, cacheDir string, email string) {
+	srv.autocertManager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+}
+
+// UseExternalCert serves an externally provided certificate instead of the certificate signed by
+// the Hub CA, and reloads it when the files change. Use this when the hub is exposed on a public
+// DNS name with a certificate from a public certificate authority.
+// Client certificates are still verified with the Hub CA. This must be called before Start.
+//  certPath of the certificate file, eg /etc/letsencrypt/live/{domain}/fullchain.pem
+//  keyPath of the private key file, eg /etc/letsencrypt/live/{domain}/privkey.pem
+// Returns an error if the certificate cannot be loaded
+func (srv *TLSServer) UseExternalCert(certPath string, keyPath string) error {
+	reloader, err := NewCertReloader(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+	srv.certReloader = reloader
+	return nil
+}
+
+// useExternalCertConfig updates the TLS configuration to serve the external certificate, if configured
+// Returns true if an external certificate is used
+func (srv *TLSServer) useExternalCertConfig(serverTLSConf *tls.Config) bool {
+	if srv.certReloader != nil {
+		serverTLSConf.GetCertificate = srv.certReloader.GetCertificate
+		return true
+	} else if srv.autocertManager != nil {
+		serverTLSConf.GetCertificate = srv.autocertManager.GetCertificate
+		serverTLSConf.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+//go:build go1.18
+// +build go1.18
+
+package tlsserver_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wostzone/hubserve-go/pkg/tlsserver"
+)
+
+// Fuzz targets for parsing of untrusted input. Run with for example:
+//  > go test -fuzz=FuzzDecodeToken -fuzztime=30s ./pkg/tlsserver
+
+func FuzzDecodeToken(f *testing.F) {
+	jauth := tlsserver.NewJWTAuthenticator([]byte("fuzzsecret"), nil)
+	accessToken, refreshToken, _ := jauth.CreateJWTTokens("user1", time.Now().Add(time.Minute))
+	f.Add(accessToken)
+	f.Add(refreshToken)
+	f.Add("")
+	f.Add("a.b.c")
+	f.Add("eyJhbGciOiJub25lIn0.eyJ1c2VybmFtZSI6MX0.")
+	f.Fuzz(func(t *testing.T, tokenString string) {
+		_, claims, err := jauth.DecodeToken(tokenString)
+		if err == nil && claims == nil {
+			t.Errorf("valid token without claims")
+		}
+		_, _ = jauth.VerifyResetToken(tokenString)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "bearer "+tokenString)
+		_, _ = jauth.AuthenticateRequest(nil, req)
+	})
+}
+
+func FuzzParseTraceParent(f *testing.F) {
+	f.Add("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	f.Add("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	f.Add("--")
+	f.Fuzz(func(t *testing.T, traceParent string) {
+		tc, err := tlsserver.ParseTraceParent(traceParent)
+		if err == nil && (len(tc.TraceID) != 32 || len(tc.ParentID) != 16) {
+			t.Errorf("invalid trace context from '%s'", traceParent)
+		}
+		tc = tlsserver.NewTraceContext(traceParent)
+		if len(tc.TraceID) != 32 || len(tc.SpanID) != 16 {
+			t.Errorf("invalid new trace context from '%s'", traceParent)
+		}
+	})
+}
+
+func FuzzQueryParams(f *testing.F) {
+	srv := tlsserver.NewTLSServer("localhost", 0, nil, nil, nil)
+	f.Add("offset=10&limit=5&sort=-name&filter.type=sensor")
+	f.Add("offset=-1&limit=99999999999999999999&sort=-")
+	f.Add("%zz")
+	f.Fuzz(func(t *testing.T, query string) {
+		req := &http.Request{Method: "GET", URL: &url.URL{Path: "/", RawQuery: query}, Header: http.Header{}}
+		offset, limit, err := srv.GetPagination(req)
+		if err == nil && (offset < 0 || limit <= 0 || limit > tlsserver.MaxPageLimit) {
+			t.Errorf("invalid pagination offset=%d, limit=%d from '%s'", offset, limit, query)
+		}
+		_, _, _ = srv.GetSort(req, []string{"name", "created"}, "name")
+		_, _ = srv.GetFilter(req, []string{"type"})
+		req.Header.Set("If-None-Match", strings.ReplaceAll(query, "&", ","))
+		_ = tlsserver.MatchETag(req, `"abc"`)
+	})
+}
@@ -0,0 +1,138 @@
+package tlsserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Default paths of the health endpoints
+const (
+	DefaultHealthPath    = "/health"
+	DefaultReadyPath     = "/ready"
+	DefaultBuildInfoPath = "/buildinfo"
+)
+
+// BuildVersion and BuildCommit describe the plugin build. Set these at build time with:
+//  > go build -ldflags "-X github.com/wostzone/hubserve-go/pkg/tlsserver.BuildVersion=v1.0.0"
+var BuildVersion = ""
+var BuildCommit = ""
+
+// BuildInfo is the response of the build info endpoint
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	GoVersion string `json:"goVersion"`
+	Module    string `json:"module,omitempty"`
+}
+
+// ReadyStatus is the response of the readiness endpoint
+type ReadyStatus struct {
+	Ready bool `json:"ready"`
+	// Checks holds the result of each probe, "ok" or the error message
+	Checks map[string]string `json:"checks"`
+}
+
+// healthProbes holds the registered readiness probes
+type healthProbes struct {
+	mux    sync.RWMutex
+	probes map[string]func() error
+}
+
+// GetBuildInfo returns the build information of the running binary
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   BuildVersion,
+		Commit:    BuildCommit,
+		GoVersion: runtime.Version(),
+	}
+	if modInfo, ok := debug.ReadBuildInfo(); ok {
+		info.Module = modInfo.Main.Path
+		if info.Version == "" {
+			info.Version = modInfo.Main.Version
+		}
+	}
+	return info
+}
+
+// AddReadinessProbe adds a probe that is checked by the readiness endpoint.
+// Use this to inject dependency checks, for example whether the message bus is connected.
+//
+//  name of the probe, included in the readiness response
+//  probe returns nil if the dependency is ready or an error describing why it isn't
+func (srv *TLSServer) AddReadinessProbe(name string, probe func() error) {
+	srv.healthProbes.mux.Lock()
+	defer srv.healthProbes.mux.Unlock()
+	if srv.healthProbes.probes == nil {
+		srv.healthProbes.probes = make(map[string]func() error)
+	}
+	srv.healthProbes.probes[name] = probe
+}
+
+// EnableHealthEndpoints registers the standard orchestration endpoints. These do not require authentication.
+//  DefaultHealthPath    liveness, always responds with 200 while the server runs
+//  DefaultReadyPath     readiness, responds 200 if all probes pass or 503 if one of them fails
+//  DefaultBuildInfoPath the build version, commit and go version
+func (srv *TLSServer) EnableHealthEndpoints() {
+	startTime := time.Now()
+
+	srv.router.HandleFunc(DefaultHealthPath, func(resp http.ResponseWriter, req *http.Request) {
+		srv.writeJSON(resp, http.StatusOK, map[string]interface{}{
+			"status": "ok",
+			"uptime": int(time.Since(startTime).Seconds()),
+		})
+	})
+	srv.router.HandleFunc(DefaultReadyPath, func(resp http.ResponseWriter, req *http.Request) {
+		status := srv.checkReadiness()
+		if status.Ready {
+			srv.writeJSON(resp, http.StatusOK, status)
+		} else {
+			srv.writeJSON(resp, http.StatusServiceUnavailable, status)
+		}
+	})
+	srv.router.HandleFunc(DefaultBuildInfoPath, func(resp http.ResponseWriter, req *http.Request) {
+		srv.writeJSON(resp, http.StatusOK, GetBuildInfo())
+	})
+}
+
+// checkReadiness runs the readiness probes in order of name
+func (srv *TLSServer) checkReadiness() ReadyStatus {
+	srv.healthProbes.mux.RLock()
+	defer srv.healthProbes.mux.RUnlock()
+
+	status := ReadyStatus{Ready: true, Checks: make(map[string]string)}
+	names := make([]string, 0, len(srv.healthProbes.probes))
+	for name := range srv.healthProbes.probes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := srv.healthProbes.probes[name]()
+		if err != nil {
+			logrus.Warningf("TLSServer.checkReadiness: probe '%s' failed: %s", name, err)
+			status.Ready = false
+			status.Checks[name] = err.Error()
+		} else {
+			status.Checks[name] = "ok"
+		}
+	}
+	return status
+}
+
+// writeJSON writes the value as JSON response with the given status code
+func (srv *TLSServer) writeJSON(resp http.ResponseWriter, statusCode int, v interface{}) {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		srv.WriteInternalError(resp, err.Error())
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(statusCode)
+	_, _ = resp.Write(msg)
+}
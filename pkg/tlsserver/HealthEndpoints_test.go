@@ -0,0 +1,61 @@
+package tlsserver_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wostzone/hubserve-go/pkg/tlsserver"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	var busError error
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, func(userID, password string) bool {
+			return false
+		})
+	srv.EnableHealthEndpoints()
+	srv.AddReadinessProbe("messagebus", func() error { return busError })
+	err := srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+	cl := newHttpsClient()
+	baseURL := "https://" + clientHostPort
+
+	// liveness doesn't require authentication
+	resp, err := cl.Get(baseURL + tlsserver.DefaultHealthPath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = cl.Get(baseURL + tlsserver.DefaultReadyPath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// a failing probe makes the server not ready
+	busError = errors.New("not connected")
+	resp, err = cl.Get(baseURL + tlsserver.DefaultReadyPath)
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	status := tlsserver.ReadyStatus{}
+	err = json.Unmarshal(body, &status)
+	require.NoError(t, err)
+	assert.False(t, status.Ready)
+	assert.Equal(t, "not connected", status.Checks["messagebus"])
+
+	resp, err = cl.Get(baseURL + tlsserver.DefaultBuildInfoPath)
+	require.NoError(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	buildInfo := tlsserver.BuildInfo{}
+	err = json.Unmarshal(body, &buildInfo)
+	require.NoError(t, err)
+	assert.NotEmpty(t, buildInfo.GoVersion)
+}
@@ -1,23 +1,53 @@
 package tlsserver
 
 import (
+	"crypto/x509"
 	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/hubserve-go/pkg/audit"
 )
 
 const AuthTypeBasic = "basic"
+const AuthTypePassword = "password"
 const AuthTypeDigest = "digest"
 const AuthTypeJWT = "jwt"
 const AuthTypeCert = "cert"
 
 // HttpAuthenticator chains the selected authenticators
+// The credentials are verified by the identity providers. By default these are a password provider
+// using the verifyUsernamePassword callback and a client certificate provider that accepts any
+// certificate signed by the CA.
 type HttpAuthenticator struct {
 	BasicAuth *BasicAuthenticator
 	CertAuth  *CertAuthenticator
 	JwtAuth   *JWTAuthenticator
+
+	identityProviders []IIdentityProvider
+	loginPolicies     []ILoginPolicy
+	// delay before responding to a failed password login
+	failureDelay time.Duration
+	providerMux  sync.RWMutex
+}
+
+// AddIdentityProvider adds an identity provider to verify credentials
+func (hauth *HttpAuthenticator) AddIdentityProvider(provider IIdentityProvider) {
+	hauth.providerMux.Lock()
+	defer hauth.providerMux.Unlock()
+	hauth.identityProviders = append(hauth.identityProviders, provider)
+}
+
+// AddLoginPolicy adds a policy that is evaluated on each password login
+func (hauth *HttpAuthenticator) AddLoginPolicy(policy ILoginPolicy) {
+	hauth.providerMux.Lock()
+	defer hauth.providerMux.Unlock()
+	hauth.loginPolicies = append(hauth.loginPolicies, policy)
 }
 
 // AuthenticateRequest
-// Checks in order: client certificate, JWT bearer, Basic
+// Checks in order: client certificate, JWT bearer, other bearer tokens, API key header, Basic
 // Returns the authenticated userID or an error if authentication failed
 func (hauth *HttpAuthenticator) AuthenticateRequest(resp http.ResponseWriter, req *http.Request) (userID string, match bool) {
 	if hauth.CertAuth != nil {
@@ -33,6 +63,20 @@ func (hauth *HttpAuthenticator) AuthenticateRequest(resp http.ResponseWriter, re
 		if match {
 			return userID, match
 		}
+		// not a JWT token, maybe another type of token
+		token, err := hauth.JwtAuth.GetBearerToken(req)
+		if err == nil {
+			userID, match = hauth.VerifyToken(token)
+			if match {
+				return userID, match
+			}
+		}
+	}
+	if apiKey := req.Header.Get(APIKeyHeader); apiKey != "" {
+		userID, match = hauth.VerifyToken(apiKey)
+		if match {
+			return userID, match
+		}
 	}
 	if hauth.BasicAuth != nil {
 		userID, match = hauth.BasicAuth.AuthenticateRequest(resp, req)
@@ -43,15 +87,141 @@ func (hauth *HttpAuthenticator) AuthenticateRequest(resp http.ResponseWriter, re
 	return userID, false
 }
 
+// HandleJWTCertLogin issues a JWT access and refresh token pair to a client that authenticated with
+// a client certificate. This lets browsers with a user certificate switch to bearer token authentication,
+// for example for websocket connections. The certificate must identify a user. Plugin certificates
+// are not accepted.
+// Attach this method to the router with the certificate login route, see DefaultJWTCertLoginPath.
+func (hauth *HttpAuthenticator) HandleJWTCertLogin(resp http.ResponseWriter, req *http.Request) {
+	logrus.Infof("HttpAuthenticator.HandleJWTCertLogin")
+	cert := getVerifiedClientCert(req)
+	userID, match := "", false
+	if cert != nil {
+		userID, match = hauth.VerifyClientCert(cert)
+	}
+	match = match && userID != ""
+	audit.Record(audit.Event{
+		Type:       audit.EventLogin,
+		UserID:     userID,
+		RemoteAddr: req.RemoteAddr,
+		Success:    match,
+		Details:    map[string]string{"method": AuthTypeCert},
+	})
+	hauth.JwtAuth.countLogin(AuthTypeCert, match)
+	if !match {
+		logrus.Infof("HttpAuthenticator.HandleJWTCertLogin: no valid user certificate from %s", req.RemoteAddr)
+		resp.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	hauth.JwtAuth.startSession(userID, resp, req)
+}
+
+// SetIdentityProviders replaces the identity providers, including the default providers.
+// Use this to limit the authentication methods of a deployment.
+func (hauth *HttpAuthenticator) SetIdentityProviders(providers ...IIdentityProvider) {
+	hauth.providerMux.Lock()
+	defer hauth.providerMux.Unlock()
+	hauth.identityProviders = providers
+}
+
+// SetLoginFailureDelay sets the delay before a failed password login returns. This slows down
+// password guessing and hides the time taken by the verification.
+//  delay of a failed login, or 0 to not delay
+func (hauth *HttpAuthenticator) SetLoginFailureDelay(delay time.Duration) {
+	hauth.providerMux.Lock()
+	defer hauth.providerMux.Unlock()
+	hauth.failureDelay = delay
+}
+
+// SetMetrics sets the registry to record the authentication metrics of the authenticators
+//  metrics is the registry in which the metrics are registered, or nil to stop recording
+func (hauth *HttpAuthenticator) SetMetrics(metrics *MetricsRegistry) {
+	hauth.JwtAuth.SetMetrics(metrics)
+	hauth.CertAuth.SetMetrics(metrics)
+}
+
+// VerifyClientCert verifies the client certificate with the identity providers
+// Returns the userID of the first provider that accepts the certificate
+func (hauth *HttpAuthenticator) VerifyClientCert(cert *x509.Certificate) (userID string, match bool) {
+	hauth.providerMux.RLock()
+	defer hauth.providerMux.RUnlock()
+	for _, provider := range hauth.identityProviders {
+		userID, match = provider.VerifyClientCert(cert)
+		if match {
+			return userID, match
+		}
+	}
+	return "", false
+}
+
+// VerifyPassword verifies the login credentials with the identity providers and the login
+// policies. All providers are invoked, also when a policy rejects the login attempt, so the
+// response time doesn't reveal which provider knows the loginID or whether a policy, like a
+// lockout, rejected the attempt.
+// Returns the userID of the first provider that accepts the credentials
+func (hauth *HttpAuthenticator) VerifyPassword(loginID, password string) (userID string, match bool) {
+	hauth.providerMux.RLock()
+	providers := hauth.identityProviders
+	policies := hauth.loginPolicies
+	failureDelay := hauth.failureDelay
+	hauth.providerMux.RUnlock()
+
+	var err error
+	for _, policy := range policies {
+		if err = policy.CheckLogin(loginID, password); err != nil {
+			logrus.Infof("HttpAuthenticator.VerifyPassword: login rejected: %s", err)
+			break
+		}
+	}
+	for _, provider := range providers {
+		if providerUserID, ok := provider.VerifyPassword(loginID, password); ok && !match {
+			userID = providerUserID
+			match = true
+		}
+	}
+	// a rejected login attempt fails even if the credentials are valid
+	if err != nil {
+		userID, match = "", false
+	}
+	for _, policy := range policies {
+		policy.LoginResult(loginID, match)
+	}
+	if !match && failureDelay > 0 {
+		time.Sleep(failureDelay)
+	}
+	return userID, match
+}
+
+// VerifyToken verifies an opaque bearer token with the identity providers
+// Returns the userID of the first provider that accepts the token
+func (hauth *HttpAuthenticator) VerifyToken(token string) (userID string, match bool) {
+	hauth.providerMux.RLock()
+	defer hauth.providerMux.RUnlock()
+	for _, provider := range hauth.identityProviders {
+		userID, match = provider.VerifyToken(token)
+		if match {
+			return userID, match
+		}
+	}
+	return "", false
+}
+
 // Create a new HTTP authenticator
 // Use .AuthenticateRequest() to authenticate the incoming request
-//  verifyUsernamePassword is the handler that validates the loginID and secret
+//  verifyUsernamePassword is the handler that validates the loginID and secret, or nil to add providers later
 func NewHttpAuthenticator(
 	verifyUsernamePassword func(loginID, secret string) bool) *HttpAuthenticator {
-	ha := &HttpAuthenticator{
-		BasicAuth: NewBasicAuthenticator(verifyUsernamePassword),
-		JwtAuth:   NewJWTAuthenticator(nil, verifyUsernamePassword),
-		CertAuth:  NewCertAuthenticator(),
+	ha := &HttpAuthenticator{}
+	ha.BasicAuth = NewBasicAuthenticator(nil)
+	ha.BasicAuth.verifyLogin = ha.VerifyPassword
+	ha.JwtAuth = NewJWTAuthenticator(nil, nil)
+	ha.JwtAuth.verifyLogin = ha.VerifyPassword
+	ha.CertAuth = NewCertAuthenticator()
+	ha.CertAuth.verifyClientCert = ha.VerifyClientCert
+
+	if verifyUsernamePassword != nil {
+		ha.AddIdentityProvider(NewPasswordIdentityProvider(verifyUsernamePassword))
 	}
+	ha.AddIdentityProvider(NewCertIdentityProvider())
 	return ha
 }
@@ -0,0 +1,136 @@
+package tlsserver
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+)
+
+// IIdentityProvider verifies the identity of clients using one or more authentication methods.
+// Methods that are not supported by the provider simply return false.
+type IIdentityProvider interface {
+	// VerifyPassword verifies login credentials and returns the userID if they are valid
+	VerifyPassword(loginID string, password string) (userID string, ok bool)
+	// VerifyClientCert verifies a client certificate that is already verified as signed by the CA.
+	// Returns the userID of the certificate holder, or an empty userID for plugins.
+	VerifyClientCert(cert *x509.Certificate) (userID string, ok bool)
+	// VerifyToken verifies an opaque (non JWT) bearer token, like an API key, and returns its userID
+	VerifyToken(token string) (userID string, ok bool)
+}
+
+// PasswordIdentityProvider verifies passwords using a callback, for example that of the unpw store
+type PasswordIdentityProvider struct {
+	verifyUsernamePassword func(loginID, password string) bool
+}
+
+// VerifyPassword returns the loginID as userID if the callback accepts the password
+func (provider *PasswordIdentityProvider) VerifyPassword(loginID string, password string) (string, bool) {
+	if provider.verifyUsernamePassword == nil {
+		return "", false
+	}
+	return loginID, provider.verifyUsernamePassword(loginID, password)
+}
+
+// VerifyClientCert is not supported
+func (provider *PasswordIdentityProvider) VerifyClientCert(*x509.Certificate) (string, bool) {
+	return "", false
+}
+
+// VerifyToken is not supported
+func (provider *PasswordIdentityProvider) VerifyToken(string) (string, bool) {
+	return "", false
+}
+
+// NewPasswordIdentityProvider creates an identity provider for password verification
+// The handler must compare the secret in constant time, for example by comparing password hashes
+// with bcrypt or crypto/subtle, to avoid revealing the password through the response time.
+//  verifyUsernamePassword is the handler that validates the loginID and secret
+func NewPasswordIdentityProvider(verifyUsernamePassword func(loginID, password string) bool) *PasswordIdentityProvider {
+	return &PasswordIdentityProvider{verifyUsernamePassword: verifyUsernamePassword}
+}
+
+// CertIdentityProvider accepts client certificates signed by the hub CA, optionally limited to
+// certificates with specific organizational units.
+type CertIdentityProvider struct {
+	allowedOUs []string
+}
+
+// VerifyPassword is not supported
+func (provider *CertIdentityProvider) VerifyPassword(string, string) (string, bool) {
+	return "", false
+}
+
+// VerifyClientCert returns the certificate CommonName as userID if the certificate OU is allowed.
+// Plugin certificates do not have a userID.
+func (provider *CertIdentityProvider) VerifyClientCert(cert *x509.Certificate) (string, bool) {
+	if cert == nil {
+		return "", false
+	}
+	userID := cert.Subject.CommonName
+	// a plugin is not a username
+	if userID == "plugin" {
+		userID = ""
+	}
+	if len(provider.allowedOUs) == 0 {
+		return userID, true
+	}
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		for _, allowed := range provider.allowedOUs {
+			if ou == allowed {
+				return userID, true
+			}
+		}
+	}
+	return userID, false
+}
+
+// VerifyToken is not supported
+func (provider *CertIdentityProvider) VerifyToken(string) (string, bool) {
+	return "", false
+}
+
+// NewCertIdentityProvider creates an identity provider for client certificates
+//  allowedOUs optionally limits the accepted certificates to those with one of these OUs
+func NewCertIdentityProvider(allowedOUs ...string) *CertIdentityProvider {
+	return &CertIdentityProvider{allowedOUs: allowedOUs}
+}
+
+// StaticKeyIdentityProvider accepts a fixed set of API keys passed as bearer token.
+// Intended for simple deployments and testing.
+type StaticKeyIdentityProvider struct {
+	// map of API key to userID
+	keys map[string]string
+}
+
+// VerifyPassword is not supported
+func (provider *StaticKeyIdentityProvider) VerifyPassword(string, string) (string, bool) {
+	return "", false
+}
+
+// VerifyClientCert is not supported
+func (provider *StaticKeyIdentityProvider) VerifyClientCert(*x509.Certificate) (string, bool) {
+	return "", false
+}
+
+// VerifyToken returns the userID of the API key if it is known
+func (provider *StaticKeyIdentityProvider) VerifyToken(token string) (string, bool) {
+	// compare all keys to avoid leaking which key matched through timing
+	userID := ""
+	found := false
+	for key, keyUserID := range provider.keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1 {
+			userID = keyUserID
+			found = true
+		}
+	}
+	return userID, found
+}
+
+// NewStaticKeyIdentityProvider creates an identity provider with a fixed set of API keys
+//  keys maps each API key to the userID it identifies
+func NewStaticKeyIdentityProvider(keys map[string]string) *StaticKeyIdentityProvider {
+	provider := &StaticKeyIdentityProvider{keys: make(map[string]string)}
+	for key, userID := range keys {
+		provider.keys[key] = userID
+	}
+	return provider
+}
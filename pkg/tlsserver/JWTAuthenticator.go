@@ -2,23 +2,61 @@ package tlsserver
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/sirupsen/logrus"
 	"github.com/wostzone/hubclient-go/pkg/tlsclient"
+	"github.com/wostzone/hubserve-go/pkg/audit"
+	"github.com/wostzone/hubserve-go/pkg/clock"
 )
 
 const JWTIssuer = "tlsserver.JWTAuthenticator"
 const JwtRefreshCookieName = "authtoken"
 
+// DefaultJWTCertLoginPath is the path for obtaining JWT tokens with a client certificate
+const DefaultJWTCertLoginPath = "/login/cert"
+
+// subject of access, refresh and password reset tokens
+const accessTokenSubject = "accessToken"
+const refreshTokenSubject = "refreshToken"
+const resetTokenSubject = "resetToken"
+
+// maximum size of the login request body
+const maxLoginBodySize = 4096
+
+// DefaultAccessTokenValidity is the default validity of access tokens
+const DefaultAccessTokenValidity = 15 * time.Minute
+
+// DefaultRefreshTokenValidity is the default validity of refresh tokens and login sessions
+const DefaultRefreshTokenValidity = 10 * 24 * time.Hour
+
+// JWTOptions holds the token settings of the JWT authenticator. Zero values use the defaults.
+// The yaml tags allow services to include the options in their configuration file.
+type JWTOptions struct {
+	// AccessTokenValidity is the validity of access tokens, default DefaultAccessTokenValidity
+	AccessTokenValidity time.Duration `yaml:"accessTokenValidity"`
+	// RefreshTokenValidity is the validity of refresh tokens, default DefaultRefreshTokenValidity
+	RefreshTokenValidity time.Duration `yaml:"refreshTokenValidity"`
+	// Leeway is the clock skew tolerated when validating the expiry, issued-at and not-before
+	// times of tokens, for tokens issued by a hub whose clock differs slightly. Default 0.
+	Leeway time.Duration `yaml:"leeway"`
+}
+
 // this is temporary while figuring things out
 type JwtClaims struct {
 	Username string `json:"username"`
+	// SessionID of the login session the token belongs to
+	SessionID string `json:"sid,omitempty"`
+	// TokenID identifies a refresh token of a session. Each refresh token can only be used once.
+	TokenID string `json:"tid,omitempty"`
 	jwt.StandardClaims
 }
 
@@ -75,13 +113,45 @@ type JWTLoginCredentials struct {
 // The application must use .AuthenticateRequest() to authenticate the incoming request using the
 // access token.
 //
+// Each login creates a session that is tracked in the session store. The session ID is included
+// in the tokens. Terminating a session invalidates its access and refresh tokens, for example
+// when a refresh token is stolen. Use ListSessions and TerminateSession in admin handlers.
+//
+// Refresh tokens of a session can be used only once. Each refresh issues a new refresh token and
+// invalidates the previous one. Reuse of a previous refresh token means that it was copied, so
+// the session is terminated and a refreshTokenReuse audit event is recorded.
+//
 type JWTAuthenticator struct {
 	// the secrets verification handler
 	verifyUsernamePassword func(username, password string) bool
-	jwtKey                 []byte // secret for signing key
+	// optional verification that maps the loginID to a userID, used instead of verifyUsernamePassword
+	verifyLogin func(loginID, password string) (userID string, match bool)
+	jwtKey      []byte // secret for signing key
+
+	// previous signing key that remains valid during a key rotation grace period
+	keyMux             sync.RWMutex
+	previousKey        []byte
+	previousKeyExpires time.Time
+
+	// IDs of password reset tokens that have been used, and their expiry time
+	usedResetTokens map[string]time.Time
 
+	// token validity and clock skew leeway, which can be changed at runtime
+	validityMux          sync.RWMutex
 	accessTokenValidity  time.Duration
 	refreshTokenValidity time.Duration
+	leeway               time.Duration
+
+	// store of active login sessions
+	sessionStore ISessionStore
+	// refreshMux serializes the rotation of refresh tokens
+	refreshMux sync.Mutex
+
+	// source of time for token expiry
+	clock clock.Clock
+
+	// optional registry to record login and token metrics
+	metrics *MetricsRegistry
 
 	// optional callback when an expired token is used
 	// expiredTokenAlert func(claims *JwtClaims)
@@ -106,59 +176,152 @@ func (jauth *JWTAuthenticator) AuthenticateRequest(resp http.ResponseWriter, req
 	// 	}
 	// }
 	jwtToken, claims, err := jauth.DecodeToken(accessTokenString)
-	_ = claims
-	if err != nil {
+	if err != nil || claims.Subject == refreshTokenSubject {
 		logrus.Infof("JWTAuthenticator: Invalid access token in request %s '%s' from %s",
 			req.Method, req.RequestURI, req.RemoteAddr)
 		return "", false
 	}
+	if claims.SessionID != "" {
+		if _, found := jauth.sessionStore.Get(claims.SessionID); !found {
+			logrus.Infof("JWTAuthenticator: Access token of terminated session in request %s '%s' from %s",
+				req.Method, req.RequestURI, req.RemoteAddr)
+			jauth.metrics.IncCounter(MetricRevokedTokens)
+			return "", false
+		}
+	}
 	// hoora
 	logrus.Infof("JWTAuthenticator. Request by %s authenticated with valid JWT token", jwtToken.Header)
 	return claims.Username, true
 }
 
+// CreateResetToken creates a one-time token for resetting the password of a user.
+// An administrator hands the token to the user, who uses it to set a new password in the password store.
+// Reset tokens are signed with a key derived from the signing key so they cannot be used as access
+// or refresh tokens. Rotating the signing key invalidates outstanding reset tokens.
+//  userID whose password can be reset with the token
+//  validity of the token
+func (jauth *JWTAuthenticator) CreateResetToken(userID string, validity time.Duration) (string, error) {
+	if userID == "" {
+		return "", fmt.Errorf("JWTAuthenticator.CreateResetToken: missing userID")
+	}
+	claims := &JwtClaims{
+		Username: userID,
+		StandardClaims: jwt.StandardClaims{
+			Id:        NewSessionID(),
+			Issuer:    JWTIssuer,
+			Subject:   resetTokenSubject,
+			ExpiresAt: jauth.clock.Now().Add(validity).Unix(),
+			IssuedAt:  jauth.clock.Now().Unix(),
+		},
+	}
+	jauth.keyMux.RLock()
+	key := resetTokenKey(jauth.jwtKey)
+	jauth.keyMux.RUnlock()
+	logrus.Infof("JWTAuthenticator.CreateResetToken: created password reset token for user '%s'", userID)
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+}
+
+// VerifyResetToken verifies a password reset token and marks it as used
+// Returns the userID whose password can be reset, or an error if the token is invalid or already used
+func (jauth *JWTAuthenticator) VerifyResetToken(tokenString string) (userID string, err error) {
+	claims := &JwtClaims{}
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	jwtToken, err := parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method '%v'", token.Header["alg"])
+		}
+		jauth.keyMux.RLock()
+		defer jauth.keyMux.RUnlock()
+		return resetTokenKey(jauth.jwtKey), nil
+	})
+	if err == nil {
+		err = jauth.validateClaims(claims)
+	}
+	if err != nil || !jwtToken.Valid || claims.Subject != resetTokenSubject || claims.Id == "" {
+		return "", fmt.Errorf("JWTAuthenticator.VerifyResetToken: invalid reset token: %s", err)
+	}
+	jauth.keyMux.Lock()
+	defer jauth.keyMux.Unlock()
+	now := jauth.clock.Now()
+	for id, expires := range jauth.usedResetTokens {
+		if now.After(expires) {
+			delete(jauth.usedResetTokens, id)
+		}
+	}
+	if _, used := jauth.usedResetTokens[claims.Id]; used {
+		return "", fmt.Errorf("JWTAuthenticator.VerifyResetToken: reset token for user '%s' was already used",
+			claims.Username)
+	}
+	jauth.usedResetTokens[claims.Id] = time.Unix(claims.ExpiresAt, 0)
+	return claims.Username, nil
+}
+
 // CreateJWTTokens creates a new access and refresh token pair containing the username.
-// The result is written to the response and a refresh token is set securely in a client cookie.
+// The tokens belong to a new session that expires with the refresh token, so they can be refreshed
+// and terminated like the tokens issued on login.
 func (jauth *JWTAuthenticator) CreateJWTTokens(userID string, expTime time.Time) (accessToken string, refreshToken string, err error) {
+	session := Session{
+		SessionID:      NewSessionID(),
+		UserID:         userID,
+		Created:        jauth.clock.Now(),
+		LastRefresh:    jauth.clock.Now(),
+		Expires:        expTime,
+		RefreshTokenID: NewSessionID(),
+	}
+	err = jauth.sessionStore.Add(session)
+	if err != nil {
+		logrus.Errorf("JWTAuthenticator.CreateJWTTokens: unable to store session: %s", err)
+		return "", "", err
+	}
+	return jauth.createJWTTokens(userID, session.SessionID, session.RefreshTokenID, expTime)
+}
+
+// createJWTTokens creates a new access and refresh token pair for the user and session
+//  refreshTokenID identifies the refresh token of the session
+func (jauth *JWTAuthenticator) createJWTTokens(userID string, sessionID string, refreshTokenID string,
+	expTime time.Time) (accessToken string, refreshToken string, err error) {
+
 	logrus.Infof("CreateJWTTokens for user '%s'", userID)
-	accessExpTime := time.Now().Add(jauth.accessTokenValidity)
+	accessValidity, _ := jauth.getTokenValidity()
+	accessExpTime := jauth.clock.Now().Add(accessValidity)
 	// refreshExpTime := time.Now().Add(jauth.refreshTokenValidity)
 	refreshExpTime := expTime
 
 	// Create the JWT claims, which includes the username and expiry time
 	accessClaims := &JwtClaims{
-		Username: userID,
+		Username:  userID,
+		SessionID: sessionID,
 		StandardClaims: jwt.StandardClaims{
 			Id:      userID,
 			Issuer:  JWTIssuer,
-			Subject: "accessToken",
+			Subject: accessTokenSubject,
 			// In JWT, the expiry time is expressed as unix milliseconds
 			ExpiresAt: accessExpTime.Unix(),
-			IssuedAt:  time.Now().Unix(),
+			IssuedAt:  jauth.clock.Now().Unix(),
 		},
 	}
 	// Declare the token with the algorithm used for signing, and the claims
-	jwtAccessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	accessToken, err = jwtAccessToken.SignedString(jauth.jwtKey)
+	accessToken, err = jauth.signToken(accessClaims)
 	if err != nil {
 		return
 	}
 
 	// same for refresh token
 	refreshClaims := &JwtClaims{
-		Username: userID,
+		Username:  userID,
+		SessionID: sessionID,
+		TokenID:   refreshTokenID,
 		StandardClaims: jwt.StandardClaims{
 			Id:      userID,
 			Issuer:  JWTIssuer,
-			Subject: "refreshToken",
+			Subject: refreshTokenSubject,
 			// In JWT, the expiry time is expressed as unix milliseconds
 			ExpiresAt: refreshExpTime.Unix(),
-			IssuedAt:  time.Now().Unix(),
+			IssuedAt:  jauth.clock.Now().Unix(),
 		},
 	}
 	// Create the JWT string
-	jwtRefreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	refreshToken, err = jwtRefreshToken.SignedString(jauth.jwtKey)
+	refreshToken, err = jauth.signToken(refreshClaims)
 	return accessToken, refreshToken, err
 }
 
@@ -168,14 +331,13 @@ func (jauth *JWTAuthenticator) DecodeToken(tokenString string) (
 	jwtToken *jwt.Token, claims *JwtClaims, err error) {
 
 	claims = &JwtClaims{}
-	jwtToken, err = jwt.ParseWithClaims(tokenString, claims,
-		func(token *jwt.Token) (interface{}, error) {
-			return jauth.jwtKey, nil
-		})
+	// the claims are validated using the clock of the authenticator
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	jwtToken, err = parser.ParseWithClaims(tokenString, claims, jauth.getVerificationKey)
 	if err != nil || jwtToken == nil || !jwtToken.Valid {
 		return nil, nil, fmt.Errorf("invalid JWT token. Err=%s", err)
 	}
-	err = jwtToken.Claims.Valid()
+	err = jauth.validateClaims(claims)
 	if err != nil {
 		return jwtToken, nil, fmt.Errorf("invalid JWT claims: err=%s", err)
 	}
@@ -184,6 +346,31 @@ func (jauth *JWTAuthenticator) DecodeToken(tokenString string) (
 	return jwtToken, claims, nil
 }
 
+// getTokenValidity returns the validity of new access and refresh tokens
+func (jauth *JWTAuthenticator) getTokenValidity() (accessValidity time.Duration, refreshValidity time.Duration) {
+	jauth.validityMux.RLock()
+	defer jauth.validityMux.RUnlock()
+	return jauth.accessTokenValidity, jauth.refreshTokenValidity
+}
+
+// getVerificationKey returns the key for verifying the token signature.
+// Tokens signed with the previous key are accepted until the rotation grace period ends.
+func (jauth *JWTAuthenticator) getVerificationKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method '%v'", token.Header["alg"])
+	}
+	jauth.keyMux.RLock()
+	defer jauth.keyMux.RUnlock()
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" || kid == signingKeyID(jauth.jwtKey) {
+		return jauth.jwtKey, nil
+	} else if jauth.previousKey != nil && kid == signingKeyID(jauth.previousKey) &&
+		jauth.clock.Now().Before(jauth.previousKeyExpires) {
+		return jauth.previousKey, nil
+	}
+	return nil, fmt.Errorf("unknown or expired signing key '%s'", kid)
+}
+
 // GetBearerToken returns the bearer token from the Authorization header
 // Returns an error if no token present or token isn't a bearer token
 func (jauth *JWTAuthenticator) GetBearerToken(req *http.Request) (string, error) {
@@ -204,6 +391,65 @@ func (jauth *JWTAuthenticator) GetBearerToken(req *http.Request) (string, error)
 	return authTokenString, nil
 }
 
+// RotateSigningKey replaces the token signing key. New tokens are signed with the new key.
+// Tokens signed with the current key remain valid during the grace period, so users stay logged in.
+// Use a grace period of at least the refresh token validity to avoid forcing users to login again,
+// or 0 to invalidate all existing tokens immediately, for example when the key is compromised.
+//  newKey is the new secret, or nil to generate a random 64 byte secret
+//  gracePeriod during which the current key remains valid
+func (jauth *JWTAuthenticator) RotateSigningKey(newKey []byte, gracePeriod time.Duration) {
+	if newKey == nil {
+		newKey = make([]byte, 64)
+		_, _ = rand.Read(newKey)
+	}
+	jauth.keyMux.Lock()
+	defer jauth.keyMux.Unlock()
+	jauth.previousKey = jauth.jwtKey
+	jauth.previousKeyExpires = jauth.clock.Now().Add(gracePeriod)
+	jauth.jwtKey = newKey
+	logrus.Infof("JWTAuthenticator.RotateSigningKey: rotated signing key to '%s'. Previous key is valid until %s",
+		signingKeyID(newKey), jauth.previousKeyExpires.Format(time.RFC3339))
+}
+
+// signToken signs the claims with the current signing key and includes the key ID
+func (jauth *JWTAuthenticator) signToken(claims jwt.Claims) (string, error) {
+	jauth.keyMux.RLock()
+	key := jauth.jwtKey
+	jauth.keyMux.RUnlock()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = signingKeyID(key)
+	return token.SignedString(key)
+}
+
+// validateClaims verifies the expiry, issued-at and not-before claims using the clock,
+// tolerating a clock skew of the configured leeway
+func (jauth *JWTAuthenticator) validateClaims(claims *JwtClaims) error {
+	jauth.validityMux.RLock()
+	leeway := int64(jauth.leeway / time.Second)
+	jauth.validityMux.RUnlock()
+	now := jauth.clock.Now().Unix()
+	if !claims.VerifyExpiresAt(now-leeway, false) {
+		return fmt.Errorf("token is expired")
+	} else if !claims.VerifyIssuedAt(now+leeway, false) {
+		return fmt.Errorf("token used before issued")
+	} else if !claims.VerifyNotBefore(now+leeway, false) {
+		return fmt.Errorf("token is not valid yet")
+	}
+	return nil
+}
+
+// resetTokenKey returns the key for signing password reset tokens, derived from the signing key
+func resetTokenKey(key []byte) []byte {
+	hash := sha256.Sum256(append([]byte(resetTokenSubject+":"), key...))
+	return hash[:]
+}
+
+// signingKeyID returns an ID of the signing key that doesn't reveal the key
+func signingKeyID(key []byte) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:8])
+}
+
 // Handle a JWT login POST request.
 // Attach this method to the router with the login route. For example:
 //  > router.HandleFunc("/login", HandleJWTLogin)
@@ -215,24 +461,68 @@ func (jauth *JWTAuthenticator) HandleJWTLogin(resp http.ResponseWriter, req *htt
 	logrus.Infof("HttpAuthenticator.HandleJWTLogin")
 
 	loginCred := JWTLoginCredentials{}
-	err := json.NewDecoder(req.Body).Decode(&loginCred)
+	err := readJSONBody(resp, req, &loginCred, maxLoginBodySize)
 	if err != nil {
-		resp.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	// this is not an authentication provider. Use a callback for actual authentication
-	match := jauth.verifyUsernamePassword(loginCred.Username, loginCred.Password)
+	userID, match := loginCred.Username, false
+	if jauth.verifyLogin != nil {
+		var verifiedUserID string
+		verifiedUserID, match = jauth.verifyLogin(loginCred.Username, loginCred.Password)
+		if match {
+			userID = verifiedUserID
+		}
+	} else if jauth.verifyUsernamePassword != nil {
+		match = jauth.verifyUsernamePassword(loginCred.Username, loginCred.Password)
+	}
+	audit.Record(audit.Event{
+		Type:       audit.EventLogin,
+		UserID:     userID,
+		RemoteAddr: req.RemoteAddr,
+		Success:    match,
+	})
+	jauth.countLogin(AuthTypePassword, match)
 	if !match {
 		resp.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	jauth.startSession(userID, resp, req)
+}
 
-	refreshExpTime := time.Now().Add(jauth.refreshTokenValidity)
-	accessToken, refreshToken, err := jauth.CreateJWTTokens(loginCred.Username, refreshExpTime)
+// countLogin counts a login attempt with the authentication method
+func (jauth *JWTAuthenticator) countLogin(method string, success bool) {
+	result := MetricResultFailure
+	if success {
+		result = MetricResultSuccess
+	}
+	jauth.metrics.IncCounter(MetricLogins, method, result)
+}
 
+// startSession creates a login session for an authenticated user and writes its tokens to the response
+func (jauth *JWTAuthenticator) startSession(userID string, resp http.ResponseWriter, req *http.Request) {
+	_, refreshValidity := jauth.getTokenValidity()
+	refreshExpTime := jauth.clock.Now().Add(refreshValidity)
+	session := Session{
+		SessionID:      NewSessionID(),
+		UserID:         userID,
+		RemoteAddr:     req.RemoteAddr,
+		Created:        jauth.clock.Now(),
+		LastRefresh:    jauth.clock.Now(),
+		Expires:        refreshExpTime,
+		RefreshTokenID: NewSessionID(),
+	}
+	err := jauth.sessionStore.Add(session)
+	if err != nil {
+		logrus.Errorf("JWTAuthenticator.startSession: unable to store session: %s", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	accessToken, refreshToken, err := jauth.createJWTTokens(
+		userID, session.SessionID, session.RefreshTokenID, refreshExpTime)
 	if err != nil {
 		// If there is an error in creating the JWT return an internal server error
-		logrus.Errorf("HttpAuthenticator.HandleJWTLogin: error %s", err)
+		logrus.Errorf("JWTAuthenticator.startSession: error %s", err)
 		resp.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -243,7 +533,8 @@ func (jauth *JWTAuthenticator) HandleJWTLogin(resp http.ResponseWriter, req *htt
 // Attach this method to the router with the refresh route. For example:
 //  > router.HandleFunc("/refresh", HandleJWTRefresh)
 //
-// A valid refresh token must be provided in the client cookie or set in the authorization header
+// A valid refresh token must be provided in the client cookie or set in the authorization header.
+// The refresh token must belong to an active session and can only be used once.
 //
 // This:
 //  1. Return unauthorized if no valid refresh token was found
@@ -262,26 +553,165 @@ func (jauth *JWTAuthenticator) HandleJWTRefresh(resp http.ResponseWriter, req *h
 	}
 	// no refresh token found
 	if err != nil || refreshTokenString == "" {
+		jauth.metrics.IncCounter(MetricTokenRefreshes, MetricResultFailure)
 		resp.WriteHeader(http.StatusUnauthorized)
+		return
 	}
 
 	// is the token valid?
 	_, claims, err := jauth.DecodeToken(refreshTokenString)
-	if err != nil || claims.Id == "" {
+	if err != nil || claims.Id == "" || claims.Subject == accessTokenSubject {
 		// refresh token is invalid. Authorization refused
+		jauth.metrics.IncCounter(MetricTokenRefreshes, MetricResultFailure)
 		resp.WriteHeader(http.StatusUnauthorized)
+		return
 	}
 
-	refreshExpTime := time.Now().Add(jauth.refreshTokenValidity)
-	accessToken, refreshToken, err := jauth.CreateJWTTokens(claims.Id, refreshExpTime)
+	// refresh tokens without session cannot be rotated so are not accepted
+	if claims.SessionID == "" {
+		logrus.Infof("HttpAuthenticator.HandleJWTRefresh: refresh token without session from %s", req.RemoteAddr)
+		jauth.metrics.IncCounter(MetricTokenRefreshes, MetricResultFailure)
+		resp.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	_, refreshValidity := jauth.getTokenValidity()
+	refreshExpTime := jauth.clock.Now().Add(refreshValidity)
+	jauth.refreshMux.Lock()
+	defer jauth.refreshMux.Unlock()
+	session, found := jauth.sessionStore.Get(claims.SessionID)
+	if !found {
+		logrus.Infof("HttpAuthenticator.HandleJWTRefresh: refresh token of terminated session from %s", req.RemoteAddr)
+		audit.Record(audit.Event{
+			Type:       audit.EventTokenRefresh,
+			UserID:     claims.Id,
+			RemoteAddr: req.RemoteAddr,
+			Success:    false,
+			Details:    map[string]string{"sessionID": claims.SessionID},
+		})
+		jauth.metrics.IncCounter(MetricTokenRefreshes, MetricResultFailure)
+		jauth.metrics.IncCounter(MetricRevokedTokens)
+		resp.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if session.RefreshTokenID != "" && claims.TokenID != session.RefreshTokenID {
+		// sessions stored before rotation was supported don't have a refresh token ID
+		jauth.revokeReusedSession(session, req)
+		resp.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	session.LastRefresh = jauth.clock.Now()
+	session.Expires = refreshExpTime
+	session.RefreshTokenID = NewSessionID()
+	err = jauth.sessionStore.Add(session)
+	if err != nil {
+		logrus.Errorf("HttpAuthenticator.HandleJWTRefresh: unable to store session: %s", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	accessToken, refreshToken, err := jauth.createJWTTokens(
+		claims.Id, session.SessionID, session.RefreshTokenID, refreshExpTime)
 	if err != nil {
 		// If there is an error in creating the JWT return an internal server error
 		logrus.Errorf("HttpAuthenticator.HandleJWTLogin: error %s", err)
 		resp.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	audit.Record(audit.Event{
+		Type:       audit.EventTokenRefresh,
+		UserID:     claims.Id,
+		RemoteAddr: req.RemoteAddr,
+		Success:    true,
+		Details:    map[string]string{"sessionID": session.SessionID},
+	})
+	jauth.metrics.IncCounter(MetricTokenRefreshes, MetricResultSuccess)
 	jauth.WriteJWTTokens(accessToken, refreshToken, refreshExpTime, resp)
+}
+
+// ListSessions returns the active login sessions of a user
+//  userID whose sessions to list, or "" for the sessions of all users
+func (jauth *JWTAuthenticator) ListSessions(userID string) []Session {
+	return jauth.sessionStore.List(userID)
+}
+
+// revokeReusedSession terminates a session whose previous refresh token was used again.
+// Either the client or an attacker holds a copy of the token, so neither can continue the session.
+func (jauth *JWTAuthenticator) revokeReusedSession(session Session, req *http.Request) {
+	logrus.Warningf("JWTAuthenticator: reuse of a refresh token of session '%s' of user '%s' from %s. Terminating the session.",
+		session.SessionID, session.UserID, req.RemoteAddr)
+	_ = jauth.sessionStore.Remove(session.SessionID)
+	audit.Record(audit.Event{
+		Type:       audit.EventRefreshTokenReuse,
+		UserID:     session.UserID,
+		RemoteAddr: req.RemoteAddr,
+		Success:    false,
+		Details:    map[string]string{"sessionID": session.SessionID},
+	})
+	jauth.metrics.IncCounter(MetricTokenRefreshes, MetricResultFailure)
+	jauth.metrics.IncCounter(MetricRevokedTokens)
+}
+
+// SetClock replaces the source of time used for token and session expiry.
+// Intended for tests that use a clock.FakeClock to expire tokens without waiting.
+// The clock is also used by the session store if it supports a clock.
+func (jauth *JWTAuthenticator) SetClock(c clock.Clock) {
+	jauth.clock = c
+	if store, ok := jauth.sessionStore.(interface{ SetClock(clock.Clock) }); ok {
+		store.SetClock(c)
+	}
+}
+
+// SetMetrics sets the registry to record the login, token refresh and session metrics
+//  metrics is the registry in which the metrics are registered, or nil to stop recording
+func (jauth *JWTAuthenticator) SetMetrics(metrics *MetricsRegistry) {
+	metrics.AddCounter(MetricLogins, "Logins by authentication method and result", "method", "result")
+	metrics.AddCounter(MetricTokenRefreshes, "Token refreshes by result", "result")
+	metrics.AddCounter(MetricRevokedTokens, "Tokens of terminated sessions that were rejected")
+	metrics.AddGaugeFunc(MetricActiveSessions, "Number of active login sessions", func() float64 {
+		return float64(len(jauth.sessionStore.List("")))
+	})
+	jauth.metrics = metrics
+}
 
+// SetSessionStore replaces the store of login sessions, for example with a FileSessionStore
+// Intended to be set before the server starts. Existing sessions are not transferred.
+func (jauth *JWTAuthenticator) SetSessionStore(store ISessionStore) {
+	jauth.sessionStore = store
+	jauth.SetClock(jauth.clock)
+}
+
+// SetTokenValidity changes the validity of new access and refresh tokens, for example to tighten
+// the policy without restarting the service. Existing tokens remain valid until they expire or
+// are refreshed.
+//  accessValidity of new access tokens, or 0 for DefaultAccessTokenValidity
+//  refreshValidity of new refresh tokens and sessions, or 0 for DefaultRefreshTokenValidity
+func (jauth *JWTAuthenticator) SetTokenValidity(accessValidity time.Duration, refreshValidity time.Duration) {
+	if accessValidity <= 0 {
+		accessValidity = DefaultAccessTokenValidity
+	}
+	if refreshValidity <= 0 {
+		refreshValidity = DefaultRefreshTokenValidity
+	}
+	logrus.Infof("JWTAuthenticator.SetTokenValidity: access tokens are valid for %s, refresh tokens for %s",
+		accessValidity, refreshValidity)
+	jauth.validityMux.Lock()
+	defer jauth.validityMux.Unlock()
+	jauth.accessTokenValidity = accessValidity
+	jauth.refreshTokenValidity = refreshValidity
+}
+
+// TerminateSession terminates a login session. This invalidates the access and refresh tokens
+// of the session. The user has to login again.
+// Returns an error if the session doesn't exist
+func (jauth *JWTAuthenticator) TerminateSession(sessionID string) error {
+	logrus.Infof("JWTAuthenticator.TerminateSession: terminating session '%s'", sessionID)
+	session, _ := jauth.sessionStore.Get(sessionID)
+	err := jauth.sessionStore.Remove(sessionID)
+	audit.Record(audit.Event{
+		Type:    audit.EventSessionTerminated,
+		UserID:  session.UserID,
+		Success: err == nil,
+		Details: map[string]string{"sessionID": sessionID},
+	})
+	return err
 }
 
 // WriteJWTTokens writes the access and refresh tokens as response message and in a
@@ -311,8 +741,9 @@ func (jauth *JWTAuthenticator) WriteJWTTokens(
 //
 //  secret for generating tokens, or nil to generate a random 64 byte secret
 //  verifyUsernamePassword is the handler that validates the loginID and secret
-func NewJWTAuthenticator(
-	secret []byte, verifyUsernamePassword func(loginID, secret string) bool) *JWTAuthenticator {
+//  options with the token validity and leeway. Optional, the defaults are used if omitted
+func NewJWTAuthenticator(secret []byte, verifyUsernamePassword func(loginID, secret string) bool,
+	options ...JWTOptions) *JWTAuthenticator {
 	if secret == nil {
 		secret = make([]byte, 64)
 		rand.Read(secret)
@@ -320,8 +751,15 @@ func NewJWTAuthenticator(
 	ja := &JWTAuthenticator{
 		verifyUsernamePassword: verifyUsernamePassword,
 		jwtKey:                 secret,
-		accessTokenValidity:    15 * time.Minute,
-		refreshTokenValidity:   10 * 24 * time.Hour,
+		sessionStore:           NewMemorySessionStore(),
+		usedResetTokens:        make(map[string]time.Time),
+		clock:                  clock.RealClock{},
+	}
+	opts := JWTOptions{}
+	if len(options) > 0 {
+		opts = options[0]
 	}
+	ja.SetTokenValidity(opts.AccessTokenValidity, opts.RefreshTokenValidity)
+	ja.leeway = opts.Leeway
 	return ja
 }
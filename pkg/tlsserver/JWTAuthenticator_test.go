@@ -1,14 +1,25 @@
 package tlsserver_test
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
 	"testing"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/wostzone/hubclient-go/pkg/tlsclient"
+	"github.com/wostzone/hubserve-go/pkg/audit"
+	"github.com/wostzone/hubserve-go/pkg/certsetup"
+	"github.com/wostzone/hubserve-go/pkg/clock"
 	"github.com/wostzone/hubserve-go/pkg/tlsserver"
 )
 
@@ -111,3 +122,459 @@ func TestBadLogin(t *testing.T) {
 	resp := httptest.NewRecorder()
 	jauth.HandleJWTLogin(resp, req)
 }
+
+// jwtLogin invokes the login handler and returns the tokens
+func jwtLogin(t *testing.T, jauth *tlsserver.JWTAuthenticator, user, pass string) tlsclient.JwtAuthResponse {
+	body, _ := json.Marshal(tlsserver.JWTLoginCredentials{Username: user, Password: pass})
+	req := httptest.NewRequest("POST", "/login", bytes.NewReader(body))
+	resp := httptest.NewRecorder()
+	jauth.HandleJWTLogin(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+	tokens := tlsclient.JwtAuthResponse{}
+	err := json.Unmarshal(resp.Body.Bytes(), &tokens)
+	require.NoError(t, err)
+	return tokens
+}
+
+func TestJWTSessions(t *testing.T) {
+	user1 := "user1"
+	jauth := tlsserver.NewJWTAuthenticator(nil, func(login, pass string) bool {
+		return login == user1 && pass == "pass1"
+	})
+	tokens1 := jwtLogin(t, jauth, user1, "pass1")
+	tokens2 := jwtLogin(t, jauth, user1, "pass1")
+	sessions := jauth.ListSessions(user1)
+	require.Equal(t, 2, len(sessions))
+	assert.Empty(t, jauth.ListSessions("user2"))
+
+	_, claims, err := jauth.DecodeToken(tokens1.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, sessions[0].SessionID, claims.SessionID)
+
+	// terminate the first session
+	err = jauth.TerminateSession(claims.SessionID)
+	assert.NoError(t, err)
+	err = jauth.TerminateSession(claims.SessionID)
+	assert.Error(t, err)
+	assert.Equal(t, 1, len(jauth.ListSessions(user1)))
+
+	// access and refresh token of the terminated session are no longer valid
+	req := httptest.NewRequest("GET", "/hello", nil)
+	req.Header.Add("Authorization", "bearer "+tokens1.AccessToken)
+	_, match := jauth.AuthenticateRequest(nil, req)
+	assert.False(t, match)
+	req = httptest.NewRequest("POST", "/refresh", nil)
+	req.Header.Add("Authorization", "bearer "+tokens1.RefreshToken)
+	resp := httptest.NewRecorder()
+	jauth.HandleJWTRefresh(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// the second session is still valid
+	req = httptest.NewRequest("GET", "/hello", nil)
+	req.Header.Add("Authorization", "bearer "+tokens2.AccessToken)
+	userID, match := jauth.AuthenticateRequest(nil, req)
+	assert.True(t, match)
+	assert.Equal(t, user1, userID)
+	req = httptest.NewRequest("POST", "/refresh", nil)
+	req.Header.Add("Authorization", "bearer "+tokens2.RefreshToken)
+	resp = httptest.NewRecorder()
+	jauth.HandleJWTRefresh(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// access and refresh tokens cannot be used in place of each other
+	req = httptest.NewRequest("GET", "/hello", nil)
+	req.Header.Add("Authorization", "bearer "+tokens2.RefreshToken)
+	_, match = jauth.AuthenticateRequest(nil, req)
+	assert.False(t, match)
+	req = httptest.NewRequest("POST", "/refresh", nil)
+	req.Header.Add("Authorization", "bearer "+tokens2.AccessToken)
+	resp = httptest.NewRecorder()
+	jauth.HandleJWTRefresh(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	user1 := "user1"
+	jauthKey := []byte("notreallyasecret")
+	jauth := tlsserver.NewJWTAuthenticator(jauthKey, func(login, pass string) bool {
+		return login == user1 && pass == "pass1"
+	})
+	dir, err := ioutil.TempDir("", "tlsserver-audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	auditLog, err := audit.NewAuditLog(path.Join(dir, audit.DefaultAuditLogFile),
+		audit.DefaultMaxFileSize, audit.DefaultMaxFiles)
+	require.NoError(t, err)
+	defer auditLog.Close()
+	events := make([]audit.Event, 0)
+	auditLog.SetPublisher(func(event audit.Event) {
+		events = append(events, event)
+	})
+	audit.SetDefault(auditLog)
+	defer audit.SetDefault(nil)
+	refresh := func(refreshToken string) (tlsclient.JwtAuthResponse, int) {
+		req := httptest.NewRequest("POST", "/refresh", nil)
+		req.Header.Add("Authorization", "bearer "+refreshToken)
+		resp := httptest.NewRecorder()
+		jauth.HandleJWTRefresh(resp, req)
+		tokens := tlsclient.JwtAuthResponse{}
+		_ = json.Unmarshal(resp.Body.Bytes(), &tokens)
+		return tokens, resp.Code
+	}
+
+	// each refresh issues a new refresh token
+	tokens1 := jwtLogin(t, jauth, user1, "pass1")
+	tokens2, status := refresh(tokens1.RefreshToken)
+	require.Equal(t, http.StatusOK, status)
+	assert.NotEqual(t, tokens1.RefreshToken, tokens2.RefreshToken)
+	tokens3, status := refresh(tokens2.RefreshToken)
+	require.Equal(t, http.StatusOK, status)
+
+	// reuse of a rotated refresh token terminates the session, including its latest tokens
+	_, status = refresh(tokens1.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Empty(t, jauth.ListSessions(user1))
+	_, status = refresh(tokens3.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	req := httptest.NewRequest("GET", "/hello", nil)
+	req.Header.Add("Authorization", "bearer "+tokens3.AccessToken)
+	_, match := jauth.AuthenticateRequest(nil, req)
+	assert.False(t, match)
+
+	reuseEvents := 0
+	for _, event := range events {
+		if event.Type == audit.EventRefreshTokenReuse {
+			reuseEvents++
+			assert.Equal(t, user1, event.UserID)
+		}
+	}
+	assert.Equal(t, 1, reuseEvents)
+
+	// refresh tokens without session are not accepted, also not the first time
+	sessionlessClaims := &tlsserver.JwtClaims{
+		Username: user1,
+		StandardClaims: jwt.StandardClaims{
+			Id:        user1,
+			Issuer:    tlsserver.JWTIssuer,
+			Subject:   "refreshToken",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+	}
+	sessionlessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, sessionlessClaims).SignedString(jauthKey)
+	require.NoError(t, err)
+	_, status = refresh(sessionlessToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	_, status = refresh(sessionlessToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Empty(t, jauth.ListSessions(user1))
+
+	// tokens created without login belong to a session and are rotated
+	_, refreshToken, err := jauth.CreateJWTTokens(user1, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(jauth.ListSessions(user1)))
+	_, status = refresh(refreshToken)
+	assert.Equal(t, http.StatusOK, status)
+	_, status = refresh(refreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Empty(t, jauth.ListSessions(user1))
+}
+
+func TestJWTExpiryWithClock(t *testing.T) {
+	user1 := "user1"
+	fakeClock := clock.NewFakeClock(time.Now())
+	jauth := tlsserver.NewJWTAuthenticator(nil, func(login, pass string) bool {
+		return login == user1 && pass == "pass1"
+	})
+	jauth.SetClock(fakeClock)
+	tokens := jwtLogin(t, jauth, user1, "pass1")
+
+	// the access token expires after 15 minutes
+	fakeClock.Advance(14 * time.Minute)
+	_, _, err := jauth.DecodeToken(tokens.AccessToken)
+	assert.NoError(t, err)
+	fakeClock.Advance(2 * time.Minute)
+	_, _, err = jauth.DecodeToken(tokens.AccessToken)
+	assert.Error(t, err)
+
+	// the refresh token is still valid
+	req := httptest.NewRequest("POST", "/refresh", nil)
+	req.Header.Add("Authorization", "bearer "+tokens.RefreshToken)
+	resp := httptest.NewRecorder()
+	jauth.HandleJWTRefresh(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, 1, len(jauth.ListSessions(user1)))
+
+	// the session and its refresh token expire after 10 days without refresh
+	fakeClock.Advance(11 * 24 * time.Hour)
+	assert.Empty(t, jauth.ListSessions(user1))
+	_, _, err = jauth.DecodeToken(tokens.RefreshToken)
+	assert.Error(t, err)
+}
+
+func TestJWTTokenValidity(t *testing.T) {
+	user1 := "user1"
+	fakeClock := clock.NewFakeClock(time.Now())
+	jauth := tlsserver.NewJWTAuthenticator(nil, func(login, pass string) bool {
+		return login == user1 && pass == "pass1"
+	}, tlsserver.JWTOptions{
+		AccessTokenValidity:  5 * time.Minute,
+		RefreshTokenValidity: time.Hour,
+		Leeway:               30 * time.Second,
+	})
+	jauth.SetClock(fakeClock)
+	tokens := jwtLogin(t, jauth, user1, "pass1")
+
+	// the access token is accepted until the leeway after its expiry
+	fakeClock.Advance(5*time.Minute + 20*time.Second)
+	_, _, err := jauth.DecodeToken(tokens.AccessToken)
+	assert.NoError(t, err)
+	fakeClock.Advance(20 * time.Second)
+	_, _, err = jauth.DecodeToken(tokens.AccessToken)
+	assert.Error(t, err)
+	sessions := jauth.ListSessions(user1)
+	require.Equal(t, 1, len(sessions))
+	assert.Equal(t, sessions[0].Created.Add(time.Hour), sessions[0].Expires)
+
+	// tokens issued slightly in the future by a clock that runs ahead are accepted
+	fakeClock.Set(fakeClock.Now().Add(-6 * time.Minute))
+	tokens = jwtLogin(t, jauth, user1, "pass1")
+	fakeClock.Advance(-20 * time.Second)
+	_, _, err = jauth.DecodeToken(tokens.AccessToken)
+	assert.NoError(t, err)
+
+	// the validity of new tokens can be changed at runtime
+	jauth.SetTokenValidity(time.Minute, 0)
+	tokens = jwtLogin(t, jauth, user1, "pass1")
+	fakeClock.Advance(time.Minute + 40*time.Second)
+	_, _, err = jauth.DecodeToken(tokens.AccessToken)
+	assert.Error(t, err)
+	// the refresh validity of 0 restores the default
+	refreshClaims := jwt.StandardClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(tokens.RefreshToken, &refreshClaims)
+	require.NoError(t, err)
+	assert.Equal(t, refreshClaims.IssuedAt+int64(tlsserver.DefaultRefreshTokenValidity/time.Second),
+		refreshClaims.ExpiresAt)
+}
+
+func TestMemorySessionStoreExpiry(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	store := tlsserver.NewMemorySessionStore()
+	store.SetClock(fakeClock)
+	session1 := tlsserver.Session{SessionID: tlsserver.NewSessionID(), UserID: "user1",
+		Created: fakeClock.Now(), Expires: fakeClock.Now().Add(time.Minute)}
+	err := store.Add(session1)
+	require.NoError(t, err)
+
+	// adding a session removes the expired sessions without listing them
+	fakeClock.Advance(2 * time.Minute)
+	session2 := tlsserver.Session{SessionID: tlsserver.NewSessionID(), UserID: "user1",
+		Created: fakeClock.Now(), Expires: fakeClock.Now().Add(time.Minute)}
+	err = store.Add(session2)
+	require.NoError(t, err)
+	err = store.Remove(session1.SessionID)
+	assert.Error(t, err, "expired session is already removed")
+	err = store.Remove(session2.SessionID)
+	assert.NoError(t, err)
+}
+
+func TestFileSessionStore(t *testing.T) {
+	storePath := path.Join(os.TempDir(), "tlsserver-sessions.json")
+	_ = os.Remove(storePath)
+	defer os.Remove(storePath)
+
+	store, err := tlsserver.NewFileSessionStore(storePath)
+	require.NoError(t, err)
+	session := tlsserver.Session{SessionID: tlsserver.NewSessionID(), UserID: "user1",
+		Created: time.Now(), Expires: time.Now().Add(time.Hour)}
+	err = store.Add(session)
+	require.NoError(t, err)
+	expired := tlsserver.Session{SessionID: tlsserver.NewSessionID(), UserID: "user1",
+		Created: time.Now(), Expires: time.Now().Add(-time.Hour)}
+	err = store.Add(expired)
+	require.NoError(t, err)
+
+	// reload the store
+	store, err = tlsserver.NewFileSessionStore(storePath)
+	require.NoError(t, err)
+	_, found := store.Get(session.SessionID)
+	assert.True(t, found)
+	_, found = store.Get(expired.SessionID)
+	assert.False(t, found)
+	assert.Equal(t, 1, len(store.List("")))
+
+	err = store.Remove(session.SessionID)
+	assert.NoError(t, err)
+	store, err = tlsserver.NewFileSessionStore(storePath)
+	require.NoError(t, err)
+	assert.Empty(t, store.List(""))
+}
+
+func TestRotateSigningKey(t *testing.T) {
+	jauth := tlsserver.NewJWTAuthenticator(nil, nil)
+	expTime := time.Now().Add(time.Minute)
+	oldAccessToken, _, err := jauth.CreateJWTTokens("user1", expTime)
+	require.NoError(t, err)
+
+	// tokens of the previous key remain valid during the grace period
+	jauth.RotateSigningKey(nil, time.Minute)
+	_, _, err = jauth.DecodeToken(oldAccessToken)
+	assert.NoError(t, err)
+	newAccessToken, _, err := jauth.CreateJWTTokens("user1", expTime)
+	require.NoError(t, err)
+	_, claims, err := jauth.DecodeToken(newAccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", claims.Username)
+
+	// without grace period the previous key is no longer accepted
+	jauth.RotateSigningKey([]byte("newsecret"), 0)
+	_, _, err = jauth.DecodeToken(newAccessToken)
+	assert.Error(t, err)
+	_, _, err = jauth.DecodeToken(oldAccessToken)
+	assert.Error(t, err)
+}
+
+func TestResetToken(t *testing.T) {
+	jauth := tlsserver.NewJWTAuthenticator(nil, nil)
+	resetToken, err := jauth.CreateResetToken("user1", time.Minute)
+	require.NoError(t, err)
+
+	// a reset token is not an access token
+	_, _, err = jauth.DecodeToken(resetToken)
+	assert.Error(t, err)
+
+	userID, err := jauth.VerifyResetToken(resetToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", userID)
+	// tokens can only be used once
+	_, err = jauth.VerifyResetToken(resetToken)
+	assert.Error(t, err)
+
+	// access tokens are not reset tokens
+	accessToken, _, _ := jauth.CreateJWTTokens("user1", time.Now().Add(time.Minute))
+	_, err = jauth.VerifyResetToken(accessToken)
+	assert.Error(t, err)
+
+	// expired
+	resetToken, _ = jauth.CreateResetToken("user1", -time.Minute)
+	_, err = jauth.VerifyResetToken(resetToken)
+	assert.Error(t, err)
+
+	_, err = jauth.CreateResetToken("", time.Minute)
+	assert.Error(t, err)
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := tlsserver.DefaultPasswordPolicy
+	assert.NoError(t, policy.Validate("secret123"))
+	assert.Error(t, policy.Validate("short1"))
+	assert.Error(t, policy.Validate("nodigitsatall"))
+
+	policy.RequireUpper = true
+	policy.RequireSymbol = true
+	assert.Error(t, policy.Validate("secret123"))
+	assert.NoError(t, policy.Validate("Secret-123"))
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	changed := fakeClock.Now()
+	fakeClock.Advance(365 * 24 * time.Hour)
+	assert.False(t, policy.IsExpired(changed, fakeClock.Now()))
+	policy.MaxAgeDays = 90
+	fakeClock.Set(changed.AddDate(0, 0, 89))
+	assert.False(t, policy.IsExpired(changed, fakeClock.Now()))
+	fakeClock.Advance(2 * 24 * time.Hour)
+	assert.True(t, policy.IsExpired(changed, fakeClock.Now()))
+}
+
+func TestLoginPolicy(t *testing.T) {
+	user1 := "user1"
+	verifyCount := 0
+	hauth := tlsserver.NewHttpAuthenticator(func(login, pass string) bool {
+		verifyCount++
+		return login == user1 && (pass == "secret123" || pass == "password")
+	})
+	basicLogin := func(login, pass string) bool {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(login, pass)
+		_, match := hauth.BasicAuth.AuthenticateRequest(httptest.NewRecorder(), req)
+		return match
+	}
+	fakeClock := clock.NewFakeClock(time.Now())
+	lockout := tlsserver.NewLockoutPolicy(3, time.Minute)
+	lockout.SetClock(fakeClock)
+	hauth.AddLoginPolicy(tlsserver.NewMinLengthPolicy(8))
+	hauth.AddLoginPolicy(tlsserver.NewDenyListPolicy([]string{"root"}, []string{"Password"}))
+	hauth.AddLoginPolicy(lockout)
+
+	assert.True(t, basicLogin(user1, "secret123"))
+	assert.False(t, basicLogin(user1, "password"))
+	assert.False(t, basicLogin("root", "secret123"))
+
+	// lockout after 3 failures, also for unknown users. A successful login resets the count.
+	assert.False(t, basicLogin(user1, "bad"))
+	assert.True(t, basicLogin(user1, "secret123"))
+	for i := 0; i < 3; i++ {
+		assert.False(t, basicLogin(user1, "badpassword"))
+		assert.False(t, basicLogin("unknown", "badpassword"))
+	}
+	assert.True(t, lockout.IsLockedOut(user1))
+	assert.True(t, lockout.IsLockedOut("unknown"))
+	// the credentials are still verified so the response time doesn't reveal the lockout
+	verifyCount = 0
+	assert.False(t, basicLogin(user1, "secret123"))
+	assert.Equal(t, 1, verifyCount)
+	body, err := json.Marshal(tlsserver.JWTLoginCredentials{Username: user1, Password: "secret123"})
+	require.NoError(t, err)
+	resp := httptest.NewRecorder()
+	hauth.JwtAuth.HandleJWTLogin(resp, httptest.NewRequest("POST", "/login", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	fakeClock.Advance(time.Minute + time.Second)
+	assert.False(t, lockout.IsLockedOut(user1))
+	assert.True(t, basicLogin(user1, "secret123"))
+
+	// failed logins are delayed
+	hauth.SetLoginFailureDelay(50 * time.Millisecond)
+	start := time.Now()
+	assert.False(t, basicLogin(user1, "badpassword"))
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond))
+}
+
+func TestJWTCertLogin(t *testing.T) {
+	caCert, caKey := certsetup.CreateHubCA()
+	serverCert, err := certsetup.CreateHubServerCert([]string{serverAddress}, caCert, caKey)
+	require.NoError(t, err)
+	userCert, userKey, err := certsetup.CreateUserCert("user1", certsetup.OUClient, 1, caCert, caKey)
+	require.NoError(t, err)
+
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort, serverCert, caCert,
+		func(loginID, password string) bool { return false })
+	err = srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+
+	// login with the user certificate
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(caCert)
+	clientTLSCert := tls.Certificate{Certificate: [][]byte{userCert.Raw}, PrivateKey: userKey}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      caCertPool,
+		Certificates: []tls.Certificate{clientTLSCert},
+	}}}
+	loginURL := "https://" + clientHostPort + tlsserver.DefaultJWTCertLoginPath
+	resp, err := client.Post(loginURL, "application/json", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	authResp := tlsclient.JwtAuthResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&authResp)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.NotEmpty(t, authResp.AccessToken)
+	assert.NotEmpty(t, authResp.RefreshToken)
+
+	// without client certificate
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caCertPool}}}
+	resp, err = client.Post(loginURL, "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,76 @@
+package tlsserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ListenerOptions holds the TLS and authentication policy of an additional listener
+type ListenerOptions struct {
+	// RequireClientCert rejects connections without a client certificate signed by the Hub CA,
+	// eg for a plugin port that only accepts mutual TLS.
+	RequireClientCert bool
+	// ExternalCert serves the certificate of UseExternalCert or EnableAutocert, if configured.
+	// By default the listener serves the Hub server certificate so plugins that only trust the Hub CA
+	// can connect.
+	ExternalCert bool
+}
+
+// tlsListener is an additional listener of the server
+type tlsListener struct {
+	address     string
+	port        uint
+	options     ListenerOptions
+	httpServer  *http.Server
+	netListener net.Listener
+}
+
+// AddListener adds a listener on another port with its own TLS and authentication policy.
+// All listeners serve the same handlers. For example, serve consumers with JWT authentication and
+// an external certificate on the main port, and plugins with mutual TLS on a second port.
+// This must be called before Start.
+//  address to listen on. Use "" to listen on all IPv4 and IPv6 addresses
+//  port to listen on
+//  options with the policy of the listener
+func (srv *TLSServer) AddListener(address string, port uint, options ListenerOptions) {
+	srv.listeners = append(srv.listeners, &tlsListener{address: address, port: port, options: options})
+}
+
+// startListeners starts serving on the additional listeners
+// Returns an error if one of them cannot listen
+func (srv *TLSServer) startListeners() error {
+	hasExternalCert := srv.certReloader != nil || srv.autocertManager != nil
+	for _, listener := range srv.listeners {
+		addr := net.JoinHostPort(listener.address, strconv.FormatUint(uint64(listener.port), 10))
+		logrus.Infof("TLSServer.startListeners: listening on address %s, requireClientCert=%v",
+			addr, listener.options.RequireClientCert)
+		if srv.serverCert == nil && !(listener.options.ExternalCert && hasExternalCert) {
+			err := fmt.Errorf("TLSServer.startListeners: missing server certificate for %s", addr)
+			logrus.Error(err)
+			return err
+		}
+		httpServer, netListener, err := srv.serveTLS(addr, srv.createListenerTLSConfig(listener.options))
+		if err != nil {
+			return err
+		}
+		listener.httpServer = httpServer
+		listener.netListener = netListener
+	}
+	return nil
+}
+
+// stopListeners stops the additional listeners and closes their connections
+func (srv *TLSServer) stopListeners() {
+	for _, listener := range srv.listeners {
+		if listener.httpServer != nil {
+			_ = listener.httpServer.Shutdown(context.Background())
+			_ = listener.netListener.Close()
+			listener.httpServer = nil
+		}
+	}
+}
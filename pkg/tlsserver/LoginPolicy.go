@@ -0,0 +1,173 @@
+package tlsserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wostzone/hubserve-go/pkg/clock"
+)
+
+// ILoginPolicy is evaluated on each password login, including HTTP Basic authentication.
+// Policies can reject login attempts before the credentials are verified, for example to lock out
+// a loginID after repeated failures. Rejected attempts fail the same way as invalid credentials so
+// clients cannot tell the difference.
+type ILoginPolicy interface {
+	// CheckLogin is invoked before the credentials are verified
+	// Returns an error if the login attempt is rejected
+	CheckLogin(loginID string, password string) error
+	// LoginResult is invoked after the login attempt with its result, including rejected attempts
+	LoginResult(loginID string, success bool)
+}
+
+// DenyListPolicy rejects logins of denied loginIDs, like 'root', and logins with commonly
+// used passwords. Matching is case-insensitive.
+// The password is compared in constant time with the hash of each denied password, so the time
+// of the check doesn't reveal anything about the password.
+type DenyListPolicy struct {
+	loginIDs map[string]bool
+	// sha256 hashes of the lower case denied passwords
+	passwordHashes [][]byte
+}
+
+// CheckLogin rejects denied loginIDs and passwords
+func (policy *DenyListPolicy) CheckLogin(loginID string, password string) error {
+	passwordHash := sha256.Sum256([]byte(strings.ToLower(password)))
+	deniedPassword := 0
+	for _, deniedHash := range policy.passwordHashes {
+		deniedPassword |= subtle.ConstantTimeCompare(passwordHash[:], deniedHash)
+	}
+	if policy.loginIDs[strings.ToLower(loginID)] {
+		return fmt.Errorf("loginID '%s' is denied", loginID)
+	} else if deniedPassword == 1 {
+		return fmt.Errorf("password of '%s' is on the deny list", loginID)
+	}
+	return nil
+}
+
+// LoginResult is not used
+func (policy *DenyListPolicy) LoginResult(string, bool) {
+}
+
+// NewDenyListPolicy creates a login policy that rejects the given loginIDs and passwords
+//  loginIDs that are not allowed to login, or nil
+//  passwords that are not allowed, or nil
+func NewDenyListPolicy(loginIDs []string, passwords []string) *DenyListPolicy {
+	policy := &DenyListPolicy{loginIDs: make(map[string]bool)}
+	for _, loginID := range loginIDs {
+		policy.loginIDs[strings.ToLower(loginID)] = true
+	}
+	for _, password := range passwords {
+		passwordHash := sha256.Sum256([]byte(strings.ToLower(password)))
+		policy.passwordHashes = append(policy.passwordHashes, passwordHash[:])
+	}
+	return policy
+}
+
+// LockoutPolicy locks out a loginID for a period after too many consecutive failed logins.
+// Failures are counted by loginID whether or not the user exists, so the lockout doesn't reveal
+// which users exist. A successful login resets the count.
+type LockoutPolicy struct {
+	maxFailures int
+	duration    time.Duration
+	clock       clock.Clock
+	mutex       sync.Mutex
+	// failures by loginID
+	failures map[string]*loginFailures
+}
+
+// loginFailures tracks the consecutive failed logins of a loginID
+type loginFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// CheckLogin rejects the login if the loginID is locked out
+func (policy *LockoutPolicy) CheckLogin(loginID string, password string) error {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	failures, found := policy.failures[loginID]
+	if found && policy.clock.Now().Before(failures.lockedUntil) {
+		return fmt.Errorf("loginID '%s' is locked out until %s", loginID, failures.lockedUntil.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// IsLockedOut returns true if the loginID is locked out
+func (policy *LockoutPolicy) IsLockedOut(loginID string) bool {
+	return policy.CheckLogin(loginID, "") != nil
+}
+
+// LoginResult counts failed logins and locks out the loginID when the maximum is reached
+func (policy *LockoutPolicy) LoginResult(loginID string, success bool) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	now := policy.clock.Now()
+	// forget failures that are older than the lockout duration
+	for id, failures := range policy.failures {
+		if now.Sub(failures.lastFailure) > policy.duration && now.After(failures.lockedUntil) {
+			delete(policy.failures, id)
+		}
+	}
+	if success {
+		delete(policy.failures, loginID)
+		return
+	}
+	failures, found := policy.failures[loginID]
+	if !found {
+		failures = &loginFailures{}
+		policy.failures[loginID] = failures
+	}
+	failures.count++
+	failures.lastFailure = now
+	if failures.count >= policy.maxFailures {
+		failures.count = 0
+		failures.lockedUntil = now.Add(policy.duration)
+	}
+}
+
+// SetClock replaces the source of time used for the lockout period.
+// Intended for tests that use a clock.FakeClock.
+func (policy *LockoutPolicy) SetClock(c clock.Clock) {
+	policy.clock = c
+}
+
+// NewLockoutPolicy creates a login policy that locks out a loginID after consecutive failed logins
+//  maxFailures is the number of consecutive failures that locks out the loginID
+//  duration of the lockout
+func NewLockoutPolicy(maxFailures int, duration time.Duration) *LockoutPolicy {
+	return &LockoutPolicy{
+		maxFailures: maxFailures,
+		duration:    duration,
+		clock:       clock.RealClock{},
+		failures:    make(map[string]*loginFailures),
+	}
+}
+
+// MinLengthPolicy rejects logins with passwords shorter than the minimum length without verifying
+// them. This avoids the cost of verifying passwords that cannot be valid. Use the MinLength of
+// the PasswordPolicy of the password store.
+type MinLengthPolicy struct {
+	minLength int
+}
+
+// CheckLogin rejects passwords that are too short
+func (policy *MinLengthPolicy) CheckLogin(loginID string, password string) error {
+	if len([]rune(password)) < policy.minLength {
+		return fmt.Errorf("password of '%s' is shorter than %d characters", loginID, policy.minLength)
+	}
+	return nil
+}
+
+// LoginResult is not used
+func (policy *MinLengthPolicy) LoginResult(string, bool) {
+}
+
+// NewMinLengthPolicy creates a login policy that rejects passwords shorter than minLength
+func NewMinLengthPolicy(minLength int) *MinLengthPolicy {
+	return &MinLengthPolicy{minLength: minLength}
+}
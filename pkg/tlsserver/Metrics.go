@@ -0,0 +1,235 @@
+package tlsserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultMetricsPath is the path of the metrics endpoint
+const DefaultMetricsPath = "/metrics"
+
+// MetricsContentType is the content type of the Prometheus text exposition format
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Names of the authentication metrics
+const (
+	// MetricLogins counts logins by method (password, cert) and result (success, failure)
+	MetricLogins = "wost_auth_logins_total"
+	// MetricTokenRefreshes counts token refreshes by result (success, failure)
+	MetricTokenRefreshes = "wost_auth_token_refreshes_total"
+	// MetricRevokedTokens counts the use of tokens of terminated sessions
+	MetricRevokedTokens = "wost_auth_revoked_tokens_total"
+	// MetricClientCertAuth counts requests authenticated with a client certificate by OU
+	MetricClientCertAuth = "wost_auth_client_cert_total"
+	// MetricActiveSessions is the number of active login sessions
+	MetricActiveSessions = "wost_auth_active_sessions"
+)
+
+// Label values of the result label
+const (
+	MetricResultSuccess = "success"
+	MetricResultFailure = "failure"
+)
+
+// metric is a counter or gauge with its values by label values
+type metric struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+	// values and label values by the joined label values
+	values      map[string]float64
+	labelValues map[string][]string
+	// gaugeFunc provides the value of a gauge
+	gaugeFunc func() float64
+}
+
+// MetricsRegistry holds counters and gauges and writes them in the Prometheus text format.
+// The methods can be used on a nil registry, which ignores all updates. This lets components
+// update their metrics without checking whether metrics are enabled.
+type MetricsRegistry struct {
+	mutex   sync.Mutex
+	metrics map[string]*metric
+}
+
+// AddCounter registers a counter. Registering an existing metric has no effect.
+//  name of the counter, by convention ending with _total
+//  help describes the counter
+//  labelNames are the names of the labels whose values are provided when incrementing the counter
+func (reg *MetricsRegistry) AddCounter(name string, help string, labelNames ...string) {
+	reg.add(&metric{name: name, help: help, metricType: "counter", labelNames: labelNames})
+}
+
+// AddGaugeFunc registers a gauge whose value is obtained when the metrics are collected.
+// Registering an existing metric has no effect.
+//  name of the gauge
+//  help describes the gauge
+//  value returns the current value of the gauge
+func (reg *MetricsRegistry) AddGaugeFunc(name string, help string, value func() float64) {
+	reg.add(&metric{name: name, help: help, metricType: "gauge", gaugeFunc: value})
+}
+
+// GetCounter returns the value of a counter with the given label values
+func (reg *MetricsRegistry) GetCounter(name string, labelValues ...string) float64 {
+	if reg == nil {
+		return 0
+	}
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	if m, found := reg.metrics[name]; found {
+		return m.values[strings.Join(labelValues, "\xff")]
+	}
+	return 0
+}
+
+// HandleMetrics writes the metrics in the Prometheus text format.
+// Attach this method to the router with the metrics route, see DefaultMetricsPath.
+func (reg *MetricsRegistry) HandleMetrics(resp http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	reg.WriteText(&buf)
+	resp.Header().Set("Content-Type", MetricsContentType)
+	_, _ = resp.Write(buf.Bytes())
+}
+
+// IncCounter increments a counter. Counters that are not registered are ignored.
+//  name of the counter
+//  labelValues in the order of the label names of the counter
+func (reg *MetricsRegistry) IncCounter(name string, labelValues ...string) {
+	if reg == nil {
+		return
+	}
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	m, found := reg.metrics[name]
+	if !found || m.metricType != "counter" || len(labelValues) != len(m.labelNames) {
+		return
+	}
+	key := strings.Join(labelValues, "\xff")
+	if _, found = m.labelValues[key]; !found {
+		m.labelValues[key] = labelValues
+	}
+	m.values[key]++
+}
+
+// WriteText writes the metrics in the Prometheus text exposition format, ordered by name
+func (reg *MetricsRegistry) WriteText(w io.Writer) {
+	if reg == nil {
+		return
+	}
+	reg.mutex.Lock()
+	names := make([]string, 0, len(reg.metrics))
+	for name := range reg.metrics {
+		names = append(names, name)
+	}
+	reg.mutex.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		reg.mutex.Lock()
+		m := reg.metrics[name]
+		gaugeFunc := m.gaugeFunc
+		keys := make([]string, 0, len(m.values))
+		for key := range m.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		lines := make([]string, 0, len(keys))
+		for _, key := range keys {
+			lines = append(lines, fmt.Sprintf("%s%s %s",
+				name, formatLabels(m.labelNames, m.labelValues[key]), formatValue(m.values[key])))
+		}
+		if len(m.labelNames) == 0 && len(keys) == 0 && gaugeFunc == nil {
+			lines = append(lines, fmt.Sprintf("%s 0", name))
+		}
+		reg.mutex.Unlock()
+
+		// gauges are evaluated without holding the lock as they can take a while
+		if gaugeFunc != nil {
+			lines = append(lines, fmt.Sprintf("%s %s", name, formatValue(gaugeFunc())))
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n", name, escapeHelp(m.help))
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, m.metricType)
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// add registers a metric unless a metric with the same name exists
+func (reg *MetricsRegistry) add(m *metric) {
+	if reg == nil {
+		return
+	}
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	if _, found := reg.metrics[m.name]; found {
+		return
+	}
+	m.values = make(map[string]float64)
+	m.labelValues = make(map[string][]string)
+	reg.metrics[m.name] = m
+}
+
+// NewMetricsRegistry creates an empty metrics registry
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{metrics: make(map[string]*metric)}
+}
+
+// EnableMetrics creates the metrics registry of the server with the authentication metrics, and
+// serves it on DefaultMetricsPath. The metrics endpoint requires authentication. Requests are
+// refused while authentication is not enabled.
+// Services can register their own metrics in the registry.
+// Returns the metrics registry
+func (srv *TLSServer) EnableMetrics() *MetricsRegistry {
+	if srv.metrics == nil {
+		srv.metrics = NewMetricsRegistry()
+		if srv.httpAuthenticator != nil {
+			srv.httpAuthenticator.SetMetrics(srv.metrics)
+		} else {
+			logrus.Warningf("TLSServer.EnableMetrics: authentication is not enabled. Metrics are not served until it is.")
+		}
+		handler := func(userID string, resp http.ResponseWriter, req *http.Request) {
+			srv.metrics.HandleMetrics(resp, req)
+		}
+		// the authenticator is determined on each request as authentication can be enabled later
+		srv.router.HandleFunc(DefaultMetricsPath, func(resp http.ResponseWriter, req *http.Request) {
+			if srv.httpAuthenticator == nil {
+				srv.WriteForbidden(resp, "TLSServer: metrics require authentication")
+				return
+			}
+			srv.authenticatedHandler(DefaultMetricsPath, handler)(resp, req)
+		})
+	}
+	return srv.metrics
+}
+
+// escapeHelp escapes backslashes and newlines in help text
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// formatLabels returns the label set of a metric line, or "" if there are no labels
+func formatLabels(labelNames []string, labelValues []string) string {
+	if len(labelNames) == 0 {
+		return ""
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	labels := make([]string, len(labelNames))
+	for i, labelName := range labelNames {
+		labels[i] = fmt.Sprintf(`%s="%s"`, labelName, escaper.Replace(labelValues[i]))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// formatValue returns the value in the Prometheus text format
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,122 @@
+package tlsserver_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wostzone/hubclient-go/pkg/tlsclient"
+	"github.com/wostzone/hubserve-go/pkg/tlsserver"
+)
+
+func TestMetrics(t *testing.T) {
+	user1 := "user1"
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, func(userID, password string) bool {
+			return userID == user1 && password == "pass1"
+		})
+	metrics := srv.EnableMetrics()
+	metrics.AddCounter("wost_test_events_total", "Test events")
+	err := srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+	cl := newHttpsClient()
+	baseURL := "https://" + clientHostPort
+
+	// a successful and a failed login
+	for _, password := range []string{"pass1", "bad"} {
+		body, _ := json.Marshal(tlsserver.JWTLoginCredentials{Username: user1, Password: password})
+		resp, err := cl.Post(baseURL+tlsclient.DefaultJWTLoginPath, "application/json", bytes.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	// a refresh without token fails
+	resp, err := cl.Post(baseURL+tlsclient.DefaultJWTRefreshPath, "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// the metrics endpoint requires authentication
+	resp, err = cl.Get(baseURL + tlsserver.DefaultMetricsPath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	pcl := tlsclient.NewTLSClient(clientHostPort, testCerts.CaCert)
+	err = pcl.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer pcl.Close()
+	body, err := pcl.Get(tlsserver.DefaultMetricsPath)
+	require.NoError(t, err)
+	text := string(body)
+
+	assert.Contains(t, text, "# TYPE wost_auth_logins_total counter\n")
+	assert.Contains(t, text, `wost_auth_logins_total{method="password",result="success"} 1`)
+	assert.Contains(t, text, `wost_auth_logins_total{method="password",result="failure"} 1`)
+	assert.Contains(t, text, `wost_auth_token_refreshes_total{result="failure"} 1`)
+	assert.Contains(t, text, "wost_auth_revoked_tokens_total 0\n")
+	assert.Contains(t, text, `wost_auth_client_cert_total{ou="plugin"} 1`)
+	assert.Contains(t, text, "# TYPE wost_auth_active_sessions gauge\nwost_auth_active_sessions 1\n")
+	assert.Contains(t, text, "wost_test_events_total 0\n")
+	assert.Equal(t, float64(1),
+		metrics.GetCounter(tlsserver.MetricLogins, tlsserver.AuthTypePassword, tlsserver.MetricResultSuccess))
+}
+
+func TestMetricsWithoutAuthentication(t *testing.T) {
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, nil)
+	srv.EnableMetrics()
+	err := srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+	cl := newHttpsClient()
+	baseURL := "https://" + clientHostPort
+
+	// metrics are not public when authentication is not enabled
+	resp, err := cl.Get(baseURL + tlsserver.DefaultMetricsPath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// authentication enabled after the metrics applies to the metrics endpoint
+	srv.AddIdentityProvider(tlsserver.NewCertIdentityProvider())
+	pcl := tlsclient.NewTLSClient(clientHostPort, testCerts.CaCert)
+	err = pcl.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	defer pcl.Close()
+	_, err = pcl.Get(tlsserver.DefaultMetricsPath)
+	assert.NoError(t, err)
+}
+
+func TestMetricsRegistry(t *testing.T) {
+	reg := tlsserver.NewMetricsRegistry()
+	reg.AddCounter("b_total", "Counter\nwith newline", "label")
+	reg.AddGaugeFunc("a_gauge", "Gauge", func() float64 { return 1.5 })
+	reg.IncCounter("b_total", `quoted "value"`)
+	reg.IncCounter("b_total", `quoted "value"`)
+	// unknown metrics and wrong number of labels are ignored
+	reg.IncCounter("unknown_total")
+	reg.IncCounter("b_total")
+	assert.Equal(t, float64(2), reg.GetCounter("b_total", `quoted "value"`))
+
+	buf := bytes.Buffer{}
+	reg.WriteText(&buf)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, []string{
+		"# HELP a_gauge Gauge",
+		"# TYPE a_gauge gauge",
+		"a_gauge 1.5",
+		`# HELP b_total Counter\nwith newline`,
+		"# TYPE b_total counter",
+		`b_total{label="quoted \"value\""} 2`,
+	}, lines)
+
+	// a nil registry ignores updates
+	var nilReg *tlsserver.MetricsRegistry
+	nilReg.IncCounter("b_total", "x")
+	assert.Equal(t, float64(0), nilReg.GetCounter("b_total", "x"))
+}
@@ -0,0 +1,295 @@
+package tlsserver
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+)
+
+// DefaultOCSPPath is the path of the OCSP responder endpoint
+const DefaultOCSPPath = "/ocsp"
+
+// DefaultOCSPValidity is the default validity of a stapled OCSP response
+const DefaultOCSPValidity = 24 * time.Hour
+
+// maximum size of an OCSP request body
+const maxOCSPRequestSize = 10000
+
+// OCSPStapler maintains a signed OCSP response for the server certificate and staples it
+// in the TLS handshake.
+//
+// When the hub CA key is available the response is constructed and signed locally. This is the
+// case when the hub is self-hosted. In that case the stapler can also act as the OCSP responder
+// for clients that want to verify certificates issued by the hub CA.
+// Without CA key the response is fetched from the OCSP server listed in the server certificate.
+type OCSPStapler struct {
+	caCert     *x509.Certificate
+	caKey      crypto.Signer
+	serverCert *tls.Certificate
+	leaf       *x509.Certificate
+	validity   time.Duration
+
+	// optional callback to determine whether a certificate is revoked
+	isRevoked func(serialNumber *big.Int) (revoked bool, revokedAt time.Time)
+
+	mux      sync.RWMutex
+	staple   []byte
+	stopChan chan bool
+}
+
+// GetCertificate returns the server certificate with the current OCSP staple
+// Intended for use in tls.Config.GetCertificate
+func (stapler *OCSPStapler) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	stapler.mux.RLock()
+	defer stapler.mux.RUnlock()
+	cert := *stapler.serverCert
+	cert.OCSPStaple = stapler.staple
+	return &cert, nil
+}
+
+// GetStaple returns the current DER encoded OCSP response, or nil if none is available
+func (stapler *OCSPStapler) GetStaple() []byte {
+	stapler.mux.RLock()
+	defer stapler.mux.RUnlock()
+	return stapler.staple
+}
+
+// HandleOCSPRequest handles an OCSP request for certificates issued by the hub CA.
+// Both the POST and GET (base64 encoded request in the path) forms of RFC6960 are supported.
+// Attach this method to the router with the OCSP path prefix. For example:
+//  > router.PathPrefix("/ocsp").HandlerFunc(stapler.HandleOCSPRequest)
+func (stapler *OCSPStapler) HandleOCSPRequest(resp http.ResponseWriter, req *http.Request) {
+	var reqData []byte
+	var err error
+
+	if stapler.caKey == nil {
+		resp.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	if req.Method == http.MethodPost {
+		reqData, err = ioutil.ReadAll(io.LimitReader(req.Body, maxOCSPRequestSize))
+	} else if req.Method == http.MethodGet {
+		// the request is the last part of the path
+		parts := strings.Split(req.URL.EscapedPath(), "/")
+		var encodedReq string
+		encodedReq, err = url.PathUnescape(parts[len(parts)-1])
+		if err == nil {
+			reqData, err = base64.StdEncoding.DecodeString(encodedReq)
+		}
+	} else {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		logrus.Infof("OCSPStapler.HandleOCSPRequest: invalid request from %s: %s", req.RemoteAddr, err)
+		stapler.writeOCSPResponse(resp, ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	ocspReq, err := ocsp.ParseRequest(reqData)
+	if err != nil {
+		logrus.Infof("OCSPStapler.HandleOCSPRequest: invalid request from %s: %s", req.RemoteAddr, err)
+		stapler.writeOCSPResponse(resp, ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	// only certificates issued by the hub CA are known
+	if !stapler.isIssuedByCA(ocspReq) {
+		logrus.Infof("OCSPStapler.HandleOCSPRequest: request for certificate of unknown issuer")
+		stapler.writeOCSPResponse(resp, ocsp.UnauthorizedErrorResponse)
+		return
+	}
+	ocspResp, err := stapler.createResponse(ocspReq.SerialNumber)
+	if err != nil {
+		logrus.Errorf("OCSPStapler.HandleOCSPRequest: %s", err)
+		stapler.writeOCSPResponse(resp, ocsp.InternalErrorErrorResponse)
+		return
+	}
+	stapler.writeOCSPResponse(resp, ocspResp)
+}
+
+// Refresh the stapled OCSP response
+// This constructs a new response if the CA key is known, or fetches one from the certificate's OCSP server.
+func (stapler *OCSPStapler) Refresh() error {
+	var staple []byte
+	var err error
+
+	if stapler.caKey != nil {
+		staple, err = stapler.createResponse(stapler.leaf.SerialNumber)
+	} else {
+		staple, err = stapler.fetchResponse()
+	}
+	if err != nil {
+		logrus.Errorf("OCSPStapler.Refresh: failed obtaining an OCSP response: %s", err)
+		return err
+	}
+	stapler.mux.Lock()
+	stapler.staple = staple
+	stapler.mux.Unlock()
+	return nil
+}
+
+// SetRevocationCheck sets the callback to determine if a certificate is revoked.
+// Without this callback all certificates issued by the CA are considered valid.
+func (stapler *OCSPStapler) SetRevocationCheck(
+	isRevoked func(serialNumber *big.Int) (revoked bool, revokedAt time.Time)) {
+	stapler.isRevoked = isRevoked
+}
+
+// Start obtains the initial OCSP response and periodically refreshes it at half its validity
+// Calling Start while already started only refreshes the response.
+func (stapler *OCSPStapler) Start() error {
+	err := stapler.Refresh()
+	stapler.mux.Lock()
+	defer stapler.mux.Unlock()
+	if stapler.stopChan != nil {
+		return err
+	}
+	// the goroutine uses its own copy of the channel as Stop clears the field
+	stopChan := make(chan bool)
+	stapler.stopChan = stopChan
+	go func() {
+		ticker := time.NewTicker(stapler.validity / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-ticker.C:
+				_ = stapler.Refresh()
+			}
+		}
+	}()
+	return err
+}
+
+// Stop refreshing the OCSP response
+func (stapler *OCSPStapler) Stop() {
+	stapler.mux.Lock()
+	defer stapler.mux.Unlock()
+	if stapler.stopChan != nil {
+		close(stapler.stopChan)
+		stapler.stopChan = nil
+	}
+}
+
+// createResponse constructs and signs an OCSP response for the given certificate serial number
+func (stapler *OCSPStapler) createResponse(serialNumber *big.Int) ([]byte, error) {
+	now := time.Now()
+	template := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: serialNumber,
+		ThisUpdate:   now.Add(-time.Minute),
+		NextUpdate:   now.Add(stapler.validity),
+	}
+	if stapler.isRevoked != nil {
+		if revoked, revokedAt := stapler.isRevoked(serialNumber); revoked {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = revokedAt
+			template.RevocationReason = ocsp.Unspecified
+		}
+	}
+	return ocsp.CreateResponse(stapler.caCert, stapler.caCert, template, stapler.caKey)
+}
+
+// fetchResponse requests the OCSP response from the OCSP server of the server certificate
+func (stapler *OCSPStapler) fetchResponse() ([]byte, error) {
+	if len(stapler.leaf.OCSPServer) == 0 {
+		return nil, fmt.Errorf("server certificate has no OCSP server")
+	}
+	ocspReq, err := ocsp.CreateRequest(stapler.leaf, stapler.caCert, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpResp, err := http.Post(stapler.leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(ocspReq))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP server %s responded with %s", stapler.leaf.OCSPServer[0], httpResp.Status)
+	}
+	staple, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	ocspResp, err := ocsp.ParseResponseForCert(staple, stapler.leaf, stapler.caCert)
+	if err != nil {
+		return nil, err
+	} else if ocspResp.Status != ocsp.Good {
+		return nil, fmt.Errorf("server certificate OCSP status is not good")
+	}
+	return staple, nil
+}
+
+// isIssuedByCA checks if the OCSP request is for a certificate issued by the CA
+func (stapler *OCSPStapler) isIssuedByCA(ocspReq *ocsp.Request) bool {
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if !ocspReq.HashAlgorithm.Available() {
+		return false
+	}
+	_, err := asn1.Unmarshal(stapler.caCert.RawSubjectPublicKeyInfo, &publicKeyInfo)
+	if err != nil {
+		return false
+	}
+	hash := ocspReq.HashAlgorithm.New()
+	hash.Write(publicKeyInfo.PublicKey.RightAlign())
+	return bytes.Equal(hash.Sum(nil), ocspReq.IssuerKeyHash)
+}
+
+// writeOCSPResponse writes the DER encoded OCSP response
+func (stapler *OCSPStapler) writeOCSPResponse(resp http.ResponseWriter, ocspResp []byte) {
+	resp.Header().Set("Content-Type", "application/ocsp-response")
+	_, _ = resp.Write(ocspResp)
+}
+
+// NewOCSPStapler creates a new OCSP stapler for the server certificate
+//
+//  serverCert is the server certificate to staple the OCSP response to
+//  caCert is the CA that issued the server certificate
+//  caKey is the CA private key for signing responses, or nil to fetch responses from the OCSP server
+//  validity of the OCSP response, or 0 to use DefaultOCSPValidity
+// Returns the stapler or an error if the server certificate cannot be parsed
+func NewOCSPStapler(serverCert *tls.Certificate, caCert *x509.Certificate,
+	caKey crypto.Signer, validity time.Duration) (*OCSPStapler, error) {
+
+	if serverCert == nil || caCert == nil || len(serverCert.Certificate) == 0 {
+		return nil, fmt.Errorf("NewOCSPStapler: missing server or CA certificate")
+	}
+	leaf := serverCert.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(serverCert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("NewOCSPStapler: invalid server certificate: %s", err)
+		}
+	}
+	if validity <= 0 {
+		validity = DefaultOCSPValidity
+	}
+	stapler := &OCSPStapler{
+		caCert:     caCert,
+		caKey:      caKey,
+		serverCert: serverCert,
+		leaf:       leaf,
+		validity:   validity,
+	}
+	return stapler, nil
+}
@@ -0,0 +1,123 @@
+package tlsserver_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wostzone/hubserve-go/pkg/certsetup"
+	"github.com/wostzone/hubserve-go/pkg/tlsserver"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestOCSPStapling(t *testing.T) {
+	caCert, caKey := certsetup.CreateHubCA()
+	serverCert, err := certsetup.CreateHubServerCert([]string{serverAddress}, caCert, caKey)
+	require.NoError(t, err)
+
+	revokedSerial := big.NewInt(42)
+	isRevoked := func(serialNumber *big.Int) (bool, time.Time) {
+		return serialNumber.Cmp(revokedSerial) == 0, time.Now()
+	}
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort, serverCert, caCert, nil)
+	err = srv.EnableOCSPStapling(caKey, isRevoked, time.Hour)
+	require.NoError(t, err)
+	err = srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(caCert)
+	conn, err := tls.Dial("tcp", clientHostPort, &tls.Config{RootCAs: caCertPool})
+	require.NoError(t, err)
+	state := conn.ConnectionState()
+	conn.Close()
+	require.NotEmpty(t, state.OCSPResponse)
+
+	ocspResp, err := ocsp.ParseResponseForCert(state.OCSPResponse, state.PeerCertificates[0], caCert)
+	require.NoError(t, err)
+	assert.Equal(t, ocsp.Good, ocspResp.Status)
+}
+
+func TestOCSPResponderRequiresRevocationCheck(t *testing.T) {
+	caCert, caKey := certsetup.CreateHubCA()
+	serverCert, err := certsetup.CreateHubServerCert([]string{serverAddress}, caCert, caKey)
+	require.NoError(t, err)
+	leaf, _ := x509.ParseCertificate(serverCert.Certificate[0])
+	ocspReq, err := ocsp.CreateRequest(leaf, caCert, nil)
+	require.NoError(t, err)
+
+	// without revocation check the responder is not served
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort, serverCert, caCert, nil)
+	err = srv.EnableOCSPStapling(caKey, nil, time.Hour)
+	require.NoError(t, err)
+	err = srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(caCert)
+	cl := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caCertPool}}}
+	resp, err := cl.Post("https://"+clientHostPort+tlsserver.DefaultOCSPPath,
+		"application/ocsp-request", bytes.NewReader(ocspReq))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// starting twice does not start a second refresh
+	stapler, err := tlsserver.NewOCSPStapler(serverCert, caCert, caKey, 0)
+	require.NoError(t, err)
+	assert.NoError(t, stapler.Start())
+	assert.NoError(t, stapler.Start())
+	stapler.Stop()
+	stapler.Stop()
+}
+
+func TestOCSPResponder(t *testing.T) {
+	caCert, caKey := certsetup.CreateHubCA()
+	serverCert, err := certsetup.CreateHubServerCert([]string{serverAddress}, caCert, caKey)
+	require.NoError(t, err)
+	leaf, _ := x509.ParseCertificate(serverCert.Certificate[0])
+
+	stapler, err := tlsserver.NewOCSPStapler(serverCert, caCert, caKey, 0)
+	require.NoError(t, err)
+	stapler.SetRevocationCheck(func(serialNumber *big.Int) (bool, time.Time) {
+		return true, time.Now()
+	})
+	ocspReq, err := ocsp.CreateRequest(leaf, caCert, nil)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", tlsserver.DefaultOCSPPath, bytes.NewReader(ocspReq))
+	resp := httptest.NewRecorder()
+	stapler.HandleOCSPRequest(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	body, _ := ioutil.ReadAll(resp.Body)
+	ocspResp, err := ocsp.ParseResponseForCert(body, leaf, caCert)
+	require.NoError(t, err)
+	assert.Equal(t, ocsp.Revoked, ocspResp.Status)
+
+	// request for a certificate of another CA is unauthorized
+	otherCA, otherKey := certsetup.CreateHubCA()
+	otherCert, _ := certsetup.CreateHubServerCert([]string{serverAddress}, otherCA, otherKey)
+	otherLeaf, _ := x509.ParseCertificate(otherCert.Certificate[0])
+	ocspReq, _ = ocsp.CreateRequest(otherLeaf, otherCA, nil)
+	req = httptest.NewRequest("POST", tlsserver.DefaultOCSPPath, bytes.NewReader(ocspReq))
+	resp = httptest.NewRecorder()
+	stapler.HandleOCSPRequest(resp, req)
+	body, _ = ioutil.ReadAll(resp.Body)
+	_, err = ocsp.ParseResponse(body, nil)
+	assert.Error(t, err)
+
+	// malformed request
+	req = httptest.NewRequest("GET", tlsserver.DefaultOCSPPath+"/notbase64", nil)
+	resp = httptest.NewRecorder()
+	stapler.HandleOCSPRequest(resp, req)
+	assert.Equal(t, ocsp.MalformedRequestErrorResponse, resp.Body.Bytes())
+}
@@ -0,0 +1,312 @@
+package tlsserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultOIDCUserIDClaim is the token claim used as hub userID when none is configured
+const DefaultOIDCUserIDClaim = "sub"
+
+// DefaultJWKSCacheDuration is the default duration the issuer signing keys are cached
+const DefaultJWKSCacheDuration = time.Hour
+
+// minimum time between refreshes of the signing keys when a token has an unknown key ID
+const minJWKSRefreshInterval = time.Minute
+
+// OIDCOptions configures the validation of bearer tokens from an external OpenID Connect issuer
+type OIDCOptions struct {
+	// DiscoveryURL of the issuer, eg https://accounts.example.com/.well-known/openid-configuration
+	DiscoveryURL string
+	// Audience the tokens must be issued for, usually the client ID of the hub at the issuer. Required.
+	Audience string
+	// UserIDClaim is the claim whose value is used as hub userID. Default is DefaultOIDCUserIDClaim.
+	// For example "email" or "preferred_username".
+	UserIDClaim string
+	// CacheDuration of the issuer signing keys. Default is DefaultJWKSCacheDuration.
+	CacheDuration time.Duration
+	// HttpClient to use for requests to the issuer. Default is http.DefaultClient.
+	HttpClient *http.Client
+}
+
+// OIDCValidator validates bearer tokens issued by an external OpenID Connect identity provider as an
+// alternative to the tokens issued by the internal JWTAuthenticator.
+// This is optional and only useful for hubs that have internet access and a fixed DNS name.
+//
+// The issuer configuration and its signing keys (JWKS) are retrieved on first use and cached.
+// The validator implements IIdentityProvider so it can be added to the TLSServer with AddIdentityProvider.
+type OIDCValidator struct {
+	options OIDCOptions
+
+	mux         sync.RWMutex
+	issuer      string
+	jwksURI     string
+	keys        map[string]interface{}
+	keysUpdated time.Time
+}
+
+// oidcDiscovery contains the used fields of the OpenID provider configuration
+type oidcDiscovery struct {
+	Issuer  string `json:"issuer"`
+	JwksURI string `json:"jwks_uri"`
+}
+
+// jsonWebKey contains the used fields of a JWK
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ValidateToken validates the token signature, issuer, audience and expiry. Tokens without expiry
+// are rejected.
+// Returns the token claims or an error if the token is invalid
+func (v *OIDCValidator) ValidateToken(tokenString string) (claims jwt.MapClaims, err error) {
+	err = v.loadDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	claims = jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		// only accept asymmetric algorithms to prevent the use of the public key as HMAC secret
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA, *jwt.SigningMethodRSAPSS:
+		default:
+			return nil, fmt.Errorf("unexpected signing method '%s'", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return v.getKey(kid)
+	})
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("invalid token: %s", err)
+	}
+	v.mux.RLock()
+	issuer := v.issuer
+	v.mux.RUnlock()
+	if !claims.VerifyIssuer(issuer, true) {
+		return nil, fmt.Errorf("token issuer '%v' is not '%s'", claims["iss"], issuer)
+	}
+	if !claims.VerifyAudience(v.options.Audience, true) {
+		return nil, fmt.Errorf("token audience '%v' is not '%s'", claims["aud"], v.options.Audience)
+	}
+	// the parser only verifies the expiry if it is present
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	return claims, nil
+}
+
+// VerifyPassword is not supported
+func (v *OIDCValidator) VerifyPassword(string, string) (string, bool) {
+	return "", false
+}
+
+// VerifyClientCert is not supported
+func (v *OIDCValidator) VerifyClientCert(*x509.Certificate) (string, bool) {
+	return "", false
+}
+
+// VerifyToken validates the token and returns the hub userID from the configured claim
+func (v *OIDCValidator) VerifyToken(tokenString string) (string, bool) {
+	claims, err := v.ValidateToken(tokenString)
+	if err != nil {
+		logrus.Infof("OIDCValidator.VerifyToken: %s", err)
+		return "", false
+	}
+	userID, _ := claims[v.options.UserIDClaim].(string)
+	if userID == "" {
+		logrus.Infof("OIDCValidator.VerifyToken: token has no claim '%s'", v.options.UserIDClaim)
+		return "", false
+	}
+	return userID, true
+}
+
+// getJSON retrieves a JSON document from the issuer
+func (v *OIDCValidator) getJSON(url string, result interface{}) error {
+	resp, err := v.options.HttpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// getKey returns the signing key with the given ID, refreshing the keys if they expired or
+// the key ID is unknown. If the refresh fails, the cached key remains in use until the issuer
+// is available again.
+func (v *OIDCValidator) getKey(kid string) (interface{}, error) {
+	v.mux.RLock()
+	key, found := v.keys[kid]
+	age := time.Since(v.keysUpdated)
+	v.mux.RUnlock()
+	if found && age < v.options.CacheDuration {
+		return key, nil
+	}
+	// the issuer might have rotated its keys
+	if !found && age < minJWKSRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key '%s'", kid)
+	}
+	err := v.loadKeys()
+	if err != nil && found {
+		logrus.Warningf("OIDCValidator.getKey: using cached key '%s' as the issuer keys cannot be refreshed", kid)
+		return key, nil
+	} else if err != nil {
+		return nil, err
+	}
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+	key, found = v.keys[kid]
+	if !found {
+		return nil, fmt.Errorf("unknown signing key '%s'", kid)
+	}
+	return key, nil
+}
+
+// loadDiscovery retrieves the issuer configuration if not yet loaded
+func (v *OIDCValidator) loadDiscovery() error {
+	v.mux.RLock()
+	loaded := v.jwksURI != ""
+	v.mux.RUnlock()
+	if loaded {
+		return nil
+	}
+	discovery := oidcDiscovery{}
+	err := v.getJSON(v.options.DiscoveryURL, &discovery)
+	if err != nil {
+		logrus.Errorf("OIDCValidator.loadDiscovery: %s", err)
+		return err
+	} else if discovery.Issuer == "" || discovery.JwksURI == "" {
+		err = fmt.Errorf("OIDCValidator.loadDiscovery: missing issuer or jwks_uri in %s", v.options.DiscoveryURL)
+		logrus.Error(err)
+		return err
+	}
+	v.mux.Lock()
+	v.issuer = discovery.Issuer
+	v.jwksURI = discovery.JwksURI
+	v.mux.Unlock()
+	return nil
+}
+
+// loadKeys retrieves the signing keys of the issuer
+func (v *OIDCValidator) loadKeys() error {
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	v.mux.RLock()
+	jwksURI := v.jwksURI
+	v.mux.RUnlock()
+	err := v.getJSON(jwksURI, &jwks)
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	// don't hammer the issuer when it is not available
+	v.keysUpdated = time.Now()
+	if err != nil {
+		logrus.Errorf("OIDCValidator.loadKeys: %s", err)
+		return err
+	}
+	keys := make(map[string]interface{})
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			logrus.Warningf("OIDCValidator.loadKeys: ignoring key '%s': %s", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	v.keys = keys
+	return nil
+}
+
+// publicKey returns the RSA or ECDSA public key of the JWK
+func (jwk *jsonWebKey) publicKey() (interface{}, error) {
+	decode := func(value string) (*big.Int, error) {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(data), nil
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", jwk.Kty)
+}
+
+// NewOIDCValidator creates a validator for tokens of an external OpenID Connect issuer
+// The issuer is not contacted until the first token is validated.
+//  options with the issuer discovery URL, audience and user ID claim
+// Returns an error if the discovery URL or audience is missing
+func NewOIDCValidator(options OIDCOptions) (*OIDCValidator, error) {
+	if options.DiscoveryURL == "" || options.Audience == "" {
+		err := fmt.Errorf("NewOIDCValidator: missing discovery URL or audience")
+		logrus.Error(err)
+		return nil, err
+	}
+	if options.UserIDClaim == "" {
+		options.UserIDClaim = DefaultOIDCUserIDClaim
+	}
+	if options.CacheDuration <= 0 {
+		options.CacheDuration = DefaultJWKSCacheDuration
+	}
+	if options.HttpClient == nil {
+		options.HttpClient = http.DefaultClient
+	}
+	v := &OIDCValidator{
+		options: options,
+		keys:    make(map[string]interface{}),
+	}
+	return v, nil
+}
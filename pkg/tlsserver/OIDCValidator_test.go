@@ -0,0 +1,119 @@
+package tlsserver_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wostzone/hubserve-go/pkg/tlsserver"
+)
+
+func TestOIDCValidator(t *testing.T) {
+	const kid = "key1"
+	const audience = "wosthub"
+	issuerKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var issuerURL string
+	jwksDown := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(resp http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(resp).Encode(map[string]string{
+			"issuer":   issuerURL,
+			"jwks_uri": issuerURL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(resp http.ResponseWriter, req *http.Request) {
+		if jwksDown {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(resp).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": kid, "kty": "RSA", "use": "sig",
+				"n": base64.RawURLEncoding.EncodeToString(issuerKey.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(issuerKey.E)).Bytes()),
+			}},
+		})
+	})
+	issuer := httptest.NewServer(mux)
+	defer issuer.Close()
+	issuerURL = issuer.URL
+
+	createToken := func(claims jwt.MapClaims, method jwt.SigningMethod, key interface{}) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		tokenString, err := token.SignedString(key)
+		require.NoError(t, err)
+		return tokenString
+	}
+	validator, err := tlsserver.NewOIDCValidator(tlsserver.OIDCOptions{
+		DiscoveryURL:  issuerURL + "/.well-known/openid-configuration",
+		Audience:      audience,
+		UserIDClaim:   "email",
+		CacheDuration: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	claims := jwt.MapClaims{
+		"iss":   issuerURL,
+		"aud":   audience,
+		"sub":   "1234",
+		"email": "user1@example.com",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	}
+	userID, valid := validator.VerifyToken(createToken(claims, jwt.SigningMethodRS256, issuerKey))
+	assert.True(t, valid)
+	assert.Equal(t, "user1@example.com", userID)
+
+	// the cached key is used when the issuer is not available to refresh the keys
+	jwksDown = true
+	time.Sleep(20 * time.Millisecond)
+	_, valid = validator.VerifyToken(createToken(claims, jwt.SigningMethodRS256, issuerKey))
+	assert.True(t, valid)
+	jwksDown = false
+
+	// no expiry
+	delete(claims, "exp")
+	_, valid = validator.VerifyToken(createToken(claims, jwt.SigningMethodRS256, issuerKey))
+	assert.False(t, valid)
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+
+	// wrong audience
+	claims["aud"] = "otherapp"
+	_, valid = validator.VerifyToken(createToken(claims, jwt.SigningMethodRS256, issuerKey))
+	assert.False(t, valid)
+
+	// expired
+	claims["aud"] = audience
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	_, valid = validator.VerifyToken(createToken(claims, jwt.SigningMethodRS256, issuerKey))
+	assert.False(t, valid)
+
+	// signed by another key
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, valid = validator.VerifyToken(createToken(claims, jwt.SigningMethodRS256, otherKey))
+	assert.False(t, valid)
+
+	// HMAC tokens are not accepted
+	_, valid = validator.VerifyToken(createToken(claims, jwt.SigningMethodHS256, []byte("secret")))
+	assert.False(t, valid)
+
+	// the audience is required
+	_, err = tlsserver.NewOIDCValidator(tlsserver.OIDCOptions{DiscoveryURL: issuerURL + "/.well-known/openid-configuration"})
+	assert.Error(t, err)
+
+	// unreachable issuer
+	validator, err = tlsserver.NewOIDCValidator(tlsserver.OIDCOptions{
+		DiscoveryURL: issuerURL + "/notfound", Audience: audience})
+	require.NoError(t, err)
+	_, err = validator.ValidateToken(createToken(claims, jwt.SigningMethodRS256, issuerKey))
+	assert.Error(t, err)
+}
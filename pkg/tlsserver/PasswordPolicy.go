@@ -0,0 +1,80 @@
+package tlsserver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// PasswordPolicy describes the complexity and age requirements of user passwords.
+// The password store uses it to validate new passwords and to expire old passwords.
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters
+	MinLength int
+	// RequireUpper requires at least one upper case letter
+	RequireUpper bool
+	// RequireLower requires at least one lower case letter
+	RequireLower bool
+	// RequireDigit requires at least one digit
+	RequireDigit bool
+	// RequireSymbol requires at least one character that is not a letter or digit
+	RequireSymbol bool
+	// MaxAgeDays is the number of days after which a password expires, or 0 to never expire
+	MaxAgeDays int
+}
+
+// DefaultPasswordPolicy requires passwords of at least 8 characters with letters and digits
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:    8,
+	RequireLower: true,
+	RequireDigit: true,
+}
+
+// IsExpired returns true if a password that was set at the given time has expired
+//  changed is the time the password was set
+//  now is the current time, eg from the clock of the JWTAuthenticator so tests can use a FakeClock
+func (policy *PasswordPolicy) IsExpired(changed time.Time, now time.Time) bool {
+	if policy.MaxAgeDays <= 0 {
+		return false
+	}
+	return now.After(changed.AddDate(0, 0, policy.MaxAgeDays))
+}
+
+// Validate checks the password against the policy
+// Returns an error describing all requirements the password does not meet
+func (policy *PasswordPolicy) Validate(password string) error {
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		default:
+			hasSymbol = true
+		}
+	}
+	problems := make([]string, 0)
+	if len([]rune(password)) < policy.MinLength {
+		problems = append(problems, fmt.Sprintf("at least %d characters", policy.MinLength))
+	}
+	if policy.RequireUpper && !hasUpper {
+		problems = append(problems, "an upper case letter")
+	}
+	if policy.RequireLower && !hasLower {
+		problems = append(problems, "a lower case letter")
+	}
+	if policy.RequireDigit && !hasDigit {
+		problems = append(problems, "a digit")
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		problems = append(problems, "a symbol")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("password must contain %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
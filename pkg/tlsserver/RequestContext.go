@@ -0,0 +1,60 @@
+package tlsserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ServerTimeouts holds the timeouts of the server connections. A zero value means no timeout.
+// The yaml tags allow services to include the timeouts in their configuration file.
+type ServerTimeouts struct {
+	// ReadHeaderTimeout is the time allowed to read the request headers
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout"`
+	// ReadTimeout is the time allowed to read the request, including the body
+	ReadTimeout time.Duration `yaml:"readTimeout"`
+	// WriteTimeout is the time allowed from the end of reading the request headers until the
+	// response is written. Long-running handlers exceeding it cannot respond.
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+	// IdleTimeout is the time a keep-alive connection is kept open waiting for the next request
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+}
+
+// AddHandlerCtx adds a new handler for a path that receives the request context.
+// The context is cancelled when the client disconnects, the request times out or the server
+// stops. Long-running handlers, like history queries, should stop their work when it is done.
+// Authentication is the same as AddHandler.
+//
+//  path to listen on. This supports wildcards
+//  handler to invoke with the request context. The userID is only provided when an authenticator is used
+func (srv *TLSServer) AddHandlerCtx(path string,
+	handler func(ctx context.Context, userID string, resp http.ResponseWriter, req *http.Request)) {
+
+	srv.AddHandler(path, func(userID string, resp http.ResponseWriter, req *http.Request) {
+		handler(req.Context(), userID, resp, req)
+	})
+}
+
+// SetTimeouts sets the timeouts of the server connections. This must be called before Start.
+//  timeouts to apply to all listeners
+func (srv *TLSServer) SetTimeouts(timeouts ServerTimeouts) {
+	srv.timeouts = timeouts
+}
+
+// newHTTPServer returns a http server for the router with the configured timeouts, whose request
+// contexts are cancelled when the server stops
+func (srv *TLSServer) newHTTPServer(addr string) *http.Server {
+	baseCtx := srv.requestCtx
+	return &http.Server{
+		Addr:              addr,
+		Handler:           srv.router,
+		ReadHeaderTimeout: srv.timeouts.ReadHeaderTimeout,
+		ReadTimeout:       srv.timeouts.ReadTimeout,
+		WriteTimeout:      srv.timeouts.WriteTimeout,
+		IdleTimeout:       srv.timeouts.IdleTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
+	}
+}
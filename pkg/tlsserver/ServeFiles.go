@@ -0,0 +1,149 @@
+package tlsserver
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// IndexFile is the file served for folders and, in SPA mode, for unknown paths
+const IndexFile = "index.html"
+
+// ServeFilesOptions with options for serving static files
+type ServeFilesOptions struct {
+	// Public files are served without authentication. Default is to authenticate
+	Public bool
+	// SPA (single page application) mode serves index.html for paths that do not exist
+	// so the application can handle its own routing.
+	SPA bool
+	// CacheMaxAge is the duration clients can cache the files. 0 to require revalidation.
+	// index.html is never cached as it refers to the other assets.
+	CacheMaxAge time.Duration
+}
+
+// content types that benefit from compression
+var compressibleTypes = []string{
+	"text/", "application/javascript", "application/json", "application/xml", "image/svg+xml",
+}
+
+// ServeFiles serves static files, like web assets for Hub UI plugins, from a directory.
+// The content type is determined from the file extension. Compressible files are gzipped when
+// the client supports it. If a pre-compressed '.gz' version of the file exists then it is used instead.
+//
+//  prefix is the path prefix to serve the files on, eg "/ui"
+//  dir is the directory containing the files to serve
+//  options with serving options, or nil for the defaults
+func (srv *TLSServer) ServeFiles(prefix string, dir string, options *ServeFilesOptions) {
+	if options == nil {
+		options = &ServeFilesOptions{}
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	logrus.Infof("TLSServer.ServeFiles: serving files from '%s' on '%s'. SPA=%v, public=%v",
+		dir, prefix+"/", options.SPA, options.Public)
+
+	handler := func(userID string, resp http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		// path.Clean with a leading slash prevents escaping from dir with ../
+		urlPath := path.Clean("/" + strings.TrimPrefix(req.URL.Path, prefix))
+		filePath := filepath.Join(dir, filepath.FromSlash(urlPath))
+		fileInfo, err := os.Stat(filePath)
+		if err == nil && fileInfo.IsDir() {
+			filePath = filepath.Join(filePath, IndexFile)
+			fileInfo, err = os.Stat(filePath)
+		}
+		if err != nil && options.SPA {
+			filePath = filepath.Join(dir, IndexFile)
+			fileInfo, err = os.Stat(filePath)
+		}
+		if err != nil || fileInfo.IsDir() {
+			srv.WriteNotFound(resp, fmt.Sprintf("TLSServer.ServeFiles: '%s' not found", req.URL.Path))
+			return
+		}
+		srv.serveFile(resp, req, filePath, fileInfo, options.CacheMaxAge)
+	}
+	if options.Public {
+		srv.router.PathPrefix(prefix + "/").HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			handler("", resp, req)
+		})
+	} else {
+		srv.router.PathPrefix(prefix + "/").HandlerFunc(srv.authenticatedHandler(prefix, handler))
+	}
+}
+
+// serveFile writes the file to the response with content type, cache and compression headers
+func (srv *TLSServer) serveFile(resp http.ResponseWriter, req *http.Request,
+	filePath string, fileInfo os.FileInfo, cacheMaxAge time.Duration) {
+
+	contentType := mime.TypeByExtension(filepath.Ext(filePath))
+	if contentType != "" {
+		resp.Header().Set("Content-Type", contentType)
+	}
+	if filepath.Base(filePath) == IndexFile || cacheMaxAge <= 0 {
+		resp.Header().Set("Cache-Control", "no-cache")
+	} else {
+		resp.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(cacheMaxAge.Seconds())))
+	}
+	acceptGzip := strings.Contains(req.Header.Get("Accept-Encoding"), "gzip")
+	compressible := false
+	for _, prefix := range compressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			compressible = true
+			break
+		}
+	}
+	if compressible {
+		resp.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	// use the pre-compressed file if it exists
+	if acceptGzip {
+		gzInfo, err := os.Stat(filePath + ".gz")
+		if err == nil && !gzInfo.IsDir() {
+			gzFile, err := os.Open(filePath + ".gz")
+			if err == nil {
+				defer gzFile.Close()
+				resp.Header().Set("Content-Encoding", "gzip")
+				http.ServeContent(resp, req, filePath, gzInfo.ModTime(), gzFile)
+				return
+			}
+		}
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		srv.WriteInternalError(resp, fmt.Sprintf("TLSServer.ServeFiles: unable to open '%s': %s", filePath, err))
+		return
+	}
+	defer file.Close()
+
+	// compress on the fly. Range requests are not supported for compressed content.
+	if acceptGzip && compressible && req.Header.Get("Range") == "" {
+		modTime := fileInfo.ModTime().UTC().Truncate(time.Second)
+		if ims, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil && !modTime.After(ims) {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		resp.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+		resp.Header().Set("Content-Encoding", "gzip")
+		resp.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodHead {
+			return
+		}
+		gzWriter := gzip.NewWriter(resp)
+		defer gzWriter.Close()
+		_, _ = io.Copy(gzWriter, file)
+		return
+	}
+	http.ServeContent(resp, req, filePath, fileInfo.ModTime(), file)
+}
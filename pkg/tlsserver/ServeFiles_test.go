@@ -0,0 +1,88 @@
+package tlsserver_test
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wostzone/hubserve-go/pkg/tlsserver"
+)
+
+// newHttpsClient returns a plain https client that trusts the test CA
+func newHttpsClient() *http.Client {
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(testCerts.CaCert)
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig:    &tls.Config{RootCAs: caCertPool},
+			DisableCompression: true,
+		},
+	}
+}
+
+func TestServeFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servefiles")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	_ = ioutil.WriteFile(path.Join(dir, "index.html"), []byte("<html>index</html>"), 0644)
+	_ = ioutil.WriteFile(path.Join(dir, "app.js"), []byte("console.log('app')"), 0644)
+
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, func(userID, password string) bool {
+			return false
+		})
+	srv.ServeFiles("/ui", dir, &tlsserver.ServeFilesOptions{
+		Public: true, SPA: true, CacheMaxAge: time.Hour})
+	srv.ServeFiles("/private", dir, nil)
+	err = srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+	cl := newHttpsClient()
+	baseURL := "https://" + clientHostPort
+
+	// plain file with content type and cache header
+	resp, err := cl.Get(baseURL + "/ui/app.js")
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "console.log('app')", string(body))
+	assert.Contains(t, resp.Header.Get("Content-Type"), "javascript")
+	assert.Equal(t, "public, max-age=3600", resp.Header.Get("Cache-Control"))
+
+	// gzip compressed
+	req, _ := http.NewRequest("GET", baseURL+"/ui/app.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err = cl.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	gzReader, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	body, _ = ioutil.ReadAll(gzReader)
+	resp.Body.Close()
+	assert.Equal(t, "console.log('app')", string(body))
+
+	// SPA fallback to index.html
+	resp, err = cl.Get(baseURL + "/ui/some/route")
+	require.NoError(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "<html>index</html>", string(body))
+	assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+
+	// private files require authentication
+	resp, err = cl.Get(baseURL + "/private/app.js")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
@@ -0,0 +1,201 @@
+package tlsserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/hubserve-go/pkg/clock"
+)
+
+// Session describes an active login session. A session is created on login and lives until
+// its refresh token expires or the session is terminated.
+type Session struct {
+	SessionID string `json:"sessionID"`
+	UserID    string `json:"userID"`
+	// RemoteAddr of the client that logged in
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	Created    time.Time `json:"created"`
+	// LastRefresh is the last time the session tokens were refreshed
+	LastRefresh time.Time `json:"lastRefresh"`
+	// Expires is the expiry time of the session refresh token
+	Expires time.Time `json:"expires"`
+	// RefreshTokenID is the ID of the current refresh token. Older refresh tokens of the session
+	// are no longer valid.
+	RefreshTokenID string `json:"refreshTokenID,omitempty"`
+}
+
+// ISessionStore is the interface of the storage of active sessions
+type ISessionStore interface {
+	// Add or replace a session
+	Add(session Session) error
+	// Get the session with the given ID. Returns false if the session doesn't exist or has expired.
+	Get(sessionID string) (session Session, found bool)
+	// List the active sessions of a user, or all active sessions if userID is empty
+	List(userID string) []Session
+	// Remove the session with the given ID
+	Remove(sessionID string) error
+}
+
+// NewSessionID returns a new random session ID
+func NewSessionID() string {
+	sid := make([]byte, 16)
+	_, _ = rand.Read(sid)
+	return hex.EncodeToString(sid)
+}
+
+// MemorySessionStore keeps sessions in memory. All sessions are lost after a restart.
+type MemorySessionStore struct {
+	mux      sync.RWMutex
+	sessions map[string]Session
+	clock    clock.Clock
+}
+
+// Add or replace a session
+// Expired sessions are removed so the store doesn't grow with each login.
+func (store *MemorySessionStore) Add(session Session) error {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	store.removeExpired()
+	store.sessions[session.SessionID] = session
+	return nil
+}
+
+// Get the session with the given ID. Returns false if the session doesn't exist or has expired.
+func (store *MemorySessionStore) Get(sessionID string) (session Session, found bool) {
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+	session, found = store.sessions[sessionID]
+	if found && store.clock.Now().After(session.Expires) {
+		return session, false
+	}
+	return session, found
+}
+
+// List the active sessions of a user ordered by creation time, or all sessions if userID is empty
+func (store *MemorySessionStore) List(userID string) []Session {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	// remove expired sessions while we're at it
+	store.removeExpired()
+	result := make([]Session, 0)
+	for _, session := range store.sessions {
+		if userID == "" || session.UserID == userID {
+			result = append(result, session)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Created.Before(result[j].Created) })
+	return result
+}
+
+// Remove the session with the given ID
+func (store *MemorySessionStore) Remove(sessionID string) error {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	if _, found := store.sessions[sessionID]; !found {
+		return fmt.Errorf("session '%s' not found", sessionID)
+	}
+	delete(store.sessions, sessionID)
+	return nil
+}
+
+// removeExpired removes the expired sessions. The caller must hold the lock.
+func (store *MemorySessionStore) removeExpired() {
+	now := store.clock.Now()
+	for sessionID, session := range store.sessions {
+		if now.After(session.Expires) {
+			delete(store.sessions, sessionID)
+		}
+	}
+}
+
+// SetClock replaces the source of time used to expire sessions
+func (store *MemorySessionStore) SetClock(c clock.Clock) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	store.clock = c
+}
+
+// NewMemorySessionStore creates a session store that keeps sessions in memory
+func NewMemorySessionStore() *MemorySessionStore {
+	store := &MemorySessionStore{
+		sessions: make(map[string]Session),
+		clock:    clock.RealClock{},
+	}
+	return store
+}
+
+// FileSessionStore keeps sessions in memory and saves them to a JSON file on each change.
+// Sessions survive a restart, provided the JWT signing key is also preserved.
+type FileSessionStore struct {
+	MemorySessionStore
+	filePath string
+	fileMux  sync.Mutex
+}
+
+// Add or replace a session and save the store
+func (store *FileSessionStore) Add(session Session) error {
+	_ = store.MemorySessionStore.Add(session)
+	return store.save()
+}
+
+// Remove a session and save the store
+func (store *FileSessionStore) Remove(sessionID string) error {
+	err := store.MemorySessionStore.Remove(sessionID)
+	if err != nil {
+		return err
+	}
+	return store.save()
+}
+
+// save writes the active sessions to file
+func (store *FileSessionStore) save() error {
+	store.fileMux.Lock()
+	defer store.fileMux.Unlock()
+	sessions := store.MemorySessionStore.List("")
+	data, _ := json.MarshalIndent(sessions, "", "  ")
+	tmpPath := store.filePath + ".tmp"
+	err := ioutil.WriteFile(tmpPath, data, 0600)
+	if err == nil {
+		err = os.Rename(tmpPath, store.filePath)
+	}
+	if err != nil {
+		logrus.Errorf("FileSessionStore.save: failed writing sessions to %s: %s", store.filePath, err)
+	}
+	return err
+}
+
+// NewFileSessionStore creates a session store that persists sessions in the given file.
+// Existing sessions are loaded from the file if it exists.
+//  filePath of the JSON file holding the sessions
+// Returns the store, or an error if the file exists but cannot be read
+func NewFileSessionStore(filePath string) (*FileSessionStore, error) {
+	store := &FileSessionStore{
+		MemorySessionStore: MemorySessionStore{sessions: make(map[string]Session), clock: clock.RealClock{}},
+		filePath:           filePath,
+	}
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		logrus.Errorf("NewFileSessionStore: unable to read %s: %s", filePath, err)
+		return nil, err
+	}
+	sessions := make([]Session, 0)
+	err = json.Unmarshal(data, &sessions)
+	if err != nil {
+		logrus.Errorf("NewFileSessionStore: invalid session file %s: %s", filePath, err)
+		return nil, err
+	}
+	for _, session := range sessions {
+		store.sessions[session.SessionID] = session
+	}
+	return store, nil
+}
@@ -3,15 +3,20 @@ package tlsserver
 
 import (
 	"context"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"math/big"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 	"github.com/wostzone/hubclient-go/pkg/tlsclient"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 // Simple TLS Server
@@ -19,10 +24,33 @@ type TLSServer struct {
 	address           string
 	port              uint
 	caCert            *x509.Certificate
+	clientCAs         []*x509.Certificate
+	requireClientCert bool
+	certReloader      *CertReloader
+	autocertManager   *autocert.Manager
+	listeners         []*tlsListener
+	timeouts          ServerTimeouts
+	// requestCtx is the parent context of requests, cancelled when the server stops
+	requestCtx        context.Context
+	cancelRequests    context.CancelFunc
 	serverCert        *tls.Certificate
 	httpServer        *http.Server
+	httpListener      net.Listener
 	router            *mux.Router
 	httpAuthenticator *HttpAuthenticator
+	ocspStapler       *OCSPStapler
+	healthProbes      healthProbes
+	metrics           *MetricsRegistry
+	unixServer        *http.Server
+	unixSocketPath    string
+}
+
+// AddClientCA adds a CA whose client certificates are accepted in addition to those of the server CA.
+// Use this during the transition period of a CA rotation to accept certificates of the previous CA.
+// This must be called before Start.
+//  caCert is the certificate of the additional CA
+func (srv *TLSServer) AddClientCA(caCert *x509.Certificate) {
+	srv.clientCAs = append(srv.clientCAs, caCert)
 }
 
 // AddHandler adds a new handler for a path.
@@ -30,17 +58,28 @@ type TLSServer struct {
 // The server authenticates the request before passing it to this handler.
 // The handler's userID is that of the authenticated user, and is intended for authorization of the request.
 // If authentication is not enabled then the userID is empty.
+// If the client authenticated with a certificate, the handler can obtain it using GetClientCertificate(req).
 //
 //  path to listen on. This supports wildcards
 //  handler to invoke with the request. The userID is only provided when an authenticator is used
 func (srv *TLSServer) AddHandler(path string,
 	handler func(userID string, resp http.ResponseWriter, req *http.Request)) {
 
+	srv.router.HandleFunc(path, srv.authenticatedHandler(path, handler))
+}
+
+// authenticatedHandler returns a http handler that authenticates the request before passing it
+// to the given handler. If no authenticator is used the request is passed as-is with an empty userID.
+//  path is the path of the handler, used for logging
+//  handler to invoke with the authenticated request
+func (srv *TLSServer) authenticatedHandler(path string,
+	handler func(userID string, resp http.ResponseWriter, req *http.Request)) http.HandlerFunc {
+
 	// do we need a local copy of handler? not sure
 	local_handler := handler
 	if srv.httpAuthenticator != nil {
 		// the internal authenticator performs certificate based, basic or jwt token authentication if needed
-		srv.router.HandleFunc(path, func(resp http.ResponseWriter, req *http.Request) {
+		return func(resp http.ResponseWriter, req *http.Request) {
 			// valid authentication without userID means a plugin certificate was used which is always authorized
 			userID, match := srv.httpAuthenticator.AuthenticateRequest(resp, req)
 			if !match {
@@ -48,67 +87,261 @@ func (srv *TLSServer) AddHandler(path string,
 				logrus.Infof("%s", msg)
 				srv.WriteForbidden(resp, msg)
 			} else {
-				local_handler(userID, resp, req)
+				local_handler(userID, resp, withClientCertificate(req))
 			}
-		})
-	} else {
-		srv.router.HandleFunc(path, func(resp http.ResponseWriter, req *http.Request) {
-			// no authenticator means we don't know who the user is
-			local_handler("", resp, req)
-		})
+		}
+	}
+	return func(resp http.ResponseWriter, req *http.Request) {
+		// no authenticator means we don't know who the user is
+		local_handler("", resp, withClientCertificate(req))
 	}
 }
 
-// Start the TLS server using the provided CA and Server certificates.
-// The server will request but not require a client certificate. If one is provided it must be valid.
-func (srv *TLSServer) Start() error {
-	var err error
+// AddIdentityProvider adds an identity provider for verifying client credentials.
+// This enables authentication if no authenticator was provided to NewTLSServer. In that case call
+// this before adding handlers.
+// Use this to accept multiple authentication methods, like passwords, client certificates and API keys.
+func (srv *TLSServer) AddIdentityProvider(provider IIdentityProvider) {
+	if srv.httpAuthenticator == nil {
+		srv.enableAuthentication(nil)
+	}
+	srv.httpAuthenticator.AddIdentityProvider(provider)
+}
 
-	logrus.Infof("Starting TLS server on address: %s:%d", srv.address, srv.port)
-	if srv.caCert == nil || srv.serverCert == nil {
-		err := fmt.Errorf("missing CA or server certificate")
+// AddLoginPolicy adds a policy that is evaluated on each password login, like a lockout after
+// repeated failures.
+// Returns an error if authentication is not enabled
+func (srv *TLSServer) AddLoginPolicy(policy ILoginPolicy) error {
+	if srv.httpAuthenticator == nil {
+		err := fmt.Errorf("TLSServer.AddLoginPolicy: authentication is not enabled")
 		logrus.Error(err)
 		return err
 	}
+	srv.httpAuthenticator.AddLoginPolicy(policy)
+	return nil
+}
+
+// enableAuthentication creates the http authenticator and adds the JWT login and refresh handlers
+//  verifyUsernamePassword is the handler that validates the loginID and secret, or nil for none
+func (srv *TLSServer) enableAuthentication(verifyUsernamePassword func(userID, secret string) bool) {
+	// for now the JWT login path is fixed. Once a use-case comes up that requires something configurable
+	// this can be updated.
+	jwtLoginPath := tlsclient.DefaultJWTLoginPath
+	hwtRefreshPath := tlsclient.DefaultJWTRefreshPath
 
+	srv.httpAuthenticator = NewHttpAuthenticator(verifyUsernamePassword)
+	srv.router.HandleFunc(jwtLoginPath, srv.httpAuthenticator.JwtAuth.HandleJWTLogin)
+	srv.router.HandleFunc(hwtRefreshPath, srv.httpAuthenticator.JwtAuth.HandleJWTRefresh)
+	srv.router.HandleFunc(DefaultJWTCertLoginPath, srv.httpAuthenticator.HandleJWTCertLogin)
+	if srv.metrics != nil {
+		srv.httpAuthenticator.SetMetrics(srv.metrics)
+	}
+}
+
+// EnableOCSPStapling staples an OCSP response for the server certificate in the TLS handshake.
+// This must be called before Start.
+//
+// If the CA key is provided, the server signs its own OCSP responses. If a revocation check is
+// also provided, the server serves the OCSP responder endpoint on DefaultOCSPPath, so clients can
+// verify certificates issued by the hub CA. Without revocation check the responder is not served
+// as it would report revoked certificates as good.
+// Without CA key the response is fetched from the OCSP server listed in the server certificate.
+//
+//  caKey is the hub CA key for signing responses, or nil to fetch responses
+//  isRevoked is the callback that determines if a certificate is revoked, eg certsetup.IsRevoked, or nil
+//  validity of the OCSP response, or 0 for DefaultOCSPValidity. Responses are refreshed at half this time.
+func (srv *TLSServer) EnableOCSPStapling(caKey crypto.Signer,
+	isRevoked func(serialNumber *big.Int) (revoked bool, revokedAt time.Time),
+	validity time.Duration) error {
+
+	stapler, err := NewOCSPStapler(srv.serverCert, srv.caCert, caKey, validity)
+	if err != nil {
+		logrus.Errorf("TLSServer.EnableOCSPStapling: %s", err)
+		return err
+	}
+	stapler.SetRevocationCheck(isRevoked)
+	srv.ocspStapler = stapler
+	if caKey != nil && isRevoked != nil {
+		// OCSP requests are not authenticated
+		srv.router.PathPrefix(DefaultOCSPPath).HandlerFunc(stapler.HandleOCSPRequest)
+	} else if caKey != nil {
+		logrus.Warningf("TLSServer.EnableOCSPStapling: no revocation check. The OCSP responder is not served.")
+	}
+	return nil
+}
+
+// SetIdentityProviders replaces the identity providers, including the default password and
+// client certificate providers. Use this to limit the authentication methods of a deployment.
+// This enables authentication if no authenticator was provided to NewTLSServer. In that case call
+// this before adding handlers.
+func (srv *TLSServer) SetIdentityProviders(providers ...IIdentityProvider) {
+	if srv.httpAuthenticator == nil {
+		srv.enableAuthentication(nil)
+	}
+	srv.httpAuthenticator.SetIdentityProviders(providers...)
+}
+
+// createTLSConfig returns the TLS configuration of the main listener
+func (srv *TLSServer) createTLSConfig() *tls.Config {
+	return srv.createListenerTLSConfig(ListenerOptions{
+		RequireClientCert: srv.requireClientCert,
+		ExternalCert:      true,
+	})
+}
+
+// createListenerTLSConfig returns the TLS configuration with the server certificate that accepts
+// client certificates signed by the CA or one of the additional client CAs
+//  options with the client certificate policy and whether to serve an external certificate
+func (srv *TLSServer) createListenerTLSConfig(options ListenerOptions) *tls.Config {
 	caCertPool := x509.NewCertPool()
 	caCertPool.AddCert(srv.caCert)
+	for _, clientCA := range srv.clientCAs {
+		caCertPool.AddCert(clientCA)
+	}
 
+	clientAuth := tls.VerifyClientCertIfGiven
+	if options.RequireClientCert {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
 	serverTLSConf := &tls.Config{
-		Certificates:       []tls.Certificate{*srv.serverCert},
-		ClientAuth:         tls.VerifyClientCertIfGiven,
+		ClientAuth:         clientAuth,
 		ClientCAs:          caCertPool,
 		MinVersion:         tls.VersionTLS12,
 		InsecureSkipVerify: false,
 	}
+	if options.ExternalCert && srv.useExternalCertConfig(serverTLSConf) {
+		return serverTLSConf
+	}
+	if srv.ocspStapler != nil {
+		// the stapler provides the server certificate with the current OCSP response
+		serverTLSConf.GetCertificate = srv.ocspStapler.GetCertificate
+	} else {
+		serverTLSConf.Certificates = []tls.Certificate{*srv.serverCert}
+	}
+	return serverTLSConf
+}
+
+// SetLoginFailureDelay sets the delay before a failed password login returns, to slow down
+// password guessing.
+//  delay of a failed login, or 0 to not delay
+// Returns an error if authentication is not enabled
+func (srv *TLSServer) SetLoginFailureDelay(delay time.Duration) error {
+	if srv.httpAuthenticator == nil {
+		err := fmt.Errorf("TLSServer.SetLoginFailureDelay: authentication is not enabled")
+		logrus.Error(err)
+		return err
+	}
+	srv.httpAuthenticator.SetLoginFailureDelay(delay)
+	return nil
+}
+
+// SetTokenValidity changes the validity of new JWT access and refresh tokens at runtime.
+// This has no effect if authentication is not enabled.
+//  accessValidity of new access tokens, or 0 for DefaultAccessTokenValidity
+//  refreshValidity of new refresh tokens and sessions, or 0 for DefaultRefreshTokenValidity
+func (srv *TLSServer) SetTokenValidity(accessValidity time.Duration, refreshValidity time.Duration) {
+	if srv.httpAuthenticator != nil {
+		srv.httpAuthenticator.JwtAuth.SetTokenValidity(accessValidity, refreshValidity)
+	}
+}
+
+// SetRequireClientCert sets whether all clients must present a certificate signed by the CA.
+// By default the server requests but doesn't require a client certificate. A required certificate
+// is enforced in the TLS handshake, so clients without certificate fail to connect and receive no
+// HTTP response. Use AddClientCertHandler to require certificates for specific routes instead.
+// This must be called before Start.
+//  require is true to reject connections without a valid client certificate
+func (srv *TLSServer) SetRequireClientCert(require bool) {
+	srv.requireClientCert = require
+}
+
+// Start the TLS server using the provided CA and Server certificates.
+// The server will request but not require a client certificate unless SetRequireClientCert is used.
+// If one is provided it must be valid.
+func (srv *TLSServer) Start() error {
+	// JoinHostPort brackets IPv6 addresses
+	addr := net.JoinHostPort(srv.address, strconv.FormatUint(uint64(srv.port), 10))
+	logrus.Infof("Starting TLS server on address: %s", addr)
+	hasExternalCert := srv.certReloader != nil || srv.autocertManager != nil
+	if srv.caCert == nil || (srv.serverCert == nil && !hasExternalCert) {
+		err := fmt.Errorf("missing CA or server certificate")
+		logrus.Error(err)
+		return err
+	}
+	if srv.certReloader != nil {
+		err := srv.certReloader.Start()
+		if err != nil {
+			logrus.Errorf("TLSServer.Start: unable to watch the external certificate: %s", err)
+			return err
+		}
+	}
 
-	srv.httpServer = &http.Server{
-		Addr: fmt.Sprintf("%s:%d", srv.address, srv.port),
-		// ReadTimeout:  5 * time.Minute, // 5 min to allow for delays when 'curl' on OSx prompts for username/password
-		// WriteTimeout: 10 * time.Second,
-		Handler:   srv.router,
-		TLSConfig: serverTLSConf,
+	if srv.ocspStapler != nil {
+		// the handshake succeeds without staple, the stapler retries at the next refresh
+		if err := srv.ocspStapler.Start(); err != nil {
+			logrus.Warningf("TLSServer.Start: no OCSP response to staple: %s", err)
+		}
+	}
+	httpServer, httpListener, err := srv.serveTLS(addr, srv.createTLSConfig())
+	if err != nil {
+		srv.Stop()
+		return err
+	}
+	srv.httpServer = httpServer
+	srv.httpListener = httpListener
+	err = srv.startListeners()
+	if err != nil {
+		srv.Stop()
+		return err
+	}
+	return nil
+}
+
+// serveTLS serves the handlers with TLS on the given address
+// This listens before returning so the server is ready to accept connections and listen errors,
+// like a port that is in use, are reported to the caller.
+//  addr is the host:port to listen on
+//  serverTLSConf with the server certificate and client certificate policy
+// Returns the server and its listener, which must be closed after shutting down the server
+func (srv *TLSServer) serveTLS(addr string, serverTLSConf *tls.Config) (*http.Server, net.Listener, error) {
+	httpServer := srv.newHTTPServer(addr)
+	httpServer.TLSConfig = serverTLSConf
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		err = fmt.Errorf("TLSServer.Start: %s", err)
+		logrus.Error(err)
+		return nil, nil, err
 	}
-	// mutex to capture error result in case startup in the background failed
 	go func() {
 		// serverTLSConf contains certificate and key
-		err2 := srv.httpServer.ListenAndServeTLS("", "")
+		err2 := httpServer.ServeTLS(listener, "", "")
 		if err2 != nil && err2 != http.ErrServerClosed {
-			err = fmt.Errorf("TLSServer.Start: ListenAndServeTLS: %s", err2)
-			logrus.Error(err)
+			logrus.Errorf("TLSServer.Start: ServeTLS: %s", err2)
 		}
 	}()
-	// Make sure the server is listening before continuing
-	time.Sleep(time.Second)
-	return err
+	return httpServer, listener, nil
 }
 
 // Stop the TLS server and close all connections
 func (srv *TLSServer) Stop() {
 	logrus.Infof("TLSServer.Stop: Stopping TLS server")
+	// abort running requests so the shutdown doesn't wait for long-running handlers
+	srv.cancelRequests()
+	srv.requestCtx, srv.cancelRequests = context.WithCancel(context.Background())
 
 	if srv.httpServer != nil {
 		srv.httpServer.Shutdown(context.Background())
+		// Shutdown doesn't close the listener if the server hasn't started serving yet
+		_ = srv.httpListener.Close()
+		srv.httpServer = nil
+	}
+	srv.stopListeners()
+	srv.stopUnixSocket()
+	if srv.certReloader != nil {
+		srv.certReloader.Stop()
+	}
+	if srv.ocspStapler != nil {
+		srv.ocspStapler.Stop()
 	}
 }
 
@@ -116,7 +349,7 @@ func (srv *TLSServer) Stop() {
 // The authenticator is optional to authenticate and authorize each of the requests. It returns
 // an error if auth fails, after it writes the error message to the ResponseWriter.
 //
-//  address          server listening address
+//  address          server listening IPv4 or IPv6 address. Use "" to listen on all IPv4 and IPv6 addresses (dual-stack)
 //  port             listening port
 //  caCertPath       CA certificate
 //  serverCertPath   Server certificate of this server
@@ -127,20 +360,14 @@ func (srv *TLSServer) Stop() {
 func NewTLSServer(address string, port uint,
 	serverCert *tls.Certificate, caCert *x509.Certificate,
 	authenticator func(userID, secret string) bool) *TLSServer {
-	// for now the JWT login path is fixed. Once a use-case comes up that requires something configurable
-	// this can be updated.
-	jwtLoginPath := tlsclient.DefaultJWTLoginPath
-	hwtRefreshPath := tlsclient.DefaultJWTRefreshPath
-
 	srv := &TLSServer{
 		router:     mux.NewRouter(),
 		caCert:     caCert,
 		serverCert: serverCert,
 	}
+	srv.requestCtx, srv.cancelRequests = context.WithCancel(context.Background())
 	if authenticator != nil {
-		srv.httpAuthenticator = NewHttpAuthenticator(authenticator)
-		srv.router.HandleFunc(jwtLoginPath, srv.httpAuthenticator.JwtAuth.HandleJWTLogin)
-		srv.router.HandleFunc(hwtRefreshPath, srv.httpAuthenticator.JwtAuth.HandleJWTRefresh)
+		srv.enableAuthentication(authenticator)
 	}
 	srv.address = address
 	srv.port = port
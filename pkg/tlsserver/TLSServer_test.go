@@ -1,16 +1,27 @@
 package tlsserver_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/wostzone/hubclient-go/pkg/certs"
 	"github.com/wostzone/hubclient-go/pkg/testenv"
 	"github.com/wostzone/hubclient-go/pkg/tlsclient"
 	"github.com/wostzone/hubserve-go/pkg/tlsserver"
@@ -49,11 +60,41 @@ func TestMain(m *testing.M) {
 func TestStartStop(t *testing.T) {
 	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
 		testCerts.ServerCert, testCerts.CaCert, nil)
+	t1 := time.Now()
 	err := srv.Start()
 	assert.NoError(t, err)
+	// the server must be listening when Start returns, without a settle delay
+	assert.Less(t, int64(time.Since(t1)), int64(100*time.Millisecond))
+	conn, err := net.Dial("tcp", clientHostPort)
+	require.NoError(t, err)
+	_ = conn.Close()
+
+	// a second server on the same port must fail
+	srv2 := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, nil)
+	err = srv2.Start()
+	assert.Error(t, err)
 	srv.Stop()
 }
 
+func TestDualStack(t *testing.T) {
+	srv := tlsserver.NewTLSServer("", serverPort,
+		testCerts.ServerCert, testCerts.CaCert, nil)
+	err := srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+
+	port := fmt.Sprint(serverPort)
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	require.NoError(t, err)
+	_ = conn.Close()
+	conn, err = net.Dial("tcp6", net.JoinHostPort("::1", port))
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %s", err)
+	}
+	_ = conn.Close()
+}
+
 func TestNoCA(t *testing.T) {
 	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
 		testCerts.ServerCert, nil, nil)
@@ -161,6 +202,278 @@ func TestCertAuth(t *testing.T) {
 }
 
 // Test valid authentication using JWT
+func TestAddClientCA(t *testing.T) {
+	path1 := "/hello"
+	// client certificate of another CA, eg the previous CA after a CA rotation
+	prevCerts := testenv.CreateCertBundle()
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, func(loginID1, password string) bool {
+			return false
+		})
+	srv.AddHandler(path1, func(string, http.ResponseWriter, *http.Request) {})
+	err := srv.Start()
+	require.NoError(t, err)
+	cl := tlsclient.NewTLSClient(clientHostPort, testCerts.CaCert)
+	err = cl.ConnectWithClientCert(prevCerts.PluginCert)
+	assert.NoError(t, err)
+	_, err = cl.Get(path1)
+	assert.Error(t, err, "client CA not accepted")
+	cl.Close()
+	srv.Stop()
+
+	srv = tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, func(loginID1, password string) bool {
+			return false
+		})
+	srv.AddClientCA(prevCerts.CaCert)
+	srv.AddHandler(path1, func(string, http.ResponseWriter, *http.Request) {})
+	err = srv.Start()
+	require.NoError(t, err)
+	cl = tlsclient.NewTLSClient(clientHostPort, testCerts.CaCert)
+	err = cl.ConnectWithClientCert(prevCerts.PluginCert)
+	assert.NoError(t, err)
+	_, err = cl.Get(path1)
+	assert.NoError(t, err)
+	cl.Close()
+	srv.Stop()
+}
+
+func TestClientCertRequired(t *testing.T) {
+	pluginPath := "/plugin"
+	consumerPath := "/consumer"
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, nil)
+	srv.AddClientCertHandler(pluginPath, func(string, http.ResponseWriter, *http.Request) {})
+	srv.AddHandler(consumerPath, func(string, http.ResponseWriter, *http.Request) {})
+	err := srv.Start()
+	require.NoError(t, err)
+
+	// routes that require a certificate explain why the request is rejected
+	caPool := x509.NewCertPool()
+	caPool.AddCert(testCerts.CaCert)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caPool}}}
+	resp, err := httpClient.Get(fmt.Sprintf("https://%s%s", clientHostPort, pluginPath))
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, tlsserver.ProblemContentType, resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), "requires a client certificate")
+	resp, err = httpClient.Get(fmt.Sprintf("https://%s%s", clientHostPort, consumerPath))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	cl := tlsclient.NewTLSClient(clientHostPort, testCerts.CaCert)
+	err = cl.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	_, err = cl.Get(pluginPath)
+	assert.NoError(t, err)
+	cl.Close()
+	srv.Stop()
+
+	// the server can require certificates for all connections
+	srv = tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, nil)
+	srv.SetRequireClientCert(true)
+	srv.AddHandler(consumerPath, func(string, http.ResponseWriter, *http.Request) {})
+	err = srv.Start()
+	require.NoError(t, err)
+	_, err = httpClient.Get(fmt.Sprintf("https://%s%s", clientHostPort, consumerPath))
+	assert.Error(t, err)
+	cl = tlsclient.NewTLSClient(clientHostPort, testCerts.CaCert)
+	err = cl.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	_, err = cl.Get(consumerPath)
+	assert.NoError(t, err)
+	cl.Close()
+	srv.Stop()
+}
+
+func TestExternalCert(t *testing.T) {
+	path1 := "/hello"
+	tempFolder, _ := ioutil.TempDir("", "wost-externalcert")
+	defer os.RemoveAll(tempFolder)
+	certPath := path.Join(tempFolder, "fullchain.pem")
+	keyPath := path.Join(tempFolder, "privkey.pem")
+	// certificates of a public CA
+	publicCerts := testenv.CreateCertBundle()
+	renewedCerts := testenv.CreateCertBundle()
+	err := certs.SaveTLSCertToPEM(publicCerts.ServerCert, certPath, keyPath)
+	require.NoError(t, err)
+
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort, nil, testCerts.CaCert, nil)
+	err = srv.UseExternalCert(path.Join(tempFolder, "missing.pem"), keyPath)
+	assert.Error(t, err)
+	err = srv.UseExternalCert(certPath, keyPath)
+	require.NoError(t, err)
+	srv.AddHandler(path1, func(string, http.ResponseWriter, *http.Request) {})
+	err = srv.Start()
+	require.NoError(t, err)
+
+	// client certificates of the Hub CA are still accepted
+	cl := tlsclient.NewTLSClient(clientHostPort, publicCerts.CaCert)
+	err = cl.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	_, err = cl.Get(path1)
+	assert.NoError(t, err)
+	cl.Close()
+
+	// the renewed certificate is served without restart
+	err = certs.SaveTLSCertToPEM(renewedCerts.ServerCert, certPath, keyPath)
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond * 300)
+	cl = tlsclient.NewTLSClient(clientHostPort, renewedCerts.CaCert)
+	err = cl.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	_, err = cl.Get(path1)
+	assert.NoError(t, err)
+	cl.Close()
+	srv.Stop()
+}
+
+func TestExternalCertSymlinkRenewal(t *testing.T) {
+	// certbot layout where the live files are symlinks to files in the archive folder
+	tempFolder, _ := ioutil.TempDir("", "wost-certbot")
+	defer os.RemoveAll(tempFolder)
+	archiveFolder := path.Join(tempFolder, "archive")
+	liveFolder := path.Join(tempFolder, "live")
+	_ = os.Mkdir(archiveFolder, 0700)
+	_ = os.Mkdir(liveFolder, 0700)
+	certPath := path.Join(liveFolder, "fullchain.pem")
+	keyPath := path.Join(liveFolder, "privkey.pem")
+	publicCerts := testenv.CreateCertBundle()
+	renewedCerts := testenv.CreateCertBundle()
+	// replace the symlinks the way certbot does, by renaming a new symlink over the old one
+	linkCerts := func(bundle testenv.TestCerts, version int) {
+		archiveCert := path.Join(archiveFolder, fmt.Sprintf("fullchain%d.pem", version))
+		archiveKey := path.Join(archiveFolder, fmt.Sprintf("privkey%d.pem", version))
+		err := certs.SaveTLSCertToPEM(bundle.ServerCert, archiveCert, archiveKey)
+		require.NoError(t, err)
+		for target, link := range map[string]string{archiveCert: certPath, archiveKey: keyPath} {
+			err = os.Symlink(target, link+".new")
+			if err != nil {
+				t.Skipf("symlinks are not supported: %s", err)
+			}
+			err = os.Rename(link+".new", link)
+			require.NoError(t, err)
+		}
+	}
+	linkCerts(publicCerts, 1)
+
+	reloader, err := tlsserver.NewCertReloader(certPath, keyPath)
+	require.NoError(t, err)
+	err = reloader.Start()
+	require.NoError(t, err)
+	defer reloader.Stop()
+	cert, _ := reloader.GetCertificate(nil)
+	assert.Equal(t, publicCerts.ServerCert.Certificate[0], cert.Certificate[0])
+
+	linkCerts(renewedCerts, 2)
+	time.Sleep(time.Millisecond * 300)
+	cert, _ = reloader.GetCertificate(nil)
+	assert.Equal(t, renewedCerts.ServerCert.Certificate[0], cert.Certificate[0])
+}
+
+func TestDualListener(t *testing.T) {
+	path1 := "/hello"
+	pluginPort := serverPort + 1
+	pluginHostPort := fmt.Sprintf("%s:%d", serverAddress, pluginPort)
+	tempFolder, _ := ioutil.TempDir("", "wost-duallistener")
+	defer os.RemoveAll(tempFolder)
+	certPath := path.Join(tempFolder, "fullchain.pem")
+	keyPath := path.Join(tempFolder, "privkey.pem")
+	publicCerts := testenv.CreateCertBundle()
+	err := certs.SaveTLSCertToPEM(publicCerts.ServerCert, certPath, keyPath)
+	require.NoError(t, err)
+
+	// public port with an external certificate and the plugin port with mutual TLS
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort, testCerts.ServerCert, testCerts.CaCert, nil)
+	err = srv.UseExternalCert(certPath, keyPath)
+	require.NoError(t, err)
+	srv.AddListener(serverAddress, pluginPort, tlsserver.ListenerOptions{RequireClientCert: true})
+	srv.AddHandler(path1, func(string, http.ResponseWriter, *http.Request) {})
+	err = srv.Start()
+	require.NoError(t, err)
+
+	publicPool := x509.NewCertPool()
+	publicPool.AddCert(publicCerts.CaCert)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: publicPool}}}
+	resp, err := httpClient.Get(fmt.Sprintf("https://%s%s", clientHostPort, path1))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	cl := tlsclient.NewTLSClient(pluginHostPort, testCerts.CaCert)
+	err = cl.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	_, err = cl.Get(path1)
+	assert.NoError(t, err)
+	cl.Close()
+
+	// the plugin port requires a client certificate
+	hubPool := x509.NewCertPool()
+	hubPool.AddCert(testCerts.CaCert)
+	httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: hubPool}}}
+	_, err = httpClient.Get(fmt.Sprintf("https://%s%s", pluginHostPort, path1))
+	assert.Error(t, err)
+	srv.Stop()
+
+	// a listener that cannot listen fails the start
+	srv = tlsserver.NewTLSServer(serverAddress, serverPort, testCerts.ServerCert, testCerts.CaCert, nil)
+	srv.AddListener(serverAddress, serverPort, tlsserver.ListenerOptions{})
+	err = srv.Start()
+	assert.Error(t, err)
+	srv.Stop()
+}
+
+func TestRequestContext(t *testing.T) {
+	path1 := "/history"
+	started := make(chan bool, 1)
+	aborted := make(chan error, 1)
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort, testCerts.ServerCert, testCerts.CaCert, nil)
+	srv.SetTimeouts(tlsserver.ServerTimeouts{ReadHeaderTimeout: time.Second, IdleTimeout: time.Minute})
+	srv.AddHandlerCtx(path1, func(ctx context.Context, userID string, resp http.ResponseWriter, req *http.Request) {
+		started <- true
+		select {
+		case <-ctx.Done():
+			aborted <- ctx.Err()
+		case <-time.After(5 * time.Second):
+			aborted <- nil
+		}
+	})
+	err := srv.Start()
+	require.NoError(t, err)
+
+	// a client that disconnects aborts the handler
+	caPool := x509.NewCertPool()
+	caPool.AddCert(testCerts.CaCert)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caPool}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	req, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://%s%s", clientHostPort, path1), nil)
+	_, err = httpClient.Do(req)
+	cancel()
+	assert.Error(t, err)
+	<-started
+	select {
+	case err = <-aborted:
+		assert.Error(t, err, "handler context is cancelled")
+	case <-time.After(time.Second):
+		assert.Fail(t, "handler wasn't aborted")
+	}
+
+	// stopping the server aborts running handlers
+	go func() {
+		_, _ = httpClient.Get(fmt.Sprintf("https://%s%s", clientHostPort, path1))
+	}()
+	<-started
+	t1 := time.Now()
+	srv.Stop()
+	assert.Less(t, int64(time.Since(t1)), int64(time.Second))
+	err = <-aborted
+	assert.Error(t, err)
+}
+
 func TestJWTLogin(t *testing.T) {
 	user1 := "user1"
 	user1Pass := "pass1"
@@ -282,6 +595,99 @@ func TestQueryParams(t *testing.T) {
 	srv.Stop()
 }
 
+func TestPagination(t *testing.T) {
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, nil)
+	allowed := []string{"name", "deviceType"}
+
+	req := httptest.NewRequest("GET", "/things?offset=20&limit=5000&sort=-name&filter.deviceType=sensor", nil)
+	offset, limit, err := srv.GetPagination(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, offset)
+	assert.Equal(t, tlsserver.MaxPageLimit, limit)
+	field, descending, err := srv.GetSort(req, allowed, "name")
+	assert.NoError(t, err)
+	assert.Equal(t, "name", field)
+	assert.True(t, descending)
+	filter, err := srv.GetFilter(req, allowed)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"deviceType": "sensor"}, filter)
+
+	// defaults
+	req = httptest.NewRequest("GET", "/things", nil)
+	offset, limit, err = srv.GetPagination(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, offset)
+	assert.Equal(t, tlsserver.DefaultPageLimit, limit)
+	field, descending, err = srv.GetSort(req, allowed, "name")
+	assert.NoError(t, err)
+	assert.Equal(t, "name", field)
+	assert.False(t, descending)
+	// the default field must be allowed
+	_, _, err = srv.GetSort(req, allowed, "id")
+	assert.Error(t, err)
+	filter, err = srv.GetFilter(req, allowed)
+	assert.NoError(t, err)
+	assert.Empty(t, filter)
+
+	// invalid parameters
+	for _, query := range []string{"offset=-1", "limit=0", "limit=abc"} {
+		req = httptest.NewRequest("GET", "/things?"+query, nil)
+		_, _, err = srv.GetPagination(req)
+		assert.Error(t, err, query)
+	}
+	req = httptest.NewRequest("GET", "/things?sort=secret&filter.secret=1", nil)
+	_, _, err = srv.GetSort(req, allowed, "name")
+	assert.Error(t, err)
+	_, err = srv.GetFilter(req, allowed)
+	assert.Error(t, err)
+	for _, query := range []string{"sort=-", "sort="} {
+		req = httptest.NewRequest("GET", "/things?"+query, nil)
+		_, _, err = srv.GetSort(req, allowed, "name")
+		assert.Error(t, err, query)
+	}
+}
+
+func TestWriteJSONWithETag(t *testing.T) {
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, nil)
+	td := map[string]string{"id": "thing1", "title": "my thing"}
+
+	req := httptest.NewRequest("GET", "/things/thing1", nil)
+	resp := httptest.NewRecorder()
+	err := srv.WriteJSONWithETag(resp, req, td)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	etag := resp.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Contains(t, resp.Body.String(), "thing1")
+
+	// unchanged content is not sent again
+	req = httptest.NewRequest("GET", "/things/thing1", nil)
+	req.Header.Set("If-None-Match", `"other", W/`+etag)
+	resp = httptest.NewRecorder()
+	err = srv.WriteJSONWithETag(resp, req, td)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotModified, resp.Code)
+	assert.Empty(t, resp.Body.Bytes())
+
+	// changed content is sent
+	td["title"] = "new title"
+	req = httptest.NewRequest("GET", "/things/thing1", nil)
+	req.Header.Set("If-None-Match", etag)
+	resp = httptest.NewRecorder()
+	err = srv.WriteJSONWithETag(resp, req, td)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NotEqual(t, etag, resp.Header().Get("ETag"))
+
+	// values that cannot be marshalled
+	resp = httptest.NewRecorder()
+	err = srv.WriteJSONWithETag(resp, req, make(chan int))
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+}
+
 func TestWriteResponse(t *testing.T) {
 	path2 := "/hello"
 	path2Hit := 0
@@ -362,3 +768,328 @@ func TestBasicAuth(t *testing.T) {
 	cl.Close()
 	srv.Stop()
 }
+
+func TestClientCertificate(t *testing.T) {
+	path1 := "/hello"
+	path1Hit := 0
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, nil)
+	err := srv.Start()
+	assert.NoError(t, err)
+	pluginCert, _ := x509.ParseCertificate(testCerts.PluginCert.Certificate[0])
+	srv.AddHandler(path1, func(userID string, resp http.ResponseWriter, req *http.Request) {
+		clientCert := tlsserver.GetClientCertificate(req)
+		require.NotNil(t, clientCert)
+		assert.Equal(t, pluginCert.Subject.CommonName, clientCert.Subject.CommonName)
+		assert.Equal(t, pluginCert.Subject.OrganizationalUnit[0], tlsserver.GetClientOU(req))
+		path1Hit++
+	})
+
+	cl := tlsclient.NewTLSClient(clientHostPort, testCerts.CaCert)
+	err = cl.ConnectWithClientCert(testCerts.PluginCert)
+	assert.NoError(t, err)
+	_, err = cl.Get(path1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, path1Hit)
+	cl.Close()
+	srv.Stop()
+
+	// without client certificate
+	req, _ := http.NewRequest("GET", path1, nil)
+	assert.Nil(t, tlsserver.GetClientCertificate(req))
+	assert.Empty(t, tlsserver.GetClientOU(req))
+}
+
+func TestWriteProblem(t *testing.T) {
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, nil)
+
+	resp := httptest.NewRecorder()
+	srv.WriteNotFound(resp, "thing not found")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Equal(t, tlsserver.ProblemContentType, resp.Header().Get("Content-Type"))
+	problem := tlsserver.ProblemDetails{}
+	err := json.Unmarshal(resp.Body.Bytes(), &problem)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, problem.Status)
+	assert.Equal(t, "Not Found", problem.Title)
+	assert.Equal(t, "thing not found", problem.Detail)
+	assert.NotEmpty(t, problem.CorrelationID)
+
+	// the trace ID is used as correlation ID
+	req := httptest.NewRequest("GET", "/things/thing1", nil)
+	tc := tlsserver.NewTraceContext("")
+	req = req.WithContext(context.WithValue(req.Context(), tlsserver.TraceContextKey, tc))
+	resp = httptest.NewRecorder()
+	srv.WriteProblem(resp, req, http.StatusConflict, "thing exists")
+	problem = tlsserver.ProblemDetails{}
+	err = json.Unmarshal(resp.Body.Bytes(), &problem)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Equal(t, "/things/thing1", problem.Instance)
+	assert.Equal(t, tc.TraceID, problem.CorrelationID)
+}
+
+func TestReadJSONBody(t *testing.T) {
+	type Body struct {
+		Name string `json:"name"`
+	}
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, nil)
+
+	body := Body{}
+	req := httptest.NewRequest("POST", "/hello", strings.NewReader(`{"name":"bob"}`))
+	resp := httptest.NewRecorder()
+	err := srv.ReadJSONBody(resp, req, &body, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", body.Name)
+
+	// unknown fields are rejected
+	req = httptest.NewRequest("POST", "/hello", strings.NewReader(`{"name":"bob","age":3}`))
+	resp = httptest.NewRecorder()
+	err = srv.ReadJSONBody(resp, req, &body, 0)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// trailing data is rejected
+	req = httptest.NewRequest("POST", "/hello", strings.NewReader(`{"name":"bob"}{}`))
+	resp = httptest.NewRecorder()
+	err = srv.ReadJSONBody(resp, req, &body, 0)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// body too large
+	req = httptest.NewRequest("POST", "/hello", strings.NewReader(`{"name":"bobbobbobbob"}`))
+	resp = httptest.NewRecorder()
+	err = srv.ReadJSONBody(resp, req, &body, 10)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+}
+
+func TestIdentityProviders(t *testing.T) {
+	path1 := "/hello"
+	apiKey := "key1"
+	var lastUserID string
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, nil)
+	srv.AddIdentityProvider(tlsserver.NewStaticKeyIdentityProvider(map[string]string{apiKey: "script1"}))
+	srv.AddHandler(path1, func(userID string, resp http.ResponseWriter, req *http.Request) {
+		lastUserID = userID
+	})
+	err := srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+	cl := newHttpsClient()
+
+	// API key as bearer token
+	req, _ := http.NewRequest("GET", "https://"+clientHostPort+path1, nil)
+	req.Header.Set("Authorization", "bearer "+apiKey)
+	resp, err := cl.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "script1", lastUserID)
+
+	// invalid key
+	req.Header.Set("Authorization", "bearer badkey")
+	resp, err = cl.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// plugin certificate is accepted by default
+	tlsCl := tlsclient.NewTLSClient(clientHostPort, testCerts.CaCert)
+	_ = tlsCl.ConnectWithClientCert(testCerts.PluginCert)
+	_, err = tlsCl.Get(path1)
+	assert.NoError(t, err)
+
+	// but not when only admin certificates are allowed
+	srv.SetIdentityProviders(tlsserver.NewCertIdentityProvider("admin"))
+	_, err = tlsCl.Get(path1)
+	assert.Error(t, err)
+	tlsCl.Close()
+}
+
+func TestLoginSettingsRequireAuthentication(t *testing.T) {
+	// login settings don't enable authentication
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, nil)
+	err := srv.SetLoginFailureDelay(time.Second)
+	assert.Error(t, err)
+	err = srv.AddLoginPolicy(tlsserver.NewMinLengthPolicy(8))
+	assert.Error(t, err)
+
+	srv = tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, func(loginID, password string) bool { return false })
+	err = srv.SetLoginFailureDelay(time.Second)
+	assert.NoError(t, err)
+	err = srv.AddLoginPolicy(tlsserver.NewMinLengthPolicy(8))
+	assert.NoError(t, err)
+}
+
+// emailIdentityProvider maps the email address used as loginID to a userID
+type emailIdentityProvider struct {
+	tlsserver.PasswordIdentityProvider
+}
+
+func (provider *emailIdentityProvider) VerifyPassword(loginID string, password string) (string, bool) {
+	if loginID == "user1@example.com" && password == "pass1" {
+		return "user1", true
+	}
+	return "", false
+}
+
+func TestPasswordProviderUserID(t *testing.T) {
+	hauth := tlsserver.NewHttpAuthenticator(nil)
+	hauth.AddIdentityProvider(&emailIdentityProvider{})
+
+	// basic authentication identifies the user by the provider's userID
+	req := httptest.NewRequest("GET", "/hello", nil)
+	req.SetBasicAuth("user1@example.com", "pass1")
+	userID, match := hauth.AuthenticateRequest(httptest.NewRecorder(), req)
+	assert.True(t, match)
+	assert.Equal(t, "user1", userID)
+	req.SetBasicAuth("user1@example.com", "badpass")
+	_, match = hauth.AuthenticateRequest(httptest.NewRecorder(), req)
+	assert.False(t, match)
+
+	// so does the JWT login session
+	body, _ := json.Marshal(tlsserver.JWTLoginCredentials{Username: "user1@example.com", Password: "pass1"})
+	req = httptest.NewRequest("POST", "/login", bytes.NewReader(body))
+	resp := httptest.NewRecorder()
+	hauth.JwtAuth.HandleJWTLogin(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+	tokens := tlsclient.JwtAuthResponse{}
+	err := json.Unmarshal(resp.Body.Bytes(), &tokens)
+	require.NoError(t, err)
+	_, claims, err := hauth.JwtAuth.DecodeToken(tokens.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", claims.Username)
+	assert.Equal(t, 1, len(hauth.JwtAuth.ListSessions("user1")))
+}
+
+func TestAPIKeyStore(t *testing.T) {
+	path1 := "/hello"
+	var lastUserID string
+	var lastOU string
+	storePath := path.Join(os.TempDir(), "tlsserver-apikeys.json")
+	_ = os.Remove(storePath)
+	defer os.Remove(storePath)
+
+	keyStore, err := tlsserver.NewAPIKeyStore(storePath)
+	require.NoError(t, err)
+	key1, info1, err := keyStore.CreateKey("script1", "client")
+	require.NoError(t, err)
+	_, _, err = keyStore.CreateKey("", "client")
+	assert.Error(t, err)
+
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, nil)
+	srv.AddIdentityProvider(keyStore)
+	srv.AddHandler(path1, func(userID string, resp http.ResponseWriter, req *http.Request) {
+		lastUserID = userID
+		info, _ := keyStore.VerifyRequest(req)
+		lastOU = info.OU
+	})
+	err = srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+	cl := newHttpsClient()
+
+	req, _ := http.NewRequest("GET", "https://"+clientHostPort+path1, nil)
+	req.Header.Set(tlsserver.APIKeyHeader, key1)
+	resp, err := cl.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "script1", lastUserID)
+	assert.Equal(t, "client", lastOU)
+
+	// keys are persisted
+	keyStore2, err := tlsserver.NewAPIKeyStore(storePath)
+	require.NoError(t, err)
+	info, valid := keyStore2.VerifyKey(key1)
+	assert.True(t, valid)
+	assert.Equal(t, "client", info.OU)
+
+	// after rotation the old key is invalid
+	key2, err := keyStore.RotateKey(info1.KeyID)
+	require.NoError(t, err)
+	resp, err = cl.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, valid = keyStore.VerifyKey(key2)
+	assert.True(t, valid)
+
+	// removed keys are invalid
+	assert.Equal(t, 1, len(keyStore.ListKeys("script1")))
+	err = keyStore.RemoveKey(info1.KeyID)
+	assert.NoError(t, err)
+	_, valid = keyStore.VerifyKey(key2)
+	assert.False(t, valid)
+	err = keyStore.RemoveKey(info1.KeyID)
+	assert.Error(t, err)
+	_, err = keyStore.RotateKey(info1.KeyID)
+	assert.Error(t, err)
+
+	// concurrent changes are all saved
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, err := keyStore.CreateKey(fmt.Sprintf("script%d", i), "client")
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	keyStore2, err = tlsserver.NewAPIKeyStore(storePath)
+	require.NoError(t, err)
+	assert.Equal(t, 10, len(keyStore2.ListKeys("")))
+
+	// an empty key file
+	err = ioutil.WriteFile(storePath, []byte("null"), 0600)
+	require.NoError(t, err)
+	keyStore2, err = tlsserver.NewAPIKeyStore(storePath)
+	require.NoError(t, err)
+	_, _, err = keyStore2.CreateKey("script1", "client")
+	assert.NoError(t, err)
+}
+
+func TestUnixSocket(t *testing.T) {
+	path1 := "/hello"
+	path1Hit := 0
+	socketFolder, _ := ioutil.TempDir("", "tlsserver")
+	defer os.RemoveAll(socketFolder)
+	socketPath := path.Join(socketFolder, "hub.sock")
+
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, nil)
+	srv.AddHandler(path1, func(string, http.ResponseWriter, *http.Request) {
+		path1Hit++
+	})
+	err := srv.StartUnixSocket(socketPath, 0, false)
+	require.NoError(t, err)
+	info, err := os.Stat(socketPath)
+	require.NoError(t, err)
+	assert.Equal(t, tlsserver.DefaultUnixSocketPermissions, info.Mode().Perm())
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		},
+	}}
+	resp, err := client.Get("http://localhost" + path1)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, path1Hit)
+
+	srv.Stop()
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err))
+
+	err = srv.StartUnixSocket("/not/a/folder/hub.sock", 0, false)
+	assert.Error(t, err)
+}
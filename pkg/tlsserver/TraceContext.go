@@ -0,0 +1,125 @@
+package tlsserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TraceParentHeader is the W3C trace context header that identifies the trace and calling span
+const TraceParentHeader = "traceparent"
+
+// TraceContextKey is the request context key that holds the TraceContext
+const TraceContextKey contextKey = "traceContext"
+
+// TraceContext identifies the trace a request is part of, following the W3C trace context format.
+// This lets an operation be followed from a consumer through the hub to the Thing and back.
+type TraceContext struct {
+	// TraceID identifies the whole trace, 32 hex characters
+	TraceID string
+	// ParentID is the span ID of the caller, if any, 16 hex characters
+	ParentID string
+	// SpanID identifies the span of this server, 16 hex characters
+	SpanID string
+	// Sampled is set when the caller records the trace
+	Sampled bool
+}
+
+// Inject sets the traceparent header with this span as parent, for propagating the trace
+// to outgoing requests.
+func (tc TraceContext) Inject(header http.Header) {
+	header.Set(TraceParentHeader, tc.TraceParent())
+}
+
+// TraceParent returns the traceparent header value with this span as parent
+func (tc TraceContext) TraceParent() string {
+	flags := "00"
+	if tc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", tc.TraceID, tc.SpanID, flags)
+}
+
+// GetTraceContext returns the trace context of the request
+// Returns false if tracing is not enabled
+func GetTraceContext(req *http.Request) (TraceContext, bool) {
+	tc, found := req.Context().Value(TraceContextKey).(TraceContext)
+	return tc, found
+}
+
+// NewTraceContext returns the trace context for a request with the given traceparent header.
+// A new trace is started if the header is empty or invalid. A new span ID is always created.
+func NewTraceContext(traceParent string) TraceContext {
+	tc, err := ParseTraceParent(traceParent)
+	if err != nil {
+		if traceParent != "" {
+			logrus.Infof("NewTraceContext: ignoring traceparent: %s", err)
+		}
+		tc = TraceContext{TraceID: randomHex(16)}
+	}
+	tc.SpanID = randomHex(8)
+	return tc
+}
+
+// ParseTraceParent parses a traceparent header value
+// The span ID in the header is returned as the ParentID
+// Returns an error if the value is not a valid version 00 traceparent
+func ParseTraceParent(traceParent string) (tc TraceContext, err error) {
+	parts := strings.Split(strings.TrimSpace(traceParent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return tc, fmt.Errorf("invalid traceparent '%s'", traceParent)
+	} else if parts[0] == "00" && len(parts) != 4 {
+		return tc, fmt.Errorf("invalid traceparent '%s'", traceParent)
+	}
+	traceID, parentID, flags := parts[1], parts[2], parts[3]
+	if !isHex(traceID, 32) || !isHex(parentID, 16) || !isHex(flags, 2) ||
+		traceID == strings.Repeat("0", 32) || parentID == strings.Repeat("0", 16) {
+		return tc, fmt.Errorf("invalid traceparent '%s'", traceParent)
+	}
+	flagBits, _ := hex.DecodeString(flags)
+	tc = TraceContext{
+		TraceID:  traceID,
+		ParentID: parentID,
+		Sampled:  flagBits[0]&1 == 1,
+	}
+	return tc, nil
+}
+
+// EnableTracing adds the trace context to all requests. Handlers obtain it with GetTraceContext.
+// The trace of the caller is continued if the request has a valid traceparent header, otherwise
+// a new trace is started. The traceparent of the server span is returned in the response header.
+func (srv *TLSServer) EnableTracing() {
+	srv.router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			tc := NewTraceContext(req.Header.Get(TraceParentHeader))
+			resp.Header().Set(TraceParentHeader, tc.TraceParent())
+			ctx := context.WithValue(req.Context(), TraceContextKey, tc)
+			next.ServeHTTP(resp, req.WithContext(ctx))
+		})
+	})
+}
+
+// isHex returns true if the value is a lower case hex string of the given length
+func isHex(value string, length int) bool {
+	if len(value) != length {
+		return false
+	}
+	for _, c := range value {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// randomHex returns a random hex string from the given number of random bytes
+func randomHex(nrBytes int) string {
+	data := make([]byte, nrBytes)
+	_, _ = rand.Read(data)
+	return hex.EncodeToString(data)
+}
@@ -0,0 +1,75 @@
+package tlsserver_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wostzone/hubserve-go/pkg/tlsserver"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tc, err := tlsserver.ParseTraceParent(traceParent)
+	require.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", tc.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", tc.ParentID)
+	assert.True(t, tc.Sampled)
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, err = tlsserver.ParseTraceParent(invalid)
+		assert.Error(t, err, invalid)
+	}
+
+	// a new span continues the trace
+	tc = tlsserver.NewTraceContext(traceParent)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", tc.TraceID)
+	assert.Len(t, tc.SpanID, 16)
+	header := http.Header{}
+	tc.Inject(header)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+tc.SpanID+"-01", header.Get(tlsserver.TraceParentHeader))
+
+	// an invalid traceparent starts a new trace
+	tc = tlsserver.NewTraceContext("invalid")
+	assert.Len(t, tc.TraceID, 32)
+	assert.Empty(t, tc.ParentID)
+}
+
+func TestEnableTracing(t *testing.T) {
+	path1 := "/hello"
+	var handlerTC tlsserver.TraceContext
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert, nil)
+	srv.EnableTracing()
+	srv.AddHandler(path1, func(userID string, resp http.ResponseWriter, req *http.Request) {
+		var found bool
+		handlerTC, found = tlsserver.GetTraceContext(req)
+		assert.True(t, found)
+	})
+	err := srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+
+	req, _ := http.NewRequest("GET", "https://"+clientHostPort+path1, nil)
+	req.Header.Set(tlsserver.TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	resp, err := newHttpsClient().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", handlerTC.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", handlerTC.ParentID)
+	assert.Equal(t, handlerTC.TraceParent(), resp.Header.Get(tlsserver.TraceParentHeader))
+
+	// without tracing there is no trace context
+	req, _ = http.NewRequest("GET", path1, nil)
+	_, found := tlsserver.GetTraceContext(req)
+	assert.False(t, found)
+}
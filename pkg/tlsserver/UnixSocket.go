@@ -0,0 +1,80 @@
+package tlsserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultUnixSocketPermissions only allows the owner of the socket to connect
+const DefaultUnixSocketPermissions os.FileMode = 0600
+
+// StartUnixSocket serves the server handlers on a Unix domain socket, in addition to the TCP listener.
+// Co-located plugins can use this to avoid the TCP and TLS overhead. Access is controlled with the
+// file permissions of the socket, for example by giving plugins group access.
+//
+// Without TLS, requests cannot be authenticated with a client certificate. Handlers that require
+// authentication still accept password, token and API key authentication.
+//
+//  socketPath of the socket file. An existing socket file at this path is replaced.
+//  perm are the socket file permissions, or 0 for DefaultUnixSocketPermissions
+//  useTLS serves TLS on the socket using the server certificate, instead of plain HTTP
+// Returns an error if the socket cannot be created
+func (srv *TLSServer) StartUnixSocket(socketPath string, perm os.FileMode, useTLS bool) error {
+	logrus.Infof("TLSServer.StartUnixSocket: listening on %s, TLS=%v", socketPath, useTLS)
+	if perm == 0 {
+		perm = DefaultUnixSocketPermissions
+	}
+	if useTLS && (srv.caCert == nil || srv.serverCert == nil) {
+		err := fmt.Errorf("TLSServer.StartUnixSocket: missing CA or server certificate")
+		logrus.Error(err)
+		return err
+	}
+	// remove a socket file left behind by a previous run
+	if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(socketPath)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err == nil {
+		err = os.Chmod(socketPath, perm)
+		if err != nil {
+			_ = listener.Close()
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("TLSServer.StartUnixSocket: %s", err)
+		logrus.Error(err)
+		return err
+	}
+	srv.unixSocketPath = socketPath
+	srv.unixServer = srv.newHTTPServer("")
+	if useTLS {
+		srv.unixServer.TLSConfig = srv.createTLSConfig()
+	}
+	go func() {
+		var err2 error
+		if useTLS {
+			err2 = srv.unixServer.ServeTLS(listener, "", "")
+		} else {
+			err2 = srv.unixServer.Serve(listener)
+		}
+		if err2 != nil && err2 != http.ErrServerClosed {
+			logrus.Errorf("TLSServer.StartUnixSocket: %s", err2)
+		}
+	}()
+	return nil
+}
+
+// stopUnixSocket stops serving on the Unix domain socket and removes the socket file
+func (srv *TLSServer) stopUnixSocket() {
+	if srv.unixServer == nil {
+		return
+	}
+	_ = srv.unixServer.Shutdown(context.Background())
+	_ = os.Remove(srv.unixSocketPath)
+	srv.unixServer = nil
+}
@@ -0,0 +1,84 @@
+package tlsserver
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// contextKey is the type of context keys used by the server
+type contextKey string
+
+// ClientCertContextKey is the request context key that holds the verified client certificate
+const ClientCertContextKey contextKey = "clientCert"
+
+// AddClientCertHandler adds a new handler for a path that requires a client certificate signed by the CA.
+// Use this for plugin-only APIs on a server whose other routes accept JWT or password authentication.
+// Requests without a client certificate are rejected with 403 Forbidden and problem details explaining
+// that a certificate is required. Requests with a certificate are authenticated as with AddHandler.
+//
+//  path to listen on. This supports wildcards
+//  handler to invoke with the request. The userID is only provided when an authenticator is used
+func (srv *TLSServer) AddClientCertHandler(path string,
+	handler func(userID string, resp http.ResponseWriter, req *http.Request)) {
+
+	srv.router.HandleFunc(path, srv.clientCertRequiredHandler(path, srv.authenticatedHandler(path, handler)))
+}
+
+// GetClientCertificate returns the verified client certificate of the request, or nil if the client
+// did not authenticate with a certificate.
+// Handlers added with AddHandler can use this to obtain the CommonName, OU and SANs of the caller.
+func GetClientCertificate(req *http.Request) *x509.Certificate {
+	if cert, ok := req.Context().Value(ClientCertContextKey).(*x509.Certificate); ok {
+		return cert
+	}
+	return getVerifiedClientCert(req)
+}
+
+// GetClientOU returns the organizational unit of the verified client certificate of the request.
+// This can be used to differentiate between plugins, IoT devices and administrators, see certsetup.OUxxx.
+// Returns an empty string if no client certificate was used or it has no OU.
+func GetClientOU(req *http.Request) string {
+	cert := GetClientCertificate(req)
+	if cert == nil || len(cert.Subject.OrganizationalUnit) == 0 {
+		return ""
+	}
+	return cert.Subject.OrganizationalUnit[0]
+}
+
+// getVerifiedClientCert returns the client certificate from the TLS connection state if it is verified
+func getVerifiedClientCert(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
+
+// clientCertRequiredHandler returns a http handler that rejects requests without a verified client certificate
+//  path is the path of the handler, used for logging
+//  next is the handler to invoke with requests that include a client certificate
+func (srv *TLSServer) clientCertRequiredHandler(path string, next http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if getVerifiedClientCert(req) == nil {
+			logrus.Infof("TLSServer.clientCertRequiredHandler %s: request from %s without client certificate", path, req.RemoteAddr)
+			writeProblem(resp, req, http.StatusForbidden,
+				fmt.Sprintf("%s requires a client certificate signed by the Hub CA", req.URL.Path))
+			return
+		}
+		next(resp, req)
+	}
+}
+
+// withClientCertificate returns the request with the verified client certificate in its context
+// If no client certificate is used then the request is returned as-is.
+func withClientCertificate(req *http.Request) *http.Request {
+	cert := getVerifiedClientCert(req)
+	if cert == nil {
+		return req
+	}
+	ctx := context.WithValue(req.Context(), ClientCertContextKey, cert)
+	return req.WithContext(ctx)
+}
@@ -0,0 +1,64 @@
+package tlsserver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// ComputeETag returns a strong entity tag for the response content
+func ComputeETag(content []byte) string {
+	hash := sha256.Sum256(content)
+	return `"` + base64.RawURLEncoding.EncodeToString(hash[:16]) + `"`
+}
+
+// MatchETag returns true if the If-None-Match header of the request matches the entity tag,
+// meaning the client already has the current content.
+//  req with the optional If-None-Match header
+//  etag is the current entity tag of the resource
+func MatchETag(req *http.Request, etag string) bool {
+	ifNoneMatch := req.Header.Get("If-None-Match")
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		// If-None-Match uses the weak comparison
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteJSONWithETag writes the value as JSON with an ETag header. If the request If-None-Match header
+// matches the ETag, then 304 Not Modified is returned without body, so clients that repeatedly fetch
+// the same TD or directory don't transfer unchanged documents.
+// Only use this for GET and HEAD requests.
+//  resp to write the response to
+//  req with the optional If-None-Match header
+//  v is the value to marshal as JSON
+// Returns an error if the value cannot be marshalled or written
+func (srv *TLSServer) WriteJSONWithETag(resp http.ResponseWriter, req *http.Request, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeProblem(resp, req, http.StatusInternalServerError, err.Error())
+		return err
+	}
+	etag := ComputeETag(body)
+	resp.Header().Set("ETag", etag)
+	// require the client to revalidate, as the content can change any time
+	resp.Header().Set("Cache-Control", "no-cache")
+	if MatchETag(req, etag) {
+		resp.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	if req.Method == http.MethodHead {
+		return nil
+	}
+	_, err = resp.Write(body)
+	return err
+}
@@ -4,8 +4,24 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
+// Query parameter names for paging, sorting and filtering of listings
+const (
+	QueryParamOffset = "offset"
+	QueryParamLimit  = "limit"
+	QueryParamSort   = "sort"
+	// QueryParamFilterPrefix is the prefix of filter parameters, eg filter.deviceType=sensor
+	QueryParamFilterPrefix = "filter."
+)
+
+// DefaultPageLimit is the number of items in a page when no limit is given
+const DefaultPageLimit = 100
+
+// MaxPageLimit is the maximum number of items in a page
+const MaxPageLimit = 1000
+
 // GetQueryInt reads the request query parameter and convert it to an integer
 //  request is the request with the query parameter
 //  paramName is the name of the parameter
@@ -46,3 +62,78 @@ func (srv *TLSServer) GetQueryString(
 	}
 	return defaultValue
 }
+
+// GetFilter reads the filter parameters of a listing request, eg ?filter.deviceType=sensor
+//  request is the request with the query parameters
+//  allowedFields are the names of the fields that can be filtered on
+// Returns a map of field name to the required value, or an error if a field is not allowed (bad request)
+func (srv *TLSServer) GetFilter(request *http.Request, allowedFields []string) (map[string]string, error) {
+	filter := make(map[string]string)
+	for paramName, values := range request.URL.Query() {
+		if !strings.HasPrefix(paramName, QueryParamFilterPrefix) {
+			continue
+		}
+		field := strings.TrimPrefix(paramName, QueryParamFilterPrefix)
+		if !containsString(allowedFields, field) {
+			return nil, fmt.Errorf("filtering on '%s' is not supported", field)
+		} else if len(values) != 1 {
+			return nil, fmt.Errorf("invalid query parameter %s", paramName)
+		}
+		filter[field] = values[0]
+	}
+	return filter, nil
+}
+
+// GetPagination reads the offset and limit parameters of a listing request
+// The limit defaults to DefaultPageLimit and is capped at MaxPageLimit.
+//  request is the request with the query parameters
+// Returns the offset and limit, or an error if a parameter is invalid (bad request)
+func (srv *TLSServer) GetPagination(request *http.Request) (offset int, limit int, err error) {
+	offset, err = srv.GetQueryInt(request, QueryParamOffset, 0)
+	if err == nil {
+		limit, err = srv.GetQueryInt(request, QueryParamLimit, DefaultPageLimit)
+	}
+	if err != nil {
+		return 0, 0, err
+	} else if offset < 0 {
+		return 0, 0, fmt.Errorf("invalid query parameter %s: must not be negative", QueryParamOffset)
+	} else if limit < 1 {
+		return 0, 0, fmt.Errorf("invalid query parameter %s: must be at least 1", QueryParamLimit)
+	}
+	if limit > MaxPageLimit {
+		limit = MaxPageLimit
+	}
+	return offset, limit, nil
+}
+
+// GetSort reads the sort parameter of a listing request, eg ?sort=name or ?sort=-name for
+// descending order.
+//  request is the request with the query parameters
+//  allowedFields are the names of the fields that can be sorted on
+//  defaultField to sort on if no sort parameter is given. This must be one of the allowed fields.
+// Returns the sort field and order, or an error if the field is empty or not allowed (bad request)
+func (srv *TLSServer) GetSort(request *http.Request, allowedFields []string, defaultField string) (
+	field string, descending bool, err error) {
+
+	field = srv.GetQueryString(request, QueryParamSort, defaultField)
+	if strings.HasPrefix(field, "-") {
+		field = field[1:]
+		descending = true
+	}
+	if field == "" {
+		return "", false, fmt.Errorf("missing sort field")
+	} else if !containsString(allowedFields, field) {
+		return "", false, fmt.Errorf("sorting on '%s' is not supported", field)
+	}
+	return field, descending, nil
+}
+
+// containsString returns true if the list contains the value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
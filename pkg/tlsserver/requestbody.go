@@ -0,0 +1,63 @@
+package tlsserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultMaxBodySize is the default maximum size of a request body in bytes
+const DefaultMaxBodySize = 1024 * 1024
+
+// ReadJSONBody decodes the JSON request body into the given value.
+// Decoding is strict: unknown fields and trailing data are rejected.
+// On failure an error response is written: 413 if the body exceeds maxBytes, or 400 if the
+// body is not valid JSON for the given value. The handler should simply return in that case.
+//
+//  resp is the response writer for writing the error response
+//  req is the request whose body to decode
+//  v is a pointer to the value to decode into
+//  maxBytes is the maximum body size, or 0 to use DefaultMaxBodySize
+// Returns nil if successful or the error that was written to the response
+func (srv *TLSServer) ReadJSONBody(resp http.ResponseWriter, req *http.Request, v interface{}, maxBytes int64) error {
+	return readJSONBody(resp, req, v, maxBytes)
+}
+
+// readJSONBody implements ReadJSONBody for use by the server and its authenticators
+func readJSONBody(resp http.ResponseWriter, req *http.Request, v interface{}, maxBytes int64) error {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBodySize
+	}
+	if req.Body == nil {
+		err := fmt.Errorf("missing request body")
+		writeProblem(resp, req, http.StatusBadRequest, err.Error())
+		return err
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(resp, req.Body, maxBytes))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err == nil {
+		// only a single JSON value is allowed
+		if decoder.Decode(&struct{}{}) != io.EOF {
+			err = fmt.Errorf("request body must contain a single JSON value")
+		}
+	}
+	if err != nil {
+		// MaxBytesReader does not have a typed error in go 1.14
+		if strings.Contains(err.Error(), "request body too large") {
+			err = fmt.Errorf("request body exceeds %d bytes", maxBytes)
+			logrus.Infof("ReadJSONBody %s %s from %s: %s", req.Method, req.URL.Path, req.RemoteAddr, err)
+			writeProblem(resp, req, http.StatusRequestEntityTooLarge, err.Error())
+			return err
+		}
+		err = fmt.Errorf("invalid request body: %s", err)
+		logrus.Infof("ReadJSONBody %s %s from %s: %s", req.Method, req.URL.Path, req.RemoteAddr, err)
+		writeProblem(resp, req, http.StatusBadRequest, err.Error())
+		return err
+	}
+	return nil
+}
@@ -1,45 +1,96 @@
 package tlsserver
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/sirupsen/logrus"
 )
 
+// ProblemContentType is the content type of error responses, as defined in RFC7807
+const ProblemContentType = "application/problem+json"
+
+// ProblemDetails is the RFC7807 body of error responses
+type ProblemDetails struct {
+	// Type is a URI that identifies the problem type. "about:blank" means the status code describes it.
+	Type string `json:"type"`
+	// Title is the short description of the status code
+	Title string `json:"title"`
+	// Status is the HTTP status code
+	Status int `json:"status"`
+	// Detail is the error message
+	Detail string `json:"detail,omitempty"`
+	// Instance is the path of the request
+	Instance string `json:"instance,omitempty"`
+	// CorrelationID links the response to the server log entry. This is the trace ID if tracing is enabled.
+	CorrelationID string `json:"correlationID"`
+}
+
 // WriteBadRequest logs and respond with bad request error status code and log error
 func (srv *TLSServer) WriteBadRequest(resp http.ResponseWriter, errMsg string) {
-	logrus.Errorf(errMsg)
-	http.Error(resp, errMsg, http.StatusBadRequest)
+	writeProblem(resp, nil, http.StatusBadRequest, errMsg)
 }
 
 // WriteInternalError logs and responds with internal server error status code and log error
 func (srv *TLSServer) WriteInternalError(resp http.ResponseWriter, errMsg string) {
-	logrus.Errorf(errMsg)
-	http.Error(resp, errMsg, http.StatusInternalServerError)
+	writeProblem(resp, nil, http.StatusInternalServerError, errMsg)
 }
 
 // WriteNotFound logs and respond with 404 resource not found
 func (srv *TLSServer) WriteNotFound(resp http.ResponseWriter, errMsg string) {
-	logrus.Errorf(errMsg)
-	http.Error(resp, errMsg, http.StatusNotFound)
+	writeProblem(resp, nil, http.StatusNotFound, errMsg)
 }
 
 // WriteNotImplemented respond with 501 not implemented
 func (srv *TLSServer) WriteNotImplemented(resp http.ResponseWriter, errMsg string) {
-	logrus.Errorf(errMsg)
-	http.Error(resp, errMsg, http.StatusNotImplemented)
+	writeProblem(resp, nil, http.StatusNotImplemented, errMsg)
+}
+
+// WriteProblem logs and responds with an error status code and problem details.
+// Unlike the other write helpers this includes the request path and uses the trace ID of the request,
+// if tracing is enabled, as correlation ID.
+//  resp to write the problem details to
+//  req the problem is about
+//  status is the HTTP error status code
+//  errMsg describes the problem
+func (srv *TLSServer) WriteProblem(resp http.ResponseWriter, req *http.Request, status int, errMsg string) {
+	writeProblem(resp, req, status, errMsg)
 }
 
 // WriteUnauthorized responds with unauthorized (401) status code and log http error
 // Use this when login fails
 func (srv *TLSServer) WriteUnauthorized(resp http.ResponseWriter, errMsg string) {
-	logrus.Errorf(errMsg)
-	http.Error(resp, errMsg, http.StatusUnauthorized)
+	writeProblem(resp, nil, http.StatusUnauthorized, errMsg)
 }
 
 // WriteForbidden logs and respond with forbidden (403) code and log http error
 // Use this when access a resource without sufficient credentials
 func (srv *TLSServer) WriteForbidden(resp http.ResponseWriter, errMsg string) {
-	logrus.Errorf(errMsg)
-	http.Error(resp, errMsg, http.StatusForbidden)
+	writeProblem(resp, nil, http.StatusForbidden, errMsg)
+}
+
+// writeProblem logs the error with a correlation ID and writes the RFC7807 problem details
+//  req is optional and used for the request path and trace ID
+func writeProblem(resp http.ResponseWriter, req *http.Request, status int, errMsg string) {
+	problem := ProblemDetails{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: errMsg,
+	}
+	if req != nil {
+		problem.Instance = req.URL.Path
+		if tc, found := GetTraceContext(req); found {
+			problem.CorrelationID = tc.TraceID
+		}
+	}
+	if problem.CorrelationID == "" {
+		problem.CorrelationID = randomHex(8)
+	}
+	logrus.Errorf("%s (correlationID=%s)", errMsg, problem.CorrelationID)
+	body, _ := json.Marshal(problem)
+	resp.Header().Set("Content-Type", ProblemContentType)
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+	resp.WriteHeader(status)
+	_, _ = resp.Write(body)
 }
@@ -0,0 +1,87 @@
+package units
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// NormalizedValue holds a value converted to the canonical unit and the original value
+type NormalizedValue struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+	// OriginalValue and OriginalUnit as received from the Thing
+	OriginalValue float64 `json:"originalValue"`
+	OriginalUnit  string  `json:"originalUnit"`
+}
+
+// Normalizer converts property values to a configured set of canonical units, one per quantity,
+// so subscribers receive values in the same unit regardless of the device that produced them.
+// Values in units without a canonical unit for their quantity are passed as-is.
+// The normalizer is safe for concurrent use.
+type Normalizer struct {
+	mux sync.RWMutex
+	// canonical unit per quantity
+	canonical map[string]string
+}
+
+// Normalize converts a value to the canonical unit of its quantity
+// Returns an error if the unit is unknown. Unknown units are passed unchanged.
+func (n *Normalizer) Normalize(value float64, unit string) (NormalizedValue, error) {
+	result := NormalizedValue{Value: value, Unit: unit, OriginalValue: value, OriginalUnit: unit}
+	quantity := GetQuantity(unit)
+	if quantity == "" {
+		return result, fmt.Errorf("Normalize: unknown unit '%s'", unit)
+	}
+	n.mux.RLock()
+	canonicalUnit, found := n.canonical[quantity]
+	n.mux.RUnlock()
+	if !found {
+		return result, nil
+	}
+	converted, err := Convert(value, unit, canonicalUnit)
+	if err != nil {
+		return result, err
+	}
+	result.Value = converted
+	result.Unit = canonicalUnit
+	return result, nil
+}
+
+// NormalizeString converts a property value in text form to the canonical unit of its quantity
+// Returns an error if the value is not a number or the unit is unknown
+func (n *Normalizer) NormalizeString(value string, unit string) (NormalizedValue, error) {
+	floatValue, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return NormalizedValue{Unit: unit, OriginalUnit: unit},
+			fmt.Errorf("NormalizeString: value '%s' is not a number", value)
+	}
+	return n.Normalize(floatValue, unit)
+}
+
+// SetCanonicalUnit sets the unit values of its quantity are converted to
+// Returns an error if the unit is unknown
+func (n *Normalizer) SetCanonicalUnit(unit string) error {
+	quantity := GetQuantity(unit)
+	if quantity == "" {
+		return fmt.Errorf("SetCanonicalUnit: unknown unit '%s'", unit)
+	}
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.canonical[quantity] = unit
+	return nil
+}
+
+// NewNormalizer creates a normalizer that converts values to the given canonical units
+//  canonicalUnits with at most one unit per quantity, eg UnitCelsius, UnitKiloPascal
+// Returns an error if a unit is unknown
+func NewNormalizer(canonicalUnits ...string) (*Normalizer, error) {
+	n := &Normalizer{canonical: make(map[string]string)}
+	for _, unit := range canonicalUnits {
+		err := n.SetCanonicalUnit(unit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,163 @@
+// Package units with conversion of property values between units of measurement
+package units
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Quantities that units measure
+const (
+	QuantityTemperature = "temperature"
+	QuantityPressure    = "pressure"
+	QuantityLength      = "length"
+	QuantitySpeed       = "speed"
+	QuantityIlluminance = "illuminance"
+	QuantityRatio       = "ratio"
+	QuantityEnergy      = "energy"
+	QuantityPower       = "power"
+	QuantityVolume      = "volume"
+	QuantityWeight      = "weight"
+)
+
+// Unit names
+const (
+	UnitCelsius    = "celsius"
+	UnitFahrenheit = "fahrenheit"
+	UnitKelvin     = "kelvin"
+
+	UnitPascal      = "Pa"
+	UnitHectoPascal = "hPa"
+	UnitKiloPascal  = "kPa"
+	UnitBar         = "bar"
+	UnitMilliBar    = "mbar"
+	UnitPSI         = "psi"
+	UnitInchHg      = "inHg"
+
+	UnitMeter      = "meter"
+	UnitCentimeter = "cm"
+	UnitMillimeter = "mm"
+	UnitKilometer  = "km"
+	UnitFeet       = "feet"
+	UnitInch       = "inch"
+	UnitMile       = "mile"
+
+	UnitMeterPerSecond = "m/s"
+	UnitKmPerHour      = "km/h"
+	UnitMilePerHour    = "mph"
+	UnitKnot           = "knot"
+
+	UnitLux          = "lux"
+	UnitFootCandle   = "fc"
+	UnitPercent      = "%"
+	UnitFraction     = "fraction"
+	UnitJoule        = "J"
+	UnitKiloWattHour = "kWh"
+	UnitWatt         = "W"
+	UnitKiloWatt     = "kW"
+	UnitLiter        = "liter"
+	UnitMilliLiter   = "ml"
+	UnitCubicMeter   = "m3"
+	UnitGallon       = "gallon"
+	UnitKilogram     = "kg"
+	UnitGram         = "g"
+	UnitPound        = "lb"
+)
+
+// unitInfo describes how to convert a unit to the base unit of its quantity:
+//  base = value*scale + offset
+type unitInfo struct {
+	quantity string
+	scale    float64
+	offset   float64
+}
+
+// units maps unit names to their conversion to the base unit of their quantity
+var units = map[string]unitInfo{
+	// base unit is celsius
+	UnitCelsius:    {QuantityTemperature, 1, 0},
+	UnitFahrenheit: {QuantityTemperature, 5.0 / 9.0, -32 * 5.0 / 9.0},
+	UnitKelvin:     {QuantityTemperature, 1, -273.15},
+	// base unit is pascal
+	UnitPascal:      {QuantityPressure, 1, 0},
+	UnitHectoPascal: {QuantityPressure, 100, 0},
+	UnitKiloPascal:  {QuantityPressure, 1000, 0},
+	UnitBar:         {QuantityPressure, 100000, 0},
+	UnitMilliBar:    {QuantityPressure, 100, 0},
+	UnitPSI:         {QuantityPressure, 6894.757293168, 0},
+	UnitInchHg:      {QuantityPressure, 3386.389, 0},
+	// base unit is meter
+	UnitMeter:      {QuantityLength, 1, 0},
+	UnitCentimeter: {QuantityLength, 0.01, 0},
+	UnitMillimeter: {QuantityLength, 0.001, 0},
+	UnitKilometer:  {QuantityLength, 1000, 0},
+	UnitFeet:       {QuantityLength, 0.3048, 0},
+	UnitInch:       {QuantityLength, 0.0254, 0},
+	UnitMile:       {QuantityLength, 1609.344, 0},
+	// base unit is meter per second
+	UnitMeterPerSecond: {QuantitySpeed, 1, 0},
+	UnitKmPerHour:      {QuantitySpeed, 1000.0 / 3600.0, 0},
+	UnitMilePerHour:    {QuantitySpeed, 1609.344 / 3600.0, 0},
+	UnitKnot:           {QuantitySpeed, 1852.0 / 3600.0, 0},
+	// base unit is lux
+	UnitLux:        {QuantityIlluminance, 1, 0},
+	UnitFootCandle: {QuantityIlluminance, 10.76391, 0},
+	// base unit is percent
+	UnitPercent:  {QuantityRatio, 1, 0},
+	UnitFraction: {QuantityRatio, 100, 0},
+	// base unit is joule
+	UnitJoule:        {QuantityEnergy, 1, 0},
+	UnitKiloWattHour: {QuantityEnergy, 3600000, 0},
+	// base unit is watt
+	UnitWatt:     {QuantityPower, 1, 0},
+	UnitKiloWatt: {QuantityPower, 1000, 0},
+	// base unit is liter
+	UnitLiter:      {QuantityVolume, 1, 0},
+	UnitMilliLiter: {QuantityVolume, 0.001, 0},
+	UnitCubicMeter: {QuantityVolume, 1000, 0},
+	UnitGallon:     {QuantityVolume, 3.785411784, 0},
+	// base unit is kilogram
+	UnitKilogram: {QuantityWeight, 1, 0},
+	UnitGram:     {QuantityWeight, 0.001, 0},
+	UnitPound:    {QuantityWeight, 0.45359237, 0},
+}
+
+// Convert a value from one unit to another unit of the same quantity
+// Returns an error if a unit is unknown or the units measure different quantities
+func Convert(value float64, fromUnit string, toUnit string) (float64, error) {
+	if fromUnit == toUnit {
+		return value, nil
+	}
+	from, found := units[fromUnit]
+	if !found {
+		return value, fmt.Errorf("Convert: unknown unit '%s'", fromUnit)
+	}
+	to, found := units[toUnit]
+	if !found {
+		return value, fmt.Errorf("Convert: unknown unit '%s'", toUnit)
+	}
+	if from.quantity != to.quantity {
+		return value, fmt.Errorf("Convert: cannot convert %s '%s' to %s '%s'",
+			from.quantity, fromUnit, to.quantity, toUnit)
+	}
+	base := value*from.scale + from.offset
+	return (base - to.offset) / to.scale, nil
+}
+
+// GetQuantity returns the quantity measured by a unit, or "" if the unit is unknown
+func GetQuantity(unit string) string {
+	return units[unit].quantity
+}
+
+// ListUnits returns the names of the known units of a quantity in alphabetical order
+//  quantity to list, or "" to list all units
+func ListUnits(quantity string) []string {
+	result := make([]string, 0)
+	for name, info := range units {
+		if quantity == "" || info.quantity == quantity {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,74 @@
+package units_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wostzone/hubserve-go/pkg/units"
+)
+
+func TestConvert(t *testing.T) {
+	value, err := units.Convert(100, units.UnitCelsius, units.UnitFahrenheit)
+	assert.NoError(t, err)
+	assert.InDelta(t, 212, value, 0.0001)
+
+	value, err = units.Convert(32, units.UnitFahrenheit, units.UnitKelvin)
+	assert.NoError(t, err)
+	assert.InDelta(t, 273.15, value, 0.0001)
+
+	value, err = units.Convert(1013.25, units.UnitHectoPascal, units.UnitKiloPascal)
+	assert.NoError(t, err)
+	assert.InDelta(t, 101.325, value, 0.0001)
+
+	value, err = units.Convert(0.5, units.UnitFraction, units.UnitPercent)
+	assert.NoError(t, err)
+	assert.InDelta(t, 50, value, 0.0001)
+
+	// same unit is always allowed
+	value, err = units.Convert(3, "unknown", "unknown")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(3), value)
+
+	_, err = units.Convert(1, units.UnitCelsius, units.UnitKiloPascal)
+	assert.Error(t, err)
+	_, err = units.Convert(1, "unknown", units.UnitKiloPascal)
+	assert.Error(t, err)
+	_, err = units.Convert(1, units.UnitKiloPascal, "unknown")
+	assert.Error(t, err)
+
+	assert.Equal(t, units.QuantityTemperature, units.GetQuantity(units.UnitKelvin))
+	assert.Equal(t, []string{units.UnitCelsius, units.UnitFahrenheit, units.UnitKelvin},
+		units.ListUnits(units.QuantityTemperature))
+	assert.Greater(t, len(units.ListUnits("")), 10)
+}
+
+func TestNormalizer(t *testing.T) {
+	normalizer, err := units.NewNormalizer(units.UnitCelsius, units.UnitKiloPascal)
+	require.NoError(t, err)
+
+	result, err := normalizer.Normalize(212, units.UnitFahrenheit)
+	assert.NoError(t, err)
+	assert.InDelta(t, 100, result.Value, 0.0001)
+	assert.Equal(t, units.UnitCelsius, result.Unit)
+	assert.Equal(t, float64(212), result.OriginalValue)
+	assert.Equal(t, units.UnitFahrenheit, result.OriginalUnit)
+
+	result, err = normalizer.NormalizeString("1013.25", units.UnitHectoPascal)
+	assert.NoError(t, err)
+	assert.InDelta(t, 101.325, result.Value, 0.0001)
+
+	// no canonical unit for lengths
+	result, err = normalizer.Normalize(3, units.UnitFeet)
+	assert.NoError(t, err)
+	assert.Equal(t, units.UnitFeet, result.Unit)
+	assert.Equal(t, float64(3), result.Value)
+
+	_, err = normalizer.Normalize(3, "unknown")
+	assert.Error(t, err)
+	_, err = normalizer.NormalizeString("warm", units.UnitCelsius)
+	assert.Error(t, err)
+
+	_, err = units.NewNormalizer("unknown")
+	assert.Error(t, err)
+}